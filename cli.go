@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"pgp-sftp-proxy/lib"
+)
+
+// runCommand runs encrypt, upload, batch or watch with the same code as the http service, without starting it
+func runCommand(conf *lib.Config, name string, args []string) int {
+	err := lib.SetupLog(&conf.Log)
+	if err != nil {
+		return (&lib.CommandResult{}).Print(os.Stdout, err)
+	}
+	shutdownTracing, err := lib.SetupTracing(&conf.Tracing)
+	if err != nil {
+		return (&lib.CommandResult{}).Print(os.Stdout, err)
+	}
+	defer shutdownTracing(context.Background())
+
+	if name == "watch" {
+		return watchCommand(conf)
+	}
+	return lib.RunCommand(conf, name, args, &lib.CommandIO{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr})
+}
+
+// watch, delivers the files dropped into watch.folders until SIGINT / SIGTERM, without the http service
+func watchCommand(conf *lib.Config) int {
+	err := conf.Validate()
+	if err == nil && len(conf.Watch.Folders) <= 0 {
+		err = errors.New("no watch.folders configured")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return lib.ExitFail
+	}
+	audit := lib.NewAuditLog(conf.Audit.Path)
+	defer audit.Close()
+	watcher := lib.NewWatcher(conf, lib.NewScheduler(&conf.Concurrency), audit)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = watcher.Run(ctx)
+	stop()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return lib.ExitFail
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout())
+	defer cancel()
+	err = watcher.Wait(shutdownCtx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return lib.ExitFail
+	}
+	return lib.ExitOK
+}
@@ -0,0 +1,34 @@
+#!/bin/sh
+# Starts the service in the docker image. The environment variables of the images before the
+# PGPSFTP_* overrides (HOST, SSH_PWD, DEPLOY_PATH_PRODUCTION...) are still read, a PGPSFTP_* one
+# set as well wins. The arguments are passed on, e.g. validate-config.
+
+# legacy OLD NEW, copies $OLD into $NEW when OLD is set and NEW is not
+legacy() {
+	eval "old=\${$1:-} new=\${$2:-}"
+	if [ -n "$old" ] && [ -z "$new" ]; then
+		echo "$1 is deprecated, use $2" >&2
+		export "$2=$old"
+	fi
+}
+
+legacy HOST PGPSFTP_LISTEN
+legacy ROOT PGPSFTP_WEB_ROOT
+legacy TEMP PGPSFTP_TMP_PATH
+legacy SSH_HOST PGPSFTP_SSH_HOST
+legacy SSH_USER PGPSFTP_SSH_USER
+legacy SSH_PWD PGPSFTP_SSH_PASSWORD
+legacy SSH_KEY PGPSFTP_SSH_KEY
+legacy DEPLOY_PATH_DEV PGPSFTP_DEPLOY_PATH_DEV
+legacy DEPLOY_PATH_PRODUCTION PGPSFTP_DEPLOY_PATH_PRO
+legacy DEPLOY_PATH_TESTING PGPSFTP_DEPLOY_PATH_TEST
+
+# the defaults of the image, after the legacy names so those still replace them
+export PGPSFTP_LISTEN="${PGPSFTP_LISTEN:-0.0.0.0:3333}"
+export PGPSFTP_WEB_ROOT="${PGPSFTP_WEB_ROOT-/app/web_root}"
+export PGPSFTP_TMP_PATH="${PGPSFTP_TMP_PATH:-/tmp}"
+export PGPSFTP_DEPLOY_PATH_DEV="${PGPSFTP_DEPLOY_PATH_DEV:-/Interface_Development_Files/}"
+export PGPSFTP_DEPLOY_PATH_PRO="${PGPSFTP_DEPLOY_PATH_PRO:-/Interface_Production_Files/}"
+export PGPSFTP_DEPLOY_PATH_TEST="${PGPSFTP_DEPLOY_PATH_TEST:-/Interface_UAT_Files/}"
+
+exec /app/pgp-sftp-proxy -c /app/config.json "$@"
@@ -0,0 +1,278 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prev_hash of the first entry
+const auditGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+var ErrAuditChain = errors.New("audit log chain broken")
+
+type AuditConfig struct {
+	// append-only audit log file, empty disables the audit log
+	Path string `json:"path"`
+}
+
+// one delivered (or failed) file, hash-chained to the entry before it
+type AuditEntry struct {
+	Seq              int64     `json:"seq"`
+	Started          time.Time `json:"started"`
+	Finished         time.Time `json:"finished"`
+	Caller           string    `json:"caller"`
+	RemoteAddr       string    `json:"remote_addr"`
+	ClaimedClientID  string    `json:"claimed_client_id,omitempty"`
+	RequestID        string    `json:"request_id,omitempty"`
+	JobID            string    `json:"job_id,omitempty"`
+	Filename         string    `json:"filename"`
+	PlaintextSHA256  string    `json:"plaintext_sha256,omitempty"`
+	CiphertextSHA256 string    `json:"ciphertext_sha256,omitempty"`
+	Recipients       []string  `json:"recipients"`
+	Host             string    `json:"host"`
+	Destination      string    `json:"destination,omitempty"`
+	RemotePath       string    `json:"remote_path"`
+	Outcome          string    `json:"outcome"`
+	Error            string    `json:"error,omitempty"`
+	PrevHash         string    `json:"prev_hash"`
+	Hash             string    `json:"hash"`
+}
+
+// sha256 over the entry's JSON without the hash field
+func (e *AuditEntry) computeHash() (string, error) {
+	entry := *e
+	entry.Hash = ""
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog appends entries to a JSON lines file, each one carrying the hash of the previous
+type AuditLog struct {
+	path     string
+	mu       sync.Mutex
+	file     *os.File
+	seq      int64
+	lastHash string
+}
+
+// NewAuditLog returns nil when path is empty, recording on a nil AuditLog is a no-op
+func NewAuditLog(path string) *AuditLog {
+	if len(path) <= 0 {
+		return nil
+	}
+	return &AuditLog{path: path}
+}
+
+func (a *AuditLog) Path() string {
+	return a.path
+}
+
+// Open creates the file or continues the chain of an existing one
+func (a *AuditLog) Open() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.open()
+}
+
+func (a *AuditLog) open() error {
+	if a.file != nil {
+		return nil
+	}
+
+	last, err := lastAuditEntry(a.path)
+	if err != nil {
+		return err
+	}
+	a.seq, a.lastHash = 0, auditGenesisHash
+	if last != nil {
+		a.seq, a.lastHash = last.Seq, last.Hash
+	}
+
+	err = os.MkdirAll(filepath.Dir(a.path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	a.file, err = os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	return err
+}
+
+func lastAuditEntry(path string) (*AuditEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var last []byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			last = append(last[:0], line...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, nil
+	}
+
+	entry := &AuditEntry{}
+	err = json.Unmarshal(last, entry)
+	if err != nil {
+		return nil, fmt.Errorf("%w: last entry of %s: %s", ErrAuditChain, path, err)
+	}
+	return entry, nil
+}
+
+// Record chains and appends entry, synced to disk before returning.
+// A failure is counted, the delivery it records must fail with it.
+func (a *AuditLog) Record(entry *AuditEntry) error {
+	if a == nil {
+		return nil
+	}
+	err := a.record(entry)
+	if err != nil {
+		auditFailures.Inc()
+		return fmt.Errorf("audit log: %w", err)
+	}
+	return nil
+}
+
+func (a *AuditLog) record(entry *AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	err := a.open()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	entry.Seq = a.seq + 1
+	entry.Started = entry.Started.UTC()
+	entry.Finished = entry.Finished.UTC()
+	entry.PrevHash = a.lastHash
+	entry.Hash, err = entry.computeHash()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	_, err = a.file.Write(append(data, '\n'))
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	a.seq, a.lastHash = entry.Seq, entry.Hash
+	return nil
+}
+
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// VerifyAuditLog checks sequence, links and hashes of every entry,
+// returning the number of entries and the hash of the last one
+func VerifyAuditLog(path string) (count int64, head string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	head = auditGenesisHash
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) <= 0 {
+			continue
+		}
+		entry := &AuditEntry{}
+		err = json.Unmarshal(data, entry)
+		if err != nil {
+			return count, head, fmt.Errorf("%w: line %d: %s", ErrAuditChain, line, err)
+		}
+		if entry.Seq != count+1 {
+			return count, head, fmt.Errorf("%w: line %d: seq %d, expected %d", ErrAuditChain, line, entry.Seq, count+1)
+		}
+		if entry.PrevHash != head {
+			return count, head, fmt.Errorf("%w: line %d: prev_hash does not match the previous entry", ErrAuditChain, line)
+		}
+		hash, err := entry.computeHash()
+		if err != nil {
+			return count, head, err
+		}
+		if hash != entry.Hash {
+			return count, head, fmt.Errorf("%w: line %d: hash mismatch, entry was modified", ErrAuditChain, line)
+		}
+		count, head = entry.Seq, entry.Hash
+	}
+	return count, head, scanner.Err()
+}
+
+// the remote ip of the request, the service does not authenticate its callers
+func callerIdentity(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// the X-Client-ID header, anyone can send it so it is recorded apart from the caller
+func claimedClientID(request *http.Request) string {
+	return strings.TrimSpace(request.Header.Get("X-Client-ID"))
+}
+
+func auditOutcome(err error) (string, string) {
+	if err != nil {
+		return "failure", err.Error()
+	}
+	return "success", ""
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func recordTestAudit(auditLog *AuditLog, filename string) error {
+	return auditLog.Record(&AuditEntry{
+		Started:         time.Now(),
+		Finished:        time.Now(),
+		Caller:          "tester",
+		Filename:        filename,
+		PlaintextSHA256: strings.Repeat("a", 64),
+		Recipients:      []string{"0123456789ABCDEF0123456789ABCDEF01234567"},
+		Host:            "sftp.example.com:22",
+		RemotePath:      "/dev/" + filename + ".pgp",
+		Outcome:         "success",
+	})
+}
+
+func Test_AuditChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	auditLog := NewAuditLog(path)
+	for _, name := range []string{"a.pdf", "b.pdf"} {
+		if err := recordTestAudit(auditLog, name); err != nil {
+			t.Log(err)
+			t.Fail()
+			return
+		}
+	}
+	auditLog.Close()
+
+	// a reopened log continues the chain
+	auditLog = NewAuditLog(path)
+	if err := recordTestAudit(auditLog, "c.pdf"); err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	auditLog.Close()
+
+	count, head, err := VerifyAuditLog(path)
+	if err != nil || count != 3 || len(head) != 64 {
+		t.Log(count, head, err)
+		t.Fail()
+		return
+	}
+}
+
+func Test_AuditTampered(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	auditLog := NewAuditLog(path)
+	for _, name := range []string{"a.pdf", "b.pdf", "c.pdf"} {
+		if err := recordTestAudit(auditLog, name); err != nil {
+			t.Log(err)
+			t.Fail()
+			return
+		}
+	}
+	auditLog.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+	tests := map[string]string{
+		"modified": strings.Join([]string{lines[0], strings.Replace(lines[1], "b.pdf", "x.pdf", -1), lines[2]}, "\n"),
+		"removed":  strings.Join([]string{lines[0], lines[2]}, "\n"),
+		"reorder":  strings.Join([]string{lines[1], lines[0], lines[2]}, "\n"),
+	}
+	for name, content := range tests {
+		tampered := filepath.Join(t.TempDir(), name+".log")
+		if err := ioutil.WriteFile(tampered, []byte(content+"\n"), 0600); err != nil {
+			t.Log(err)
+			t.Fail()
+			return
+		}
+		_, _, err = VerifyAuditLog(tampered)
+		if !errors.Is(err, ErrAuditChain) {
+			t.Log(name, err)
+			t.Fail()
+		}
+	}
+}
+
+func Test_AuditDisabled(t *testing.T) {
+	var auditLog = NewAuditLog("")
+	if auditLog != nil || recordTestAudit(auditLog, "a.pdf") != nil || auditLog.Open() != nil {
+		t.Fail()
+	}
+}
+
+func Test_CallerIdentity(t *testing.T) {
+	req := httptest.NewRequest("POST", "/upload", nil)
+	req.RemoteAddr = "10.0.0.1:5555"
+	req.Header.Set("X-Client-ID", "zurich-portal")
+	// the header is only claimed, anyone can send it
+	if callerIdentity(req) != "10.0.0.1" || claimedClientID(req) != "zurich-portal" {
+		t.Log(callerIdentity(req), claimedClientID(req))
+		t.Fail()
+	}
+}
+
+func Test_AuditFailureFailsUpload(t *testing.T) {
+	broken := filepath.Join(t.TempDir(), "file")
+	writeTestFile(t, broken, "not a folder")
+	auditLog := NewAuditLog(filepath.Join(broken, "audit.log"))
+	conf := &Config{
+		TempPath:  t.TempDir(),
+		Transport: TransportConfig{Type: TransportLocal, Local: LocalConfig{Path: t.TempDir()}},
+		Deploy:    DeployPath{Development: "/dev"},
+	}
+
+	_, err := Upload(context.Background(), conf, nil, auditLog, &UploadRequest{
+		Filename: "a.txt",
+		Reader:   strings.NewReader("hello"),
+		Key:      getTestPGPKey(t),
+		Deploy:   "dev",
+	})
+	if err == nil || !strings.Contains(err.Error(), "audit log") {
+		t.Errorf("expected the upload to fail with the audit log, got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("sha256 checksum mismatch")
+	ErrSizeMismatch     = errors.New("file size mismatch")
+)
+
+// swagger:model
+type FileResult struct {
+	// original file name
+	Name string `json:"name"`
+	// received size in bytes
+	Size int64 `json:"size"`
+	// SHA-256 (hex) of the received file
+	SHA256 string `json:"sha256"`
+	// path of the encrypted file on the sftp, once delivered
+	Remote string `json:"remote,omitempty"`
+}
+
+func ChecksumReader(name string, reader io.Reader) (*FileResult, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileResult{
+		Name:   name,
+		Size:   size,
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+func ChecksumFile(name string, filePath string) (*FileResult, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ChecksumReader(name, file)
+}
+
+// Verify compares with the caller supplied values, empty sum / zero size are skipped
+func (r *FileResult) Verify(expectSHA256 string, expectSize int64) error {
+	if expectSize > 0 && expectSize != r.Size {
+		return fmt.Errorf("%w: %s expected %d bytes, got %d", ErrSizeMismatch, r.Name, expectSize, r.Size)
+	}
+	if len(expectSHA256) > 0 && !strings.EqualFold(strings.TrimSpace(expectSHA256), r.SHA256) {
+		return fmt.Errorf("%w: %s expected %s, got %s", ErrChecksumMismatch, r.Name, expectSHA256, r.SHA256)
+	}
+	return nil
+}
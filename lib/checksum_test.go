@@ -0,0 +1,32 @@
+package lib
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func Test_ChecksumVerify(t *testing.T) {
+	result, err := ChecksumReader("hello.txt", strings.NewReader("hello"))
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	if result.Size != 5 || result.SHA256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("unexpected checksum %+v", result)
+	}
+
+	if err := result.Verify("", 0); err != nil {
+		t.Errorf("empty expectation should pass, got %v", err)
+	}
+	if err := result.Verify("2CF24DBA5FB0A30E26E83B2AC5B9E29E1B161E5C1FA7425E73043362938B9824", 5); err != nil {
+		t.Errorf("matching checksum should pass, got %v", err)
+	}
+	if err := result.Verify("", 6); !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("expected size mismatch, got %v", err)
+	}
+	if err := result.Verify("deadbeef", 0); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+}
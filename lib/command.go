@@ -0,0 +1,249 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// exit codes of the encrypt, upload and batch commands
+const (
+	ExitOK    = 0
+	ExitFail  = 1
+	ExitUsage = 2
+)
+
+// CommandResult is printed as JSON by encrypt, upload and batch
+type CommandResult struct {
+	ServiceResult
+	// encrypt: the encrypted file
+	Output string `json:"output,omitempty"`
+	// upload: the file on the sftp
+	Remote string `json:"remote,omitempty"`
+}
+
+// CommandIO are the streams of a command, os.Stdin, os.Stdout and os.Stderr for the program
+type CommandIO struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// RunCommand runs encrypt, upload or batch with the same code as the http service. The result is one line
+// of JSON on Stdout, the exit code ExitOK, ExitFail, or ExitUsage for wrong arguments with the usage on Stderr.
+// encrypt only reads conf.TempPath, for the PDF of an image.
+func RunCommand(conf *Config, name string, args []string, streams *CommandIO) int {
+	switch name {
+	case "encrypt":
+		return encryptCommand(conf, args, streams)
+	case "upload":
+		return uploadCommand(conf, args, streams)
+	case "batch":
+		return batchCommand(conf, args, streams)
+	}
+	fmt.Fprintln(streams.Stderr, "unknown command:", name)
+	return ExitUsage
+}
+
+// encrypt <file> --key <public key file> [-o <output file>|-]
+func encryptCommand(conf *Config, args []string, streams *CommandIO) int {
+	flags := flag.NewFlagSet("encrypt", flag.ContinueOnError)
+	keyFile := flags.String("key", "", "PGP public key file")
+	output := flags.String("o", "", "encrypted file, default <file>.pgp, - writes it to stdout")
+	files, err := parseCommand(flags, args)
+	if err != nil || len(files) != 1 || len(*keyFile) <= 0 {
+		return commandUsage(streams, flags, "encrypt <file> --key <public key file> [-o <output file>|-]")
+	}
+
+	result := &CommandResult{}
+	key, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		return result.Print(streams.Stdout, err)
+	}
+	helper, err := NewPGPHelper(strings.NewReader(string(key)))
+	if err != nil {
+		return result.Print(streams.Stdout, err)
+	}
+	source, err := os.Open(files[0])
+	if err != nil {
+		return result.Print(streams.Stdout, err)
+	}
+	defer source.Close()
+	received, err := ChecksumReader(filepath.Base(files[0]), source)
+	if err == nil {
+		_, err = source.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return result.Print(streams.Stdout, err)
+	}
+	result.Files = []*FileResult{received}
+
+	buffer, filename, err := EncryptSource(context.Background(), conf, nil, helper, files[0], IsImageFile(files[0]), source)
+	if err != nil {
+		return result.Print(streams.Stdout, err)
+	}
+	// with the ciphertext on stdout the result goes to stderr
+	if *output == "-" {
+		_, err = io.Copy(streams.Stdout, buffer)
+		return result.Print(streams.Stderr, err)
+	}
+	result.Output = *output
+	if len(result.Output) <= 0 {
+		result.Output = filename + ".pgp"
+	}
+	err = ioutil.WriteFile(result.Output, buffer.Bytes(), 0644)
+	return result.Print(streams.Stdout, err)
+}
+
+// upload <file> --env <dev|pro|test> --key <public key file> [--sha256 <hex>] [--size <bytes>]
+func uploadCommand(conf *Config, args []string, streams *CommandIO) int {
+	flags := flag.NewFlagSet("upload", flag.ContinueOnError)
+	keyFile := flags.String("key", "", "PGP public key file")
+	env := flags.String("env", "", "sftp remote save folder: dev, pro or test")
+	sha256 := flags.String("sha256", "", "expected SHA-256 (hex) of the file")
+	size := flags.Int64("size", 0, "expected size in bytes of the file")
+	files, err := parseCommand(flags, args)
+	if err != nil || len(files) != 1 || len(*keyFile) <= 0 || len(*env) <= 0 {
+		return commandUsage(streams, flags, "upload <file> --env <dev|pro|test> --key <public key file> [--sha256 <hex>] [--size <bytes>]")
+	}
+
+	result := &CommandResult{}
+	err = conf.Validate()
+	if err != nil {
+		return result.Print(streams.Stdout, err)
+	}
+	key, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		return result.Print(streams.Stdout, err)
+	}
+	source, err := os.Open(files[0])
+	if err != nil {
+		return result.Print(streams.Stdout, err)
+	}
+	defer source.Close()
+	received, err := ChecksumReader(filepath.Base(files[0]), source)
+	if err == nil {
+		result.Files = []*FileResult{received}
+		err = received.Verify(*sha256, *size)
+	}
+	if err == nil {
+		_, err = source.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return result.Print(streams.Stdout, err)
+	}
+
+	audit := NewAuditLog(conf.Audit.Path)
+	err = audit.Open()
+	if err != nil {
+		return result.Print(streams.Stdout, err)
+	}
+	defer audit.Close()
+	result.Remote, err = Upload(context.Background(), conf, NewScheduler(&conf.Concurrency), audit, &UploadRequest{
+		Filename: filepath.Base(files[0]),
+		Reader:   source,
+		Image:    IsImageFile(files[0]),
+		Key:      string(key),
+		Deploy:   *env,
+		Received: received,
+		Caller:   commandCaller(),
+	})
+	return result.Print(streams.Stdout, err)
+}
+
+// batch <request.json>|-, runs a /multiple/upload request body to the end
+func batchCommand(conf *Config, args []string, streams *CommandIO) int {
+	flags := flag.NewFlagSet("batch", flag.ContinueOnError)
+	files, err := parseCommand(flags, args)
+	if err != nil || len(files) != 1 {
+		return commandUsage(streams, flags, "batch <request.json>|-")
+	}
+
+	result := &CommandResult{}
+	err = conf.Validate()
+	if err != nil {
+		return result.Print(streams.Stdout, err)
+	}
+	var data []byte
+	if files[0] == "-" {
+		data, err = ioutil.ReadAll(streams.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(files[0])
+	}
+	if err != nil {
+		return result.Print(streams.Stdout, err)
+	}
+	body := &MultipleBody{}
+	err = json.Unmarshal(data, body)
+	if err == nil {
+		err = body.Validate()
+	}
+	if err != nil {
+		return result.Print(streams.Stdout, err)
+	}
+
+	audit := NewAuditLog(conf.Audit.Path)
+	err = audit.Open()
+	if err != nil {
+		return result.Print(streams.Stdout, err)
+	}
+	defer audit.Close()
+	result.ServiceResult = *RunJob(context.Background(), conf, body, commandCaller(), audit)
+	if !result.Status {
+		return result.Print(streams.Stdout, errors.New(result.Error))
+	}
+	return result.Print(streams.Stdout, nil)
+}
+
+// parseCommand allows the flags before and after the arguments, e.g. upload a.pdf --env pro
+func parseCommand(flags *flag.FlagSet, args []string) ([]string, error) {
+	flags.SetOutput(ioutil.Discard)
+	positional := make([]string, 0)
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) <= 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func commandUsage(streams *CommandIO, flags *flag.FlagSet, text string) int {
+	fmt.Fprintln(streams.Stderr, "usage: pgp-sftp-proxy [-c config] "+text)
+	flags.SetOutput(streams.Stderr)
+	flags.PrintDefaults()
+	return ExitUsage
+}
+
+// the audit log caller of the commands
+func commandCaller() string {
+	if user := os.Getenv("USER"); len(user) > 0 {
+		return "cli:" + user
+	}
+	return "cli"
+}
+
+// Print writes the result with the outcome err as one line of JSON and returns the exit code
+func (result *CommandResult) Print(writer io.Writer, err error) int {
+	code := ExitOK
+	result.Status = err == nil
+	if err != nil {
+		result.Error = err.Error()
+		code = ExitFail
+	}
+	data, _ := json.Marshal(result)
+	fmt.Fprintln(writer, string(data))
+	return code
+}
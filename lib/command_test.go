@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// writes the public key of a new key pair to path, returns the pair
+func writeTestPublicKey(t *testing.T, path string) openpgp.EntityList {
+	keyring := writeTestMasterKey(t, filepath.Join(t.TempDir(), "private.asc"))
+	publicKey := new(bytes.Buffer)
+	writer, err := armor.Encode(publicKey, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring[0].Serialize(writer)
+	writer.Close()
+	writeTestFile(t, path, publicKey.String())
+	return keyring
+}
+
+// runs a command, returns its exit code, stdout and stderr
+func runTestCommand(conf *Config, name string, stdin string, args ...string) (int, string, string) {
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	code := RunCommand(conf, name, args, &CommandIO{Stdin: strings.NewReader(stdin), Stdout: stdout, Stderr: stderr})
+	return code, stdout.String(), stderr.String()
+}
+
+func decodeTestResult(t *testing.T, output string) *CommandResult {
+	result := &CommandResult{}
+	if err := json.Unmarshal([]byte(output), result); err != nil || strings.Count(output, "\n") != 1 {
+		t.Fatalf("expected one line of JSON, got %q %v", output, err)
+	}
+	return result
+}
+
+func Test_ParseCommand(t *testing.T) {
+	for _, args := range [][]string{
+		{"a.pdf", "--env", "pro", "b.pdf"},
+		{"--env", "pro", "a.pdf", "b.pdf"},
+		{"a.pdf", "b.pdf", "--env=pro"},
+	} {
+		flags := flag.NewFlagSet("upload", flag.ContinueOnError)
+		env := flags.String("env", "", "")
+		files, err := parseCommand(flags, args)
+		if err != nil || *env != "pro" || !reflect.DeepEqual(files, []string{"a.pdf", "b.pdf"}) {
+			t.Errorf("%v: unexpected %v %s %v", args, files, *env, err)
+		}
+	}
+	if _, err := parseCommand(flag.NewFlagSet("upload", flag.ContinueOnError), []string{"a.pdf", "--env", "pro"}); err == nil {
+		t.Error("expected an unknown flag to be refused")
+	}
+}
+
+func Test_EncryptCommand(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "public.asc")
+	keyring := writeTestPublicKey(t, keyFile)
+	source := filepath.Join(dir, "report.txt")
+	writeTestFile(t, source, "quarterly report")
+	// no config file, only the folder for the PDF of an image
+	conf := &Config{TempPath: t.TempDir()}
+
+	code, stdout, _ := runTestCommand(conf, "encrypt", "", source, "--key", keyFile)
+	result := decodeTestResult(t, stdout)
+	if code != ExitOK || !result.Status || result.Output != source+".pgp" || len(result.Files) != 1 || result.Files[0].Size != 16 {
+		t.Fatalf("unexpected result %d %s", code, stdout)
+	}
+	if data := readTestPGPFile(t, keyring, result.Output); string(data) != "quarterly report" {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	// the ciphertext on stdout, the result on stderr
+	code, stdout, stderr := runTestCommand(conf, "encrypt", "", "-o", "-", "--key", keyFile, source)
+	if code != ExitOK || !strings.HasPrefix(stdout, "-----BEGIN PGP MESSAGE-----") || !decodeTestResult(t, stderr).Status {
+		t.Errorf("unexpected output %d %q %q", code, stdout, stderr)
+	}
+
+	code, stdout, _ = runTestCommand(conf, "encrypt", "", filepath.Join(dir, "missing.txt"), "--key", keyFile)
+	if result := decodeTestResult(t, stdout); code != ExitFail || result.Status || !strings.Contains(result.Error, "missing.txt") {
+		t.Errorf("expected the missing file to fail, got %d %s", code, stdout)
+	}
+
+	for _, args := range [][]string{{source}, {"--key", keyFile}, {source, "--key", keyFile, "--env", "pro"}} {
+		code, stdout, stderr = runTestCommand(conf, "encrypt", "", args...)
+		if code != ExitUsage || len(stdout) > 0 || !strings.HasPrefix(stderr, "usage: ") {
+			t.Errorf("%v: expected the usage, got %d %q %q", args, code, stdout, stderr)
+		}
+	}
+}
+
+func Test_UploadCommand(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	conf := getHealthTestConfig(t, newTestSFTPServer(t))
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "public.asc")
+	keyring := writeTestPublicKey(t, keyFile)
+	source := filepath.Join(dir, "report.txt")
+	writeTestFile(t, source, "quarterly report")
+
+	code, stdout, _ := runTestCommand(conf, "upload", "", source, "--env", "pro", "--key", keyFile, "--size", "16")
+	result := decodeTestResult(t, stdout)
+	if code != ExitOK || !result.Status || result.Remote != filepath.Join(conf.Deploy.Production, "report.txt.pgp") {
+		t.Fatalf("unexpected result %d %s", code, stdout)
+	}
+	if data := readTestPGPFile(t, keyring, result.Remote); string(data) != "quarterly report" {
+		t.Errorf("unexpected content %q", data)
+	}
+	os.Remove(result.Remote)
+
+	code, stdout, _ = runTestCommand(conf, "upload", "", source, "--env", "pro", "--key", keyFile, "--sha256", "deadbeef")
+	if result := decodeTestResult(t, stdout); code != ExitFail || !strings.HasPrefix(result.Error, ErrChecksumMismatch.Error()) {
+		t.Errorf("expected a checksum mismatch, got %d %s", code, stdout)
+	}
+	if _, err := os.Stat(filepath.Join(conf.Deploy.Production, "report.txt.pgp")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing uploaded, got %v", err)
+	}
+
+	code, _, stderr := runTestCommand(conf, "upload", "", source, "--key", keyFile)
+	if code != ExitUsage || !strings.Contains(stderr, "--env <dev|pro|test>") {
+		t.Errorf("expected the usage, got %d %q", code, stderr)
+	}
+
+	code, stdout, _ = runTestCommand(&Config{}, "upload", "", source, "--env", "pro", "--key", keyFile)
+	if result := decodeTestResult(t, stdout); code != ExitFail || !strings.Contains(result.Error, "deploy_path.pro is required") {
+		t.Errorf("expected the invalid config to fail, got %d %s", code, stdout)
+	}
+}
+
+func Test_BatchCommand(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	files := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("content of a.txt"))
+	}))
+	defer files.Close()
+	conf := getHealthTestConfig(t, newTestSFTPServer(t))
+	conf.Download = DownloadConfig{AllowPrivate: true, Timeout: 5}
+	keyFile := filepath.Join(t.TempDir(), "public.asc")
+	keyring := writeTestPublicKey(t, keyFile)
+	publicKey, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := json.Marshal(&MultipleBody{
+		Files:  []*ZurichFile{{Name: "a.txt", Url: files.URL + "/a.txt"}},
+		PGPKey: string(publicKey),
+		ENV:    "test",
+	})
+	code, stdout, _ := runTestCommand(conf, "batch", string(request), "-")
+	result := decodeTestResult(t, stdout)
+	if code != ExitOK || !result.Status || len(result.Files) != 1 || len(result.Files[0].Remote) <= 0 {
+		t.Fatalf("unexpected result %d %s", code, stdout)
+	}
+	if data := readTestPGPFile(t, keyring, result.Files[0].Remote); string(data) != "content of a.txt" {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	code, stdout, _ = runTestCommand(conf, "batch", `{"files": [`, "-")
+	if result := decodeTestResult(t, stdout); code != ExitFail || result.Status {
+		t.Errorf("expected the broken request to fail, got %d %s", code, stdout)
+	}
+	code, stdout, _ = runTestCommand(conf, "batch", "", filepath.Join(t.TempDir(), "missing.json"))
+	if code != ExitFail || decodeTestResult(t, stdout).Status {
+		t.Errorf("expected the missing request to fail, got %d %s", code, stdout)
+	}
+	if code, _, _ = runTestCommand(conf, "batch", ""); code != ExitUsage {
+		t.Errorf("expected the usage, got %d", code)
+	}
+	if code, _, _ = runTestCommand(conf, "sync", ""); code != ExitUsage {
+		t.Errorf("expected an unknown command, got %d", code)
+	}
+}
@@ -1,8 +1,20 @@
 package lib
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/op/go-logging"
+	"golang.org/x/crypto/openpgp"
 )
 
 type DeployPath struct {
@@ -12,48 +24,238 @@ type DeployPath struct {
 }
 
 type Config struct {
-	Listen    string     `json:"listen"`
-	TempPath  string     `json:"tmp_path"`
-	WebRoot   string     `json:"web_root"`
-	SSH       SSHItem    `json:"ssh"`
-	Deploy    DeployPath `json:"deploy_path"`
-	save_path string
+	Listen       string              `json:"listen"`
+	TempPath     string              `json:"tmp_path"`
+	WebRoot      string              `json:"web_root"`
+	SSH          SSHItem             `json:"ssh"`
+	Transport    TransportConfig     `json:"transport"`
+	Destinations []DestinationConfig `json:"destinations"`
+	Delivery     DeliveryConfig      `json:"delivery"`
+	Deploy       DeployPath          `json:"deploy_path"`
+	Naming       NamingConfig        `json:"naming"`
+	Manifest     ManifestConfig      `json:"manifest"`
+	Package      PackageConfig       `json:"package"`
+	Download     DownloadConfig      `json:"download"`
+	Concurrency  ConcurrencyConfig   `json:"concurrency"`
+	Queue        QueueConfig         `json:"queue"`
+	Health       HealthConfig        `json:"health"`
+	Log          LogConfig           `json:"log"`
+	Audit        AuditConfig         `json:"audit"`
+	Tracing      TracingConfig       `json:"tracing"`
+	Shutdown     ShutdownConfig      `json:"shutdown"`
+	Reload       ReloadConfig        `json:"reload"`
+	Admin        AdminConfig         `json:"admin"`
+	Secrets      SecretsConfig       `json:"secrets"`
+	Watch        WatchConfig         `json:"watch"`
+	save_path    string
+	paths        []string
+	// decrypts the ENC[PGP,...] secrets, Save encrypts to it
+	masterKey openpgp.EntityList
+	// the settings as loaded, Save writes the ones changed since
+	loaded map[string]interface{}
+	// the settings of the PGPSFTP_* environment, Save leaves them out
+	envPaths map[string]bool
+	// the keys of the files no setting reads, see Warnings
+	warnings []string
 }
 
-func NewConfig(filename string) (err error, c *Config) {
+// NewConfig loads the config files in order, later files override the settings they set,
+// then applies the PGPSFTP_* environment overrides and the *_file secrets, and decrypts the ENC[PGP,...] secrets
+func NewConfig(filenames ...string) (err error, c *Config) {
 	c = &Config{}
-	c.save_path = filename
-	err = c.load(filename)
+	if len(filenames) <= 0 {
+		err = errors.New("no config file")
+		log.Error(err)
+		return
+	}
+	c.paths = filenames
+	// Save writes the last, most specific file
+	c.save_path = filenames[len(filenames)-1]
+	for _, filename := range filenames {
+		err = c.load(filename)
+		if err != nil {
+			return
+		}
+	}
+	err = c.applyEnv(os.LookupEnv)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	err = c.resolveSecretFiles()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	err = c.decryptSecrets(os.LookupEnv)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	c.loaded, err = c.tree(false)
+	if err != nil {
+		log.Error(err)
+	}
 	return
 }
 
+// load decodes one json, yaml or toml file over the settings loaded so far
 func (c *Config) load(filename string) error {
-	file, err := os.Open(filename)
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	defer file.Close()
-	decoder := json.NewDecoder(file)
+	format := configFormat(filename)
+	if format != FormatJSON {
+		data, err = toJSON(format, data)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", filename, err)
+			log.Error(err)
+			return err
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
 	err = decoder.Decode(c)
 	if err != nil {
+		if format == FormatJSON {
+			err = describeJSONError(filename, data, decoder.InputOffset(), err)
+		} else {
+			// positions in the converted document mean nothing to the reader
+			err = fmt.Errorf("%s: %w", filename, describeDecodeError(err))
+		}
 		log.Error(err)
+		return err
+	}
+	// ignored like before, older files may carry settings which are gone
+	unknown := unknownKeys(data, reflect.TypeOf(c).Elem(), "", nil)
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		warning := fmt.Sprintf("%s: unknown setting %q is ignored", filename, key)
+		log.Warning(warning)
+		c.warnings = append(c.warnings, warning)
+	}
+	return nil
+}
+
+// Paths of the config files, in load order
+func (c *Config) Paths() []string {
+	return c.paths
+}
+
+// Warnings about the config files which do not stop the service, like the unknown settings
+func (c *Config) Warnings() []string {
+	return c.warnings
+}
+
+// unknownKeys appends the keys of data no field of t reads to unknown. The names match
+// case-insensitively, as encoding/json decodes them.
+func unknownKeys(data json.RawMessage, t reflect.Type, path string, unknown []string) []string {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return unknownKeys(data, t.Elem(), path, unknown)
+	case reflect.Struct:
+		var object map[string]json.RawMessage
+		if json.Unmarshal(data, &object) != nil {
+			return unknown
+		}
+		fields := jsonFields(t)
+		for key, value := range object {
+			index := -1
+			for _, field := range fields {
+				if strings.EqualFold(field.name, key) {
+					index = field.index
+					break
+				}
+			}
+			if index < 0 {
+				unknown = append(unknown, joinPath(path, key))
+				continue
+			}
+			unknown = unknownKeys(value, t.Field(index).Type, joinPath(path, key), unknown)
+		}
+	case reflect.Map:
+		var object map[string]json.RawMessage
+		if json.Unmarshal(data, &object) != nil {
+			return unknown
+		}
+		for key, value := range object {
+			unknown = unknownKeys(value, t.Elem(), joinPath(path, key), unknown)
+		}
+	case reflect.Slice:
+		var items []json.RawMessage
+		if json.Unmarshal(data, &items) != nil {
+			return unknown
+		}
+		for index, item := range items {
+			unknown = unknownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, index), unknown)
+		}
 	}
-	return err
+	return unknown
 }
 
+func describeDecodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return fmt.Errorf("%s must be %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	}
+	return errors.New(strings.TrimPrefix(err.Error(), "json: "))
+}
+
+// points at the line and column of a decode error
+func describeJSONError(filename string, data []byte, inputOffset int64, err error) error {
+	offset := inputOffset
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		// Offset counts the offending byte
+		offset = syntaxErr.Offset - 1
+	case errors.As(err, &typeErr):
+		// Offset is past the value, step back to the start of a number or literal
+		offset = typeErr.Offset
+		for offset > 0 && offset <= int64(len(data)) && strings.IndexByte("0123456789.-+eEtruefalsn", data[offset-1]) >= 0 {
+			offset--
+		}
+	}
+	err = describeDecodeError(err)
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	column := int(offset) - bytes.LastIndexByte(data[:offset], '\n')
+	return fmt.Errorf("%s:%d:%d: %w", filename, line, column, err)
+}
+
+// Save writes the settings changed since the config was loaded into the last loaded file, in the format of that file.
+// The other settings of the file stay as they are, those of the other files and of the environment are not copied in.
+// With a master key the changed secrets are written encrypted.
 func (c *Config) Save() error {
-	file, err := os.Create(c.save_path)
+	changes, err := c.changes()
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	defer file.Close()
-	data, err2 := json.MarshalIndent(c, "", "    ")
+	if len(changes) <= 0 {
+		return nil
+	}
+	original, err := ioutil.ReadFile(c.save_path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error(err)
+		return err
+	}
+	data, err := patchConfig(configFormat(c.save_path), original, changes)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", c.save_path, err)
+		log.Error(err)
+		return err
+	}
+	file, err2 := os.Create(c.save_path)
 	if err2 != nil {
 		log.Error(err2)
 		return err2
 	}
+	defer file.Close()
 	_, err3 := file.Write(data)
 	if err3 != nil {
 		log.Error(err3)
@@ -61,6 +263,104 @@ func (c *Config) Save() error {
 	return err3
 }
 
+// configChange sets the setting at path, nil removes it
+type configChange struct {
+	path  []string
+	value interface{}
+}
+
+// changes lists the settings which differ from those loaded, but those of the environment
+func (c *Config) changes() ([]configChange, error) {
+	now, err := c.tree(false)
+	if err != nil {
+		return nil, err
+	}
+	values := now
+	if len(c.masterKey) > 0 {
+		values, err = c.tree(true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	paths := changedPaths(c.loaded, now, nil, nil)
+	sort.Slice(paths, func(i, j int) bool {
+		return strings.Join(paths[i], ".") < strings.Join(paths[j], ".")
+	})
+	changes := make([]configChange, 0, len(paths))
+	for _, path := range paths {
+		if c.setByEnv(path) {
+			continue
+		}
+		changes = append(changes, configChange{path: path, value: valueAt(values, path)})
+	}
+	return changes, nil
+}
+
+// setByEnv tells whether the environment set path or a map holding it
+func (c *Config) setByEnv(path []string) bool {
+	for i := range path {
+		if c.envPaths[strings.Join(path[:i+1], ".")] {
+			return true
+		}
+	}
+	return false
+}
+
+// tree is the config as written by Save, without the secrets of a *_file and with the others encrypted when encrypt
+func (c *Config) tree(encrypt bool) (map[string]interface{}, error) {
+	saved := *c
+	unresolveSecretFiles(reflect.ValueOf(&saved).Elem())
+	if encrypt {
+		err := encryptSecrets(reflect.ValueOf(&saved).Elem(), c.masterKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err := json.Marshal(&saved)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	tree := make(map[string]interface{})
+	err = decoder.Decode(&tree)
+	return tree, err
+}
+
+// changedPaths appends the paths of now which differ from before, maps are compared key by key, lists as a whole
+func changedPaths(before map[string]interface{}, now map[string]interface{}, path []string, paths [][]string) [][]string {
+	for key, value := range now {
+		keyPath := append(append([]string{}, path...), key)
+		if m, ok := value.(map[string]interface{}); ok {
+			old, _ := before[key].(map[string]interface{})
+			paths = changedPaths(old, m, keyPath, paths)
+			continue
+		}
+		if old, ok := before[key]; !ok || !reflect.DeepEqual(old, value) {
+			paths = append(paths, keyPath)
+		}
+	}
+	// the keys removed from a map
+	for key := range before {
+		if _, ok := now[key]; !ok {
+			paths = append(paths, append(append([]string{}, path...), key))
+		}
+	}
+	return paths
+}
+
+func valueAt(tree map[string]interface{}, path []string) interface{} {
+	var value interface{} = tree
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
 func (c *Config) GetDeployPath(deploy_type string) string {
 	switch deploy_type {
 	case "dev":
@@ -71,3 +371,114 @@ func (c *Config) GetDeployPath(deploy_type string) string {
 
 	return c.Deploy.Testing
 }
+
+// Validate reports every missing or invalid setting at once
+func (c *Config) Validate() error {
+	problems := make([]string, 0)
+	required := []struct {
+		name  string
+		value string
+	}{
+		{"listen", c.Listen},
+		{"tmp_path", c.TempPath},
+		{"deploy_path.dev", c.Deploy.Development},
+		{"deploy_path.pro", c.Deploy.Production},
+		{"deploy_path.test", c.Deploy.Testing},
+	}
+	if c.Transport.kind() == TransportSFTP {
+		required = append(required, []struct {
+			name  string
+			value string
+		}{
+			{"ssh.host", c.SSH.Host},
+			{"ssh.user", c.SSH.Username},
+		}...)
+		problems = append(problems, c.SSH.problems()...)
+	}
+	for _, item := range required {
+		if len(strings.TrimSpace(item.value)) <= 0 {
+			problems = append(problems, fmt.Sprintf("%s is required", item.name))
+		}
+	}
+	problems = append(problems, c.Transport.problems()...)
+	problems = append(problems, c.destinationProblems()...)
+	for _, item := range []struct {
+		name  string
+		value string
+	}{
+		{"listen", c.Listen},
+		{"ssh.host", c.SSH.Host},
+	} {
+		if _, _, err := net.SplitHostPort(item.value); len(item.value) > 0 && err != nil {
+			problems = append(problems, fmt.Sprintf("%s %q must be host:port", item.name, item.value))
+		}
+	}
+	for _, item := range []struct {
+		name  string
+		value int64
+		min   int64
+	}{
+		{"download.timeout", int64(c.Download.Timeout), 0},
+		{"download.retries", int64(c.Download.Retries), -1},
+		{"download.retry_delay", int64(c.Download.RetryDelay), 0},
+		{"ssh.retries", int64(c.SSH.Retries), -1},
+		{"ssh.retry_delay", int64(c.SSH.RetryDelay), 0},
+		{"download.max_size", c.Download.MaxSize, 0},
+		{"concurrency.download", int64(c.Concurrency.Download), 0},
+		{"concurrency.encrypt", int64(c.Concurrency.Encrypt), 0},
+		{"concurrency.upload", int64(c.Concurrency.Upload), 0},
+		{"concurrency.global", int64(c.Concurrency.Global), 0},
+		{"queue.max_queued", int64(c.Queue.MaxQueued), 0},
+		{"queue.max_running", int64(c.Queue.MaxRunning), 0},
+		{"queue.retry_after", int64(c.Queue.RetryAfter), 0},
+		{"queue.min_free_space", c.Queue.MinFreeSpace, 0},
+		{"health.min_free_space", c.Health.MinFreeSpace, 0},
+		{"health.cache_ttl", int64(c.Health.CacheTTL), 0},
+		{"shutdown.timeout", int64(c.Shutdown.Timeout), 0},
+		{"reload.watch_interval", int64(c.Reload.WatchInterval), -1},
+	} {
+		if item.value < item.min {
+			problems = append(problems, fmt.Sprintf("%s must be >= %d, got %d", item.name, item.min, item.value))
+		}
+	}
+	for _, scheme := range c.Download.AllowSchemes {
+		if scheme != "http" && scheme != "https" {
+			problems = append(problems, fmt.Sprintf("download.allow_schemes: unsupported scheme %q", scheme))
+		}
+	}
+	for _, prefix := range c.Download.AllowPrefixes {
+		if _, err := parsePrefix(prefix); err != nil {
+			problems = append(problems, fmt.Sprintf("download.allow_prefixes: %q is not an absolute url", prefix))
+		}
+	}
+
+	switch strings.ToLower(c.Log.Format) {
+	case "", "text", "json":
+	default:
+		problems = append(problems, fmt.Sprintf("log.format must be text or json, got %q", c.Log.Format))
+	}
+	if len(c.Log.Level) > 0 {
+		if _, err := logging.LogLevel(c.Log.Level); err != nil {
+			problems = append(problems, fmt.Sprintf("log.level: unknown level %q", c.Log.Level))
+		}
+	}
+
+	if len(c.Tracing.Endpoint) > 0 {
+		endpoint, err := url.Parse(c.Tracing.Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || len(endpoint.Host) <= 0 {
+			problems = append(problems, fmt.Sprintf("tracing.endpoint %q must be an http(s) url", c.Tracing.Endpoint))
+		}
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problems = append(problems, fmt.Sprintf("tracing.sample_ratio must be between 0 and 1, got %v", c.Tracing.SampleRatio))
+	}
+	problems = append(problems, c.Naming.problems()...)
+	problems = append(problems, c.Manifest.problems()...)
+	problems = append(problems, c.Package.problems()...)
+	problems = append(problems, c.Watch.problems()...)
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the ssh, transport and deploy_path settings of the config in MultipleBody.Destinations
+const DefaultDestination = "default"
+
+// delivery.mode and MultipleBody.Delivery
+const (
+	// every destination receives the job or none, the copies delivered are removed when one fails
+	DeliveryAll = "all"
+	// keeps what was delivered, the job succeeds when one destination received it
+	DeliveryBestEffort = "best_effort"
+)
+
+var destinationName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// DestinationConfig is a destination besides the default one, e.g. an internal archive
+type DestinationConfig struct {
+	// referenced by MultipleBody.Destinations
+	Name      string          `json:"name"`
+	SSH       SSHItem         `json:"ssh"`
+	Transport TransportConfig `json:"transport"`
+	// the empty ones are those of the config
+	Deploy DeployPath `json:"deploy_path"`
+}
+
+type DeliveryConfig struct {
+	// all (default) or best_effort, for the jobs with several destinations
+	Mode string `json:"mode"`
+}
+
+// swagger:model
+type DestinationRequest struct {
+	// a name of destinations in the config, or default
+	// required: true
+	Name string `json:"name"`
+	// PGP public key of this destination, default the key of the request
+	PGPKey string `json:"key,omitempty"`
+}
+
+// swagger:model
+type DestinationResult struct {
+	Name   string `json:"name"`
+	Status bool   `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// the files delivered were removed again as another destination failed
+	RolledBack bool          `json:"rolled_back,omitempty"`
+	Files      []*FileResult `json:"files,omitempty"`
+	Manifests  []string      `json:"manifests,omitempty"`
+}
+
+func validDelivery(mode string) bool {
+	return mode == "" || mode == DeliveryAll || mode == DeliveryBestEffort
+}
+
+// destination returns the config with the ssh, transport and deploy_path of the destination name
+func (c *Config) destination(name string) (*Config, error) {
+	if name == DefaultDestination {
+		return c, nil
+	}
+	for index := range c.Destinations {
+		destination := &c.Destinations[index]
+		if destination.Name != name {
+			continue
+		}
+		conf := *c
+		conf.SSH = destination.SSH
+		conf.Transport = destination.Transport
+		if len(destination.Deploy.Development) > 0 {
+			conf.Deploy.Development = destination.Deploy.Development
+		}
+		if len(destination.Deploy.Production) > 0 {
+			conf.Deploy.Production = destination.Deploy.Production
+		}
+		if len(destination.Deploy.Testing) > 0 {
+			conf.Deploy.Testing = destination.Deploy.Testing
+		}
+		return &conf, nil
+	}
+	return nil, fmt.Errorf("unknown destination %q", name)
+}
+
+// validate the destinations and delivery.mode, for Config.Validate
+func (c *Config) destinationProblems() []string {
+	problems := make([]string, 0)
+	if !validDelivery(c.Delivery.Mode) {
+		problems = append(problems, fmt.Sprintf("delivery.mode must be all or best_effort, got %q", c.Delivery.Mode))
+	}
+	names := make(map[string]bool)
+	for index := range c.Destinations {
+		destination := &c.Destinations[index]
+		name := fmt.Sprintf("destinations[%d]", index)
+		switch {
+		case !destinationName.MatchString(destination.Name):
+			problems = append(problems, fmt.Sprintf("%s.name %q must be letters, digits, - or _", name, destination.Name))
+		case destination.Name == DefaultDestination || names[destination.Name]:
+			problems = append(problems, fmt.Sprintf("%s.name %q is taken", name, destination.Name))
+		}
+		names[destination.Name] = true
+
+		if destination.Transport.kind() == TransportSFTP {
+			if len(strings.TrimSpace(destination.SSH.Host)) <= 0 {
+				problems = append(problems, fmt.Sprintf("%s.ssh.host is required", name))
+			} else if _, _, err := net.SplitHostPort(destination.SSH.Host); err != nil {
+				problems = append(problems, fmt.Sprintf("%s.ssh.host %q must be host:port", name, destination.SSH.Host))
+			}
+			if len(strings.TrimSpace(destination.SSH.Username)) <= 0 {
+				problems = append(problems, fmt.Sprintf("%s.ssh.user is required", name))
+			}
+			problems = append(problems, destination.SSH.authProblems(name+".ssh")...)
+			problems = append(problems, destination.SSH.dialProblems(name+".ssh", false)...)
+		}
+		for _, problem := range destination.Transport.problems() {
+			problems = append(problems, name+"."+problem)
+		}
+	}
+	return problems
+}
+
+// checkDestinations refuses the destinations conf does not know, or named twice
+func (b *MultipleBody) checkDestinations(conf *Config) error {
+	names := make(map[string]bool)
+	for _, destination := range b.Destinations {
+		if names[destination.Name] {
+			return fmt.Errorf("destination %q is listed twice", destination.Name)
+		}
+		names[destination.Name] = true
+		if _, err := conf.destination(destination.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *Zurich) deliveryMode() string {
+	if len(this.delivery) > 0 {
+		return this.delivery
+	}
+	if len(this.conf.Delivery.Mode) > 0 {
+		return this.conf.Delivery.Mode
+	}
+	return DeliveryAll
+}
+
+// forDestination copies the job for a destination, with its settings and key and without the encrypted files
+func (this *Zurich) forDestination(request *DestinationRequest) (*Zurich, error) {
+	conf, err := this.conf.destination(request.Name)
+	if err != nil {
+		return nil, err
+	}
+	delivery := *this
+	delivery.conf = conf
+	delivery.destination = request.Name
+	delivery.destinations = nil
+	delivery.deliveries = nil
+	delivery.pgpFiles = make([]*ZurichFile, len(this.Files))
+	delivery.manifests = nil
+	if len(request.PGPKey) > 0 {
+		delivery.pgpKey = request.PGPKey
+	}
+	return &delivery, nil
+}
+
+// 投递到多个目的地，每个目的地用自己的公钥加密
+func (this *Zurich) fanOut() error {
+	deliveries := make([]*Zurich, 0, len(this.destinations))
+	for _, request := range this.destinations {
+		delivery, err := this.forDestination(request)
+		if err != nil {
+			this.logger().Error(err)
+			return err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	this.deliveries = deliveries
+
+	spans := make([]trace.Span, len(deliveries))
+	for index, delivery := range deliveries {
+		delivery.ctx, spans[index] = startSpan(this.ctx, "destination",
+			attribute.String("destination.name", delivery.destination),
+			attribute.String("destination.host", delivery.conf.Transport.Host(&delivery.conf.SSH)))
+	}
+	defer func() {
+		for index, delivery := range deliveries {
+			endSpan(spans[index], delivery.err)
+		}
+	}()
+
+	if this.deliveryMode() == DeliveryBestEffort {
+		return this.deliverBestEffort()
+	}
+	return this.deliverAll()
+}
+
+// 先上传所有目的地的文件，再上传索引文件；任何一个失败则删除已上传的文件
+func (this *Zurich) deliverAll() error {
+	var failed *Zurich
+	for _, delivery := range this.deliveries {
+		delivery.err = delivery.uploadFiles()
+		if delivery.err != nil {
+			failed = delivery
+			break
+		}
+	}
+	if failed == nil && len(this.packageFormat) <= 0 {
+		for _, delivery := range this.deliveries {
+			delivery.err = delivery.UploadManifest()
+			if delivery.err != nil {
+				failed = delivery
+				break
+			}
+		}
+	}
+	if failed == nil {
+		return nil
+	}
+
+	for _, delivery := range this.deliveries {
+		if delivery != failed {
+			delivery.err = fmt.Errorf("destination %s failed", failed.destination)
+		}
+		delivery.rollBack()
+	}
+	return fmt.Errorf("destination %s: %w", failed.destination, failed.err)
+}
+
+// 每个目的地单独投递，至少一个成功即可
+func (this *Zurich) deliverBestEffort() error {
+	errs := make([]error, 0)
+	for _, delivery := range this.deliveries {
+		delivery.err = delivery.deliver()
+		if delivery.err != nil {
+			this.logger().Warningf("destination %s failed: %s", delivery.destination, delivery.err)
+			errs = append(errs, fmt.Errorf("destination %s: %w", delivery.destination, delivery.err))
+		}
+	}
+	if len(errs) == len(this.deliveries) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// rollBack removes the files and manifests delivered, as if the job never reached the destination.
+// The files an overwrite replaced existed before the job and are kept.
+func (this *Zurich) rollBack() {
+	remotePaths := make([]string, 0)
+	kept := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, pgpFile := range this.pgpFiles {
+		// in a package every file is the archive
+		if pgpFile == nil || !pgpFile.delivered || seen[pgpFile.remotePath] {
+			continue
+		}
+		seen[pgpFile.remotePath] = true
+		if pgpFile.created {
+			remotePaths = append(remotePaths, pgpFile.remotePath)
+		} else {
+			kept = append(kept, pgpFile.remotePath)
+		}
+	}
+	for _, manifest := range this.manifests {
+		if this.replacedManifests[manifest] {
+			kept = append(kept, manifest)
+		} else {
+			remotePaths = append(remotePaths, manifest)
+		}
+	}
+	if len(kept) > 0 {
+		this.logger().Warningf("roll back keeps %s of destination %s, they existed before the job", strings.Join(kept, ", "), this.destination)
+	}
+	if len(remotePaths) <= 0 {
+		return
+	}
+	this.logger().Warning("roll back destination", this.destination)
+
+	transport := NewTransport(this.ctx, &this.conf.Transport, &this.conf.SSH)
+	defer transport.Close()
+	removed := make(map[string]bool)
+	for _, remotePath := range remotePaths {
+		err := transport.Remove(remotePath)
+		if err != nil {
+			this.logger().Error(err)
+			this.err = errors.Join(this.err, fmt.Errorf("roll back %s: %w", remotePath, err))
+			continue
+		}
+		removed[remotePath] = true
+	}
+	for _, pgpFile := range this.pgpFiles {
+		if pgpFile != nil && removed[pgpFile.remotePath] {
+			pgpFile.delivered = false
+		}
+	}
+	manifests := make([]string, 0)
+	for _, manifest := range this.manifests {
+		if !removed[manifest] {
+			manifests = append(manifests, manifest)
+		}
+	}
+	this.manifests = manifests
+	this.rolledBack = len(kept) <= 0 && len(removed) == len(remotePaths)
+}
+
+// the state of the delivery to one destination, for the job result
+func (this *Zurich) destinationResult() *DestinationResult {
+	result := &DestinationResult{
+		Name:       this.destination,
+		Status:     this.err == nil,
+		RolledBack: this.rolledBack,
+		Files:      make([]*FileResult, 0, len(this.Files)),
+		Manifests:  this.manifests,
+	}
+	if this.err != nil {
+		result.Error = this.err.Error()
+	}
+	for index, zFile := range this.Files {
+		if zFile.received == nil {
+			continue
+		}
+		file := *zFile.received
+		if pgpFile := this.pgpFiles[index]; pgpFile != nil && pgpFile.delivered {
+			file.Remote = pgpFile.remotePath
+		}
+		result.Files = append(result.Files, &file)
+	}
+	return result
+}
@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func Test_Destinations(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	files := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("content of " + path.Base(request.URL.Path)))
+	}))
+	defer files.Close()
+	conf := getHealthTestConfig(t, newTestSFTPServer(t))
+	conf.Download = DownloadConfig{AllowPrivate: true, Timeout: 5}
+	conf.Naming = NamingConfig{Template: "{job_id}-{name}.pgp"}
+	conf.Manifest = ManifestConfig{Formats: []string{ManifestJSON}}
+	archive := t.TempDir()
+	conf.Destinations = []DestinationConfig{{
+		Name:      "archive",
+		Transport: TransportConfig{Type: TransportLocal, Local: LocalConfig{Path: archive}},
+		Deploy:    DeployPath{Development: "/archive/dev"},
+	}}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	keyrings := make([]openpgp.EntityList, 2)
+	publicKeys := make([]string, 2)
+	for i := range keyrings {
+		keyrings[i] = writeTestMasterKey(t, filepath.Join(t.TempDir(), "private.asc"))
+		publicKey := new(bytes.Buffer)
+		writer, _ := armor.Encode(publicKey, openpgp.PublicKeyType, nil)
+		keyrings[i][0].Serialize(writer)
+		writer.Close()
+		publicKeys[i] = publicKey.String()
+	}
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	audit := NewAuditLog(auditPath)
+	if err := audit.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	body := &MultipleBody{
+		Files:        []*ZurichFile{{Name: "a.txt", Url: files.URL + "/a.txt"}},
+		PGPKey:       publicKeys[0],
+		ENV:          "dev",
+		Destinations: []*DestinationRequest{{Name: DefaultDestination}, {Name: "archive", PGPKey: publicKeys[1]}},
+	}
+	if err := body.checkDestinations(conf); err != nil {
+		t.Fatal(err)
+	}
+	result := RunJob(context.Background(), conf, body, "cli", audit)
+	if !result.Status || len(result.Destinations) != 2 {
+		t.Log(result.Error)
+		t.Fail()
+		return
+	}
+	roots := []string{"", archive}
+	for i, destination := range result.Destinations {
+		if !destination.Status || len(destination.Files) != 1 || len(destination.Manifests) != 1 {
+			t.Fatalf("unexpected destination %s", ToJSON(destination))
+		}
+		if data := readTestPGPFile(t, keyrings[i], filepath.Join(roots[i], destination.Files[0].Remote)); string(data) != "content of a.txt" {
+			t.Errorf("unexpected file at %s: %q", destination.Name, data)
+		}
+		readTestPGPFile(t, keyrings[i], filepath.Join(roots[i], destination.Manifests[0]))
+	}
+	if remote := result.Destinations[1].Files[0].Remote; remote != "/archive/dev/"+result.ID+"-a.txt.pgp" {
+		t.Errorf("unexpected archive path %s", remote)
+	}
+	if result.Files[0].Remote != "" {
+		t.Errorf("expected the remote paths only per destination, got %s", result.Files[0].Remote)
+	}
+
+	// one audit entry per destination
+	logFile, err := os.Open(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+	destinations := make([]string, 0)
+	for scanner := bufio.NewScanner(logFile); scanner.Scan(); {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil || entry.Outcome != "success" {
+			t.Errorf("unexpected audit entry %s %v", scanner.Text(), err)
+		}
+		destinations = append(destinations, entry.Destination+"@"+entry.Host)
+	}
+	if strings.Join(destinations, ",") != "default@"+conf.SSH.Host+",archive@"+archive {
+		t.Errorf("unexpected audit destinations %v", destinations)
+	}
+
+	// the archive cannot be written: all takes back the copy of the default destination
+	broken := filepath.Join(t.TempDir(), "file")
+	writeTestFile(t, broken, "not a folder")
+	conf.Destinations[0].Transport.Local.Path = broken
+	result = RunJob(context.Background(), conf, body, "cli", nil)
+	if result.Status || len(result.Destinations) != 2 || !strings.Contains(result.Error, "destination archive") {
+		t.Fatalf("expected the job to fail, got %s", ToJSON(result))
+	}
+	if partner := result.Destinations[0]; partner.Status || !partner.RolledBack || partner.Files[0].Remote != "" {
+		t.Errorf("expected the default destination to be rolled back, got %s", ToJSON(partner))
+	}
+	if _, err := os.Stat(filepath.Join(conf.Deploy.Development, result.ID+"-a.txt.pgp")); !os.IsNotExist(err) {
+		t.Errorf("expected the file removed from the default destination, got %v", err)
+	}
+
+	// an overwrite replaced a file which existed before the job, the roll back keeps it
+	conf.Naming.Template = "{name}.pgp"
+	existing := filepath.Join(conf.Deploy.Development, "a.txt.pgp")
+	writeTestFile(t, existing, "delivered before")
+	result = RunJob(context.Background(), conf, body, "cli", nil)
+	if result.Status || len(result.Destinations) != 2 {
+		t.Fatalf("expected the job to fail, got %s", ToJSON(result))
+	}
+	if partner := result.Destinations[0]; partner.RolledBack || len(partner.Manifests) != 0 || partner.Files[0].Remote != existing {
+		t.Errorf("expected the replaced file to be kept, got %s", ToJSON(partner))
+	}
+	if _, err := os.Stat(existing); err != nil {
+		t.Errorf("expected the file which existed before to be kept, got %v", err)
+	}
+	conf.Naming.Template = "{job_id}-{name}.pgp"
+
+	// best_effort keeps it
+	body.Delivery = DeliveryBestEffort
+	result = RunJob(context.Background(), conf, body, "cli", nil)
+	if !result.Status || len(result.Destinations) != 2 {
+		t.Fatalf("expected the job to succeed, got %s", ToJSON(result))
+	}
+	if partner, failed := result.Destinations[0], result.Destinations[1]; !partner.Status || len(partner.Manifests) != 1 || failed.Status || len(failed.Error) <= 0 {
+		t.Errorf("unexpected destinations %s", ToJSON(result.Destinations))
+	}
+	if _, err := os.Stat(result.Destinations[0].Files[0].Remote); err != nil {
+		t.Error(err)
+	}
+
+	body.Destinations = []*DestinationRequest{{Name: "backup"}}
+	if err := body.checkDestinations(conf); err == nil || !strings.Contains(err.Error(), "unknown destination") {
+		t.Errorf("expected an unknown destination, got %v", err)
+	}
+	body.Delivery = "some"
+	if err := body.Validate(); err == nil {
+		t.Error("expected the delivery to be refused")
+	}
+	conf.Delivery.Mode = "some"
+	conf.Destinations = append(conf.Destinations, DestinationConfig{Name: DefaultDestination}, DestinationConfig{Name: "a b", Transport: TransportConfig{Type: TransportLocal}})
+	if problems := conf.destinationProblems(); len(problems) != 8 {
+		t.Errorf("unexpected problems %v", problems)
+	}
+}
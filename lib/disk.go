@@ -0,0 +1,15 @@
+//go:build !windows
+
+package lib
+
+import "syscall"
+
+// FreeSpace returns the bytes available to unprivileged users on the filesystem of dir
+func FreeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(dir, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
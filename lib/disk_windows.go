@@ -0,0 +1,35 @@
+//go:build windows
+
+package lib
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// FreeSpace returns the bytes available to the current user on the volume of dir
+func FreeSpace(dir string) (int64, error) {
+	kernel32, err := syscall.LoadDLL("kernel32.dll")
+	if err != nil {
+		return 0, err
+	}
+	proc, err := kernel32.FindProc("GetDiskFreeSpaceExW")
+	if err != nil {
+		return 0, err
+	}
+	path, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free int64
+	ret, _, err := proc.Call(
+		uintptr(unsafe.Pointer(path)),
+		uintptr(unsafe.Pointer(&available)),
+		uintptr(unsafe.Pointer(&total)),
+		uintptr(unsafe.Pointer(&free)),
+	)
+	if ret == 0 {
+		return 0, err
+	}
+	return available, nil
+}
@@ -18,8 +18,10 @@ package lib
 // swagger:response ResultResponse
 type ResultResponse struct {
 	// in: body
-	Status bool   `json:"status"`
-	Error  string `json:"error"`
+	Status bool          `json:"status"`
+	Error  string        `json:"error"`
+	ID     string        `json:"id"`
+	Files  []*FileResult `json:"files"`
 }
 
 // swagger:parameters hello
@@ -84,9 +86,19 @@ type JSONBody struct {
 //   required: true
 //   enum: [dev, pro, test]
 //   description: sftp remote save folder
+// - name: sha256
+//   type: string
+//   in: formData
+//   description: expected SHA-256 (hex) of the uploaded file
+// - name: size
+//   type: integer
+//   in: formData
+//   description: expected size in bytes of the uploaded file
 // responses:
 //   200:
 //     description: OK
+//   422:
+//     description: Checksum or size mismatch, the error starts with "sha256 checksum mismatch" or "file size mismatch"
 //   500:
 //     description: Error
 
@@ -107,6 +119,87 @@ type JSONBody struct {
 //	   "$ref": "#/definitions/MultipleBody"
 // responses:
 //   200:
-//     description: OK
+//     description: OK, the job is queued, "id" identifies it in the notification
+//   429:
+//     description: Job queue is full, retry after the Retry-After header
+//   503:
+//     description: Not enough free space, retry after the Retry-After header
 //   500:
 //     description: Error
+
+// swagger:operation GET /healthz healthz
+//
+// Liveness, the process is running
+//
+// ---
+// produces:
+//   - application/json
+// responses:
+//   200:
+//     description: OK
+
+// swagger:operation GET /readyz readyz
+//
+// Readiness, checks the config, tmp_path and the sftp login. The result is cached for health.cache_ttl seconds
+//
+// ---
+// produces:
+//   - application/json
+// responses:
+//   200:
+//     description: Ready
+//     schema:
+//       "$ref": "#/definitions/HealthReport"
+//   503:
+//     description: Not ready, see the failed checks
+//     schema:
+//       "$ref": "#/definitions/HealthReport"
+
+// swagger:operation GET /queue queue
+//
+// Job queue depth
+//
+// ---
+// produces:
+//   - application/json
+// responses:
+//   200:
+//     description: OK
+//     schema:
+//       "$ref": "#/definitions/QueueStats"
+
+// swagger:operation GET /admin/config adminConfig
+//
+// Active config version, secrets redacted. Needs "Authorization: Bearer <admin.token>", or a loopback caller when no token is set
+//
+// ---
+// produces:
+//   - application/json
+// responses:
+//   200:
+//     description: OK
+//     schema:
+//       "$ref": "#/definitions/ConfigVersion"
+//   401:
+//     description: Invalid admin token
+//   403:
+//     description: Not a loopback caller
+
+// swagger:operation POST /admin/reload adminReload
+//
+// Reloads the config file, the active config stays when the new one is invalid
+//
+// ---
+// produces:
+//   - application/json
+// responses:
+//   200:
+//     description: Reloaded
+//     schema:
+//       "$ref": "#/definitions/ConfigVersion"
+//   400:
+//     description: Invalid config, the active config stays
+//   401:
+//     description: Invalid admin token
+//   403:
+//     description: Not a loopback caller
@@ -0,0 +1,419 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	DefaultDownloadTimeout    = 60
+	DefaultDownloadRetries    = 3
+	DefaultDownloadRetryDelay = 1
+	DefaultDownloadMaxSize    = 100 << 20
+	maxDownloadRedirects      = 10
+	// the doubled retry delay stops growing here
+	maxDownloadRetryDelay = 30 * time.Second
+)
+
+var (
+	ErrDownloadForbidden  = errors.New("download url not allowed")
+	ErrDownloadStatus     = errors.New("download unexpected status")
+	ErrDownloadTooLarge   = errors.New("download file too large")
+	ErrDownloadIncomplete = errors.New("download incomplete")
+)
+
+// carrier-grade NAT range, not covered by net.IP.IsPrivate
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+type DownloadConfig struct {
+	// hostnames allowed as download source, "*.example.com" matches subdomains
+	AllowHosts []string `json:"allow_hosts"`
+	// url prefixes allowed as download source
+	AllowPrefixes []string `json:"allow_prefixes"`
+	// default: http, https
+	AllowSchemes []string `json:"allow_schemes"`
+	// allow loopback / private / link-local addresses
+	AllowPrivate bool `json:"allow_private"`
+	// seconds per attempt, default 60
+	Timeout int `json:"timeout"`
+	// retries on 5xx / network errors, default 3, -1 disables retry
+	Retries int `json:"retries"`
+	// seconds before the first retry, doubled on every retry up to 30s, default 1
+	RetryDelay int `json:"retry_delay"`
+	// bytes, default 100MB
+	MaxSize int64 `json:"max_size"`
+}
+
+func (c *DownloadConfig) schemes() []string {
+	if len(c.AllowSchemes) > 0 {
+		return c.AllowSchemes
+	}
+	return []string{"http", "https"}
+}
+
+func (c *DownloadConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Second
+	}
+	return DefaultDownloadTimeout * time.Second
+}
+
+func (c *DownloadConfig) retries() int {
+	if c.Retries < 0 {
+		return 0
+	}
+	if c.Retries == 0 {
+		return DefaultDownloadRetries
+	}
+	return c.Retries
+}
+
+func (c *DownloadConfig) retryDelay() time.Duration {
+	if c.RetryDelay > 0 {
+		return time.Duration(c.RetryDelay) * time.Second
+	}
+	return DefaultDownloadRetryDelay * time.Second
+}
+
+func (c *DownloadConfig) maxSize() int64 {
+	if c.MaxSize > 0 {
+		return c.MaxSize
+	}
+	return DefaultDownloadMaxSize
+}
+
+// CheckURL verifies the scheme and host allowlists, address checks happen on dial
+func (c *DownloadConfig) CheckURL(target *url.URL) error {
+	return newURLAllowlist(c).check(target)
+}
+
+// urlAllowlist is the download config with the allow_prefixes parsed once
+type urlAllowlist struct {
+	conf     *DownloadConfig
+	prefixes []*url.URL
+}
+
+func newURLAllowlist(conf *DownloadConfig) *urlAllowlist {
+	allowlist := &urlAllowlist{conf: conf}
+	for _, raw := range conf.AllowPrefixes {
+		// Validate reports the others
+		if prefix, err := parsePrefix(raw); err == nil {
+			allowlist.prefixes = append(allowlist.prefixes, prefix)
+		}
+	}
+	return allowlist
+}
+
+// parsePrefix reads an allow_prefixes entry, with the host:port and path compared by matchPrefix
+func parsePrefix(raw string) (*url.URL, error) {
+	prefix, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !prefix.IsAbs() || len(prefix.Hostname()) <= 0 {
+		return nil, errors.New("not an absolute url")
+	}
+	return &url.URL{Scheme: strings.ToLower(prefix.Scheme), Host: hostPort(prefix), Path: cleanPath(prefix.Path)}, nil
+}
+
+// hostPort is the lower-case host:port of target, with the default port of its scheme
+func hostPort(target *url.URL) string {
+	port := target.Port()
+	if len(port) <= 0 {
+		switch strings.ToLower(target.Scheme) {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(strings.ToLower(target.Hostname()), port)
+}
+
+// cleanPath resolves the . and .. of an url path, as the server would
+func cleanPath(urlPath string) string {
+	return path.Clean("/" + urlPath)
+}
+
+// matchPrefix compares the scheme and host:port exactly, and the cleaned path on a segment boundary
+func matchPrefix(prefix *url.URL, target *url.URL) bool {
+	if prefix.Scheme != strings.ToLower(target.Scheme) || prefix.Host != hostPort(target) {
+		return false
+	}
+	targetPath := cleanPath(target.Path)
+	return prefix.Path == "/" || targetPath == prefix.Path || strings.HasPrefix(targetPath, prefix.Path+"/")
+}
+
+func (a *urlAllowlist) check(target *url.URL) error {
+	c := a.conf
+	schemeAllowed := false
+	for _, scheme := range c.schemes() {
+		if strings.EqualFold(scheme, target.Scheme) {
+			schemeAllowed = true
+			break
+		}
+	}
+	if !schemeAllowed {
+		return fmt.Errorf("%w: scheme %q", ErrDownloadForbidden, target.Scheme)
+	}
+	if len(target.Hostname()) <= 0 {
+		return fmt.Errorf("%w: empty host", ErrDownloadForbidden)
+	}
+	if len(c.AllowHosts) <= 0 && len(c.AllowPrefixes) <= 0 {
+		return nil
+	}
+
+	host := strings.ToLower(target.Hostname())
+	for _, allow := range c.AllowHosts {
+		allow = strings.ToLower(allow)
+		if strings.HasPrefix(allow, "*.") {
+			if strings.HasSuffix(host, allow[1:]) {
+				return nil
+			}
+		} else if host == allow {
+			return nil
+		}
+	}
+	for _, prefix := range a.prefixes {
+		if matchPrefix(prefix, target) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrDownloadForbidden, target.Host)
+}
+
+func (c *DownloadConfig) CheckRawURL(rawURL string) error {
+	return newURLAllowlist(c).checkRaw(rawURL)
+}
+
+func (a *urlAllowlist) checkRaw(rawURL string) error {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	return a.check(target)
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if ip4[0] == 0 || ip4.Equal(net.IPv4bcast) || sharedAddressSpace.Contains(ip4) {
+			return false
+		}
+	}
+	return true
+}
+
+// checks the resolved address right before connecting, this covers redirects and DNS rebinding
+func (c *DownloadConfig) dialControl(network, address string, _ syscall.RawConn) error {
+	if c.AllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !isPublicIP(net.ParseIP(host)) {
+		return fmt.Errorf("%w: address %s", ErrDownloadForbidden, host)
+	}
+	return nil
+}
+
+// NewDownloadClient returns a http.Client restricted by the download config
+func NewDownloadClient(conf *DownloadConfig) *http.Client {
+	return newDownloadClient(conf, newURLAllowlist(conf))
+}
+
+func newDownloadClient(conf *DownloadConfig, allowlist *urlAllowlist) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   time.Second * 15,
+		KeepAlive: time.Second * 30,
+		Control:   conf.dialControl,
+	}
+	transport := &http.Transport{
+		// never use an environment proxy, the address check would only see the proxy
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   time.Second * 15,
+		ResponseHeaderTimeout: time.Second * 30,
+		IdleConnTimeout:       time.Second * 90,
+		MaxIdleConnsPerHost:   4,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   conf.timeout(),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxDownloadRedirects {
+				return errors.New("too many redirects")
+			}
+			return allowlist.check(req.URL)
+		},
+	}
+}
+
+type Downloader struct {
+	conf      *DownloadConfig
+	allowlist *urlAllowlist
+	client    *http.Client
+	// waits before a retry, time.After, replaced in tests
+	after func(time.Duration) <-chan time.Time
+}
+
+func NewDownloader(conf *DownloadConfig) *Downloader {
+	allowlist := newURLAllowlist(conf)
+	return &Downloader{
+		conf:      conf,
+		allowlist: allowlist,
+		client:    newDownloadClient(conf, allowlist),
+		after:     time.After,
+	}
+}
+
+// nextRetryDelay doubles delay up to maxDownloadRetryDelay, a longer configured retry_delay is kept
+func nextRetryDelay(delay time.Duration) time.Duration {
+	if delay >= maxDownloadRetryDelay {
+		return delay
+	}
+	return min(delay*2, maxDownloadRetryDelay)
+}
+
+// marks errors worth another attempt
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// Download saves rawURL to savePath, retrying with backoff on 5xx and network errors
+func (d *Downloader) Download(ctx context.Context, rawURL string, savePath string) (err error) {
+	ctx, span := startSpan(ctx, "download", attribute.String("url.full", redactURL(rawURL)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	err = d.allowlist.checkRaw(rawURL)
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	defer func() {
+		downloadDuration.WithLabelValues(resultLabel(err)).Observe(time.Since(started).Seconds())
+	}()
+
+	delay := d.conf.retryDelay()
+	retries := d.conf.retries()
+	for attempt := 0; ; attempt++ {
+		span.SetAttributes(attribute.Int("download.attempts", attempt+1))
+		err = d.fetch(ctx, rawURL, savePath)
+		if err == nil {
+			return nil
+		}
+		var retryable *retryableError
+		if !errors.As(err, &retryable) || attempt >= retries {
+			break
+		}
+		Logger(ctx).Warningf("download %s failed (attempt %d/%d), retry in %s: %s", redactURL(rawURL), attempt+1, retries+1, delay, err)
+		select {
+		case <-ctx.Done():
+			os.Remove(savePath)
+			return ctx.Err()
+		case <-d.after(delay):
+		}
+		delay = nextRetryDelay(delay)
+	}
+
+	os.Remove(savePath)
+	var retryable *retryableError
+	if errors.As(err, &retryable) {
+		return retryable.err
+	}
+	return err
+}
+
+func (d *Downloader) fetch(ctx context.Context, rawURL string, savePath string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	injectTrace(ctx, req.Header)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		if errors.Is(err, ErrDownloadForbidden) {
+			return err
+		}
+		return &retryableError{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = fmt.Errorf("%w: %s %s", ErrDownloadStatus, resp.Status, redactURL(rawURL))
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return &retryableError{err}
+		}
+		return err
+	}
+
+	maxSize := d.conf.maxSize()
+	if resp.ContentLength > maxSize {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrDownloadTooLarge, resp.ContentLength, maxSize)
+	}
+
+	file, err := os.Create(savePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	written, err := io.Copy(file, io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return &retryableError{err}
+	}
+	if written > maxSize {
+		return fmt.Errorf("%w: limit %d", ErrDownloadTooLarge, maxSize)
+	}
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return &retryableError{fmt.Errorf("%w: received %d of %d bytes", ErrDownloadIncomplete, written, resp.ContentLength)}
+	}
+
+	return file.Sync()
+}
+
+// url without user info and query, which may carry credentials
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
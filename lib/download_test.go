@@ -0,0 +1,227 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func getTestDownloader(conf *DownloadConfig) *Downloader {
+	conf.AllowPrivate = true
+	conf.Timeout = 5
+	downloader := NewDownloader(conf)
+	// retry at once
+	downloader.after = func(time.Duration) <-chan time.Time {
+		return time.After(0)
+	}
+	return downloader
+}
+
+func Test_DownloadCheckURL(t *testing.T) {
+	conf := &DownloadConfig{
+		AllowHosts:    []string{"files.example.com", "*.cdn.example.com"},
+		AllowPrefixes: []string{"https://s3.example.org/bucket/"},
+	}
+	cases := map[string]bool{
+		"https://files.example.com/a.pdf":          true,
+		"http://img.cdn.example.com/a.gif":         true,
+		"https://s3.example.org/bucket/a.pdf":      true,
+		"https://s3.example.org/other/a.pdf":       false,
+		"https://s3.example.org:443/bucket/a.pdf":  true,
+		"HTTPS://S3.example.org/bucket/a.pdf":      true,
+		"https://s3.example.org/bucket":            true,
+		"https://s3.example.org/bucket2/a.pdf":     false,
+		"https://s3.example.org/bucket/../other":   false,
+		"https://s3.example.org/bucket/%2e%2e/x":   false,
+		"https://s3.example.org.evil.net/bucket/a": false,
+		"https://s3.example.org@evil.net/bucket/a": false,
+		"https://s3.example.org:8443/bucket/a.pdf": false,
+		"http://s3.example.org/bucket/a.pdf":       false,
+		"https://evil.example.com/a.pdf":           false,
+		"ftp://files.example.com/a.pdf":            false,
+		"file:///etc/passwd":                       false,
+		"http://169.254.169.254/latest/meta-data/": false,
+	}
+	for rawURL, allowed := range cases {
+		err := conf.CheckRawURL(rawURL)
+		if allowed && err != nil {
+			t.Errorf("%s should be allowed: %v", rawURL, err)
+		}
+		if !allowed && !errors.Is(err, ErrDownloadForbidden) {
+			t.Errorf("%s should be forbidden, got %v", rawURL, err)
+		}
+	}
+}
+
+func Test_DownloadBlockPrivateAddress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("internal"))
+	}))
+	defer server.Close()
+
+	client := NewDownloadClient(&DownloadConfig{})
+	_, err := client.Get(server.URL)
+	if !errors.Is(err, ErrDownloadForbidden) {
+		t.Errorf("loopback download should be blocked, got %v", err)
+	}
+
+	client = NewDownloadClient(&DownloadConfig{AllowPrivate: true})
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	resp.Body.Close()
+}
+
+func Test_DownloadBlockRedirect(t *testing.T) {
+	conf := &DownloadConfig{
+		AllowPrivate: true,
+		AllowHosts:   []string{"127.0.0.1"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.Redirect(writer, request, "http://localhost/secret", http.StatusFound)
+	}))
+	defer server.Close()
+
+	_, err := NewDownloadClient(conf).Get(server.URL)
+	if !errors.Is(err, ErrDownloadForbidden) {
+		t.Errorf("redirect to other host should be blocked, got %v", err)
+	}
+}
+
+func Test_isPublicIP(t *testing.T) {
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "192.168.33.6", "169.254.169.254", "100.64.0.1", "::1", "fe80::1", "fd00::1", "0.0.0.0"} {
+		if isPublicIP(net.ParseIP(ip)) {
+			t.Errorf("%s should not be public", ip)
+		}
+	}
+	for _, ip := range []string{"8.8.8.8", "52.219.0.1", "2001:4860:4860::8888"} {
+		if !isPublicIP(net.ParseIP(ip)) {
+			t.Errorf("%s should be public", ip)
+		}
+	}
+}
+
+func Test_DownloadRetry(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			http.Error(writer, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		writer.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	savePath := filepath.Join(t.TempDir(), "file.txt")
+	err := getTestDownloader(&DownloadConfig{Retries: 3}).Download(context.Background(), server.URL, savePath)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	content, err := ioutil.ReadFile(savePath)
+	if err != nil || string(content) != "content" {
+		t.Errorf("unexpected content %q, %v", content, err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func Test_DownloadStatus(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		http.NotFound(writer, request)
+	}))
+	defer server.Close()
+
+	savePath := filepath.Join(t.TempDir(), "file.txt")
+	err := getTestDownloader(&DownloadConfig{}).Download(context.Background(), server.URL+"/a.pdf?signature=secret", savePath)
+	if !errors.Is(err, ErrDownloadStatus) {
+		t.Errorf("expected status error, got %v", err)
+	}
+	// the error is logged, the signature of the url is not
+	if err != nil && strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected the url redacted, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("4xx should not be retried, got %d attempts", attempts)
+	}
+	if _, err := ioutil.ReadFile(savePath); err == nil {
+		t.Error("failed download should not leave a file")
+	}
+}
+
+func Test_DownloadMaxSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		// chunked response, no Content-Length
+		writer.Write([]byte("0123456789"))
+		writer.(http.Flusher).Flush()
+		writer.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+
+	savePath := filepath.Join(t.TempDir(), "file.txt")
+	err := getTestDownloader(&DownloadConfig{MaxSize: 15}).Download(context.Background(), server.URL, savePath)
+	if !errors.Is(err, ErrDownloadTooLarge) {
+		t.Errorf("expected too large error, got %v", err)
+	}
+}
+
+func Test_DownloadIncomplete(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		writer.Header().Set("Content-Length", "100")
+		writer.Write([]byte("short"))
+	}))
+	defer server.Close()
+
+	savePath := filepath.Join(t.TempDir(), "file.txt")
+	err := getTestDownloader(&DownloadConfig{Retries: 1}).Download(context.Background(), server.URL, savePath)
+	if err == nil {
+		t.Error("truncated download should fail")
+	}
+	if attempts != 2 {
+		t.Errorf("truncated download should be retried, got %d attempts", attempts)
+	}
+}
+
+func Test_DownloadRetryDelay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.Error(writer, "busy", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	downloader := getTestDownloader(&DownloadConfig{Retries: 5, RetryDelay: 4})
+	delays := make([]time.Duration, 0)
+	downloader.after = func(delay time.Duration) <-chan time.Time {
+		delays = append(delays, delay)
+		return time.After(0)
+	}
+	err := downloader.Download(context.Background(), server.URL, filepath.Join(t.TempDir(), "file.txt"))
+	if !errors.Is(err, ErrDownloadStatus) {
+		t.Errorf("expected status error, got %v", err)
+	}
+	expected := []time.Duration{4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+	if !reflect.DeepEqual(delays, expected) {
+		t.Errorf("expected delays %v, got %v", expected, delays)
+	}
+	// a longer configured delay is not shortened
+	if delay := nextRetryDelay(time.Minute); delay != time.Minute {
+		t.Errorf("expected 1m, got %s", delay)
+	}
+}
@@ -2,16 +2,22 @@ package lib
 
 import (
 	"bytes"
+	"context"
+	"encoding/hex"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
 	_ "golang.org/x/crypto/ripemd160"
 	"io"
 	"os"
 	"path"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type PGPHelper struct {
 	toKey []*openpgp.Entity
+	ctx   context.Context
 }
 
 func NewPGPHelper(publicKey io.Reader) (*PGPHelper, error) {
@@ -23,33 +29,76 @@ func NewPGPHelper(publicKey io.Reader) (*PGPHelper, error) {
 	
 	return &PGPHelper{
 		toKey: entryList,
+		ctx:   context.Background(),
 	}, nil
 }
 
+// WithContext returns a copy logging with the request / job id of ctx
+func (this *PGPHelper) WithContext(ctx context.Context) *PGPHelper {
+	return &PGPHelper{
+		toKey: this.toKey,
+		ctx:   ctx,
+	}
+}
+
+func (this *PGPHelper) logger() *ContextLogger {
+	return Logger(this.ctx)
+}
+
+// Fingerprints of the recipient keys, upper case hex
+func (this *PGPHelper) Fingerprints() []string {
+	fingerprints := make([]string, 0, len(this.toKey))
+	for _, entity := range this.toKey {
+		fingerprints = append(fingerprints, strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint[:])))
+	}
+	return fingerprints
+}
+
 func (this *PGPHelper) Encrypt(source io.Reader) (*bytes.Buffer, error) {
 	buffer := new(bytes.Buffer)
+	err := this.EncryptTo(buffer, source)
+	if err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// EncryptTo writes the armored message of source to dest, reading source as it goes
+func (this *PGPHelper) EncryptTo(dest io.Writer, source io.Reader) (err error) {
+	_, span := startSpan(this.ctx, "pgp.encrypt", attribute.StringSlice("pgp.recipients", this.Fingerprints()))
+	defer func() {
+		endSpan(span, err)
+	}()
 	
 	header := map[string]string{"Creator": "MixMedia"}
-	body, err := armor.Encode(buffer, "PGP MESSAGE", header)
+	body, err := armor.Encode(dest, "PGP MESSAGE", header)
 	if err != nil {
-		log.Error(err)
-		return nil, err
+		this.logger().Error(err)
+		return err
 	}
-	defer body.Close()
 	
 	writer, err := openpgp.Encrypt(body, this.toKey, nil, nil, nil)
 	if err != nil {
-		log.Error(err)
-		return nil, err
+		this.logger().Error(err)
+		return err
 	}
-	defer writer.Close()
 	
-	_, err = io.Copy(writer, source)
+	n, err := io.Copy(writer, source)
+	encryptedBytes.Add(float64(n))
+	span.SetAttributes(attribute.Int64("pgp.plaintext_bytes", n))
 	if err != nil {
-		log.Error(err)
-		return nil, err
+		this.logger().Error(err)
+		return err
 	}
-	return buffer, nil
+	// the last packets and the armor footer
+	err = writer.Close()
+	if err == nil {
+		err = body.Close()
+	}
+	if err != nil {
+		this.logger().Error(err)
+	}
+	return err
 }
 
 func PGP_Encrypt(src []byte, PublicKey io.Reader) (EncryptEntry string, err error) {
@@ -68,27 +117,35 @@ func PGP_Encrypt(src []byte, PublicKey io.Reader) (EncryptEntry string, err erro
 }
 
 func PGP_Encrypt_File(src []byte, PublicKey io.Reader, save_path string) (err error) {
+	helper, err := NewPGPHelper(PublicKey)
+	if err != nil {
+		return err
+	}
+
+	return helper.EncryptFile(src, save_path)
+}
+
+func (this *PGPHelper) EncryptFile(src []byte, save_path string) error {
 	distPath := path.Dir(save_path)
 	if _, err := os.Stat(distPath); err != nil && os.IsNotExist(err) {
 		os.MkdirAll(distPath, os.ModePerm)
 	}
 	distFile, err := os.Create(save_path)
 	if err != nil {
-		log.Error(err)
+		this.logger().Error(err)
 		return err
 	}
 	defer distFile.Close()
 	
-	helper, err := NewPGPHelper(PublicKey)
+	srcReader := bytes.NewReader(src)
+	buffer, err := this.Encrypt(srcReader)
 	if err != nil {
 		return err
 	}
-	srcReader := bytes.NewReader(src)
-	buffer, err := helper.Encrypt(srcReader)
 	
 	_, err = io.Copy(distFile, buffer)
 	if err != nil {
-		log.Error(err)
+		this.logger().Error(err)
 		return err
 	}
 	
@@ -0,0 +1,287 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// prefix of the environment variables overriding the config file
+const EnvPrefix = "PGPSFTP_"
+
+// applyEnv overrides every setting from PGPSFTP_<json path>, e.g. PGPSFTP_SSH_PASSWORD for ssh.password,
+// or from the file named by PGPSFTP_<json path>_FILE. Lists are comma separated, maps are key=value,key=value.
+// The paths set are kept in envPaths, Save leaves them out.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	c.envPaths = make(map[string]bool)
+	return applyEnvValue(reflect.ValueOf(c).Elem(), EnvPrefix, "", lookup, c.envPaths)
+}
+
+func applyEnvValue(value reflect.Value, envPrefix string, path string, lookup func(string) (string, bool), setPaths map[string]bool) error {
+	fields := jsonFields(value.Type())
+	envNames := make(map[string]bool)
+	byName := make(map[string]reflect.Value)
+	secrets := make(map[string]bool)
+	for _, field := range fields {
+		envNames[envPrefix+envName(field.name)] = true
+		byName[field.name] = value.Field(field.index)
+		secrets[field.name] = value.Type().Field(field.index).Tag.Get("secret") == "true"
+	}
+	setByEnv := make(map[string]bool)
+
+	for _, field := range fields {
+		fieldValue := value.Field(field.index)
+		name := envPrefix + envName(field.name)
+		fieldPath := joinPath(path, field.name)
+		if fieldValue.Kind() == reflect.Struct {
+			err := applyEnvValue(fieldValue, name+"_", fieldPath, lookup, setPaths)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var raw string
+		var ok bool
+		var err error
+		// a sibling setting may own the _FILE name, e.g. ssh.password_file
+		if envNames[name+"_FILE"] {
+			raw, ok = lookup(name)
+		} else {
+			raw, ok, err = lookupEnv(lookup, name)
+			if err != nil {
+				return err
+			}
+		}
+		if !ok {
+			continue
+		}
+		err = setFromString(fieldValue, raw)
+		if err != nil {
+			return fmt.Errorf("%s (%s): %w", name, fieldPath, err)
+		}
+		setByEnv[field.name] = true
+		setPaths[fieldPath] = true
+	}
+
+	// the environment wins over a secret and its _file sibling from the config file
+	for name := range setByEnv {
+		secret, sibling := name, name+"_file"
+		if strings.HasSuffix(name, "_file") {
+			secret, sibling = strings.TrimSuffix(name, "_file"), strings.TrimSuffix(name, "_file")
+		}
+		if other, ok := byName[sibling]; ok && secrets[secret] && !setByEnv[sibling] {
+			other.Set(reflect.Zero(other.Type()))
+			setPaths[joinPath(path, sibling)] = true
+		}
+	}
+	return nil
+}
+
+// lookupEnv reads name, or the file named by name_FILE
+func lookupEnv(lookup func(string) (string, bool), name string) (string, bool, error) {
+	raw, ok := lookup(name)
+	fileName := name + "_FILE"
+	filePath, fileOk := lookup(fileName)
+	if !fileOk {
+		return raw, ok, nil
+	}
+	if ok {
+		return "", false, fmt.Errorf("%s and %s are both set, use one", name, fileName)
+	}
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return "", false, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+type jsonField struct {
+	index int
+	name  string
+}
+
+func jsonFields(t reflect.Type) []jsonField {
+	fields := make([]jsonField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if len(name) <= 0 {
+			name = field.Name
+		}
+		fields = append(fields, jsonField{index: i, name: name})
+	}
+	return fields
+}
+
+func envName(jsonName string) string {
+	return strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(jsonName))
+}
+
+func joinPath(path string, name string) string {
+	if len(path) <= 0 {
+		return name
+	}
+	return path + "." + name
+}
+
+func setFromString(value reflect.Value, raw string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(f)
+	case reflect.Slice:
+		items := make([]string, 0)
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				items = append(items, item)
+			}
+		}
+		if value.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported list type %s", value.Type())
+		}
+		value.Set(reflect.ValueOf(items))
+	case reflect.Map:
+		m := reflect.MakeMap(value.Type())
+		for _, pair := range strings.Split(raw, ",") {
+			if pair = strings.TrimSpace(pair); len(pair) <= 0 {
+				continue
+			}
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("expected key=value, got %q", pair)
+			}
+			item := reflect.New(value.Type().Elem()).Elem()
+			err := setFromString(item, parts[1])
+			if err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(strings.TrimSpace(parts[0])), item)
+		}
+		value.Set(m)
+	default:
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+	return nil
+}
+
+// resolveSecretFiles reads secrets tagged secret:"true" from their <name>_file sibling, e.g. ssh.password_file
+func (c *Config) resolveSecretFiles() error {
+	return resolveSecretFiles(reflect.ValueOf(c).Elem(), "")
+}
+
+func resolveSecretFiles(value reflect.Value, path string) error {
+	fields := jsonFields(value.Type())
+	byName := make(map[string]reflect.Value)
+	for _, field := range fields {
+		byName[field.name] = value.Field(field.index)
+	}
+
+	for _, field := range fields {
+		fieldValue := value.Field(field.index)
+		fieldPath := joinPath(path, field.name)
+		if fieldValue.Kind() == reflect.Struct {
+			err := resolveSecretFiles(fieldValue, fieldPath)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if ok, err := eachStructInSlice(fieldValue, fieldPath, resolveSecretFiles); ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if value.Type().Field(field.index).Tag.Get("secret") != "true" || fieldValue.Kind() != reflect.String {
+			continue
+		}
+		fileValue, ok := byName[field.name+"_file"]
+		if !ok || fileValue.Kind() != reflect.String || fileValue.Len() <= 0 {
+			continue
+		}
+		if fieldValue.Len() > 0 {
+			return fmt.Errorf("%s and %s_file are both set, use one", fieldPath, fieldPath)
+		}
+		data, err := ioutil.ReadFile(fileValue.String())
+		if err != nil {
+			return fmt.Errorf("%s_file: %w", fieldPath, err)
+		}
+		fieldValue.SetString(strings.TrimRight(string(data), "\r\n"))
+	}
+	return nil
+}
+
+// clears the secrets which resolveSecretFiles read from their <name>_file sibling
+func unresolveSecretFiles(value reflect.Value) {
+	fields := jsonFields(value.Type())
+	byName := make(map[string]reflect.Value)
+	for _, field := range fields {
+		byName[field.name] = value.Field(field.index)
+	}
+	for _, field := range fields {
+		fieldValue := value.Field(field.index)
+		if fieldValue.Kind() == reflect.Struct {
+			unresolveSecretFiles(fieldValue)
+			continue
+		}
+		if ok, _ := eachStructInSlice(fieldValue, "", func(item reflect.Value, path string) error {
+			unresolveSecretFiles(item)
+			return nil
+		}); ok {
+			continue
+		}
+		if value.Type().Field(field.index).Tag.Get("secret") != "true" || fieldValue.Kind() != reflect.String {
+			continue
+		}
+		if fileValue, ok := byName[field.name+"_file"]; ok && fileValue.Kind() == reflect.String && fileValue.Len() > 0 {
+			fieldValue.SetString("")
+		}
+	}
+}
+
+// eachStructInSlice calls fn with every element of a slice of structs, e.g. ssh.jump[0].
+// The elements are copied first, value may share them with another config.
+func eachStructInSlice(value reflect.Value, path string, fn func(item reflect.Value, path string) error) (bool, error) {
+	if value.Kind() != reflect.Slice || value.Type().Elem().Kind() != reflect.Struct {
+		return false, nil
+	}
+	if value.Len() <= 0 {
+		return true, nil
+	}
+	items := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+	reflect.Copy(items, value)
+	for i := 0; i < items.Len(); i++ {
+		err := fn(items.Index(i), fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			return true, err
+		}
+	}
+	value.Set(items)
+	return true, nil
+}
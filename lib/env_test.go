@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testLookup(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func Test_ApplyEnv(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "token")
+	err := ioutil.WriteFile(secret, []byte("file-token\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &Config{
+		SSH: SSHItem{Host: "sftp.example.com:22", PasswordFile: "/run/secrets/missing"},
+	}
+	err = conf.applyEnv(testLookup(map[string]string{
+		"PGPSFTP_SSH_PASSWORD":           "env-secret",
+		"PGPSFTP_DEPLOY_PATH_PRO":        "/pro/",
+		"PGPSFTP_DOWNLOAD_RETRIES":       "-1",
+		"PGPSFTP_DOWNLOAD_ALLOW_HOSTS":   "a.example.com, b.example.com",
+		"PGPSFTP_DOWNLOAD_ALLOW_PRIVATE": "true",
+		"PGPSFTP_QUEUE_PRIORITY":         "pro=3,dev=1",
+		"PGPSFTP_TRACING_SAMPLE_RATIO":   "0.5",
+		"PGPSFTP_ADMIN_TOKEN_FILE":       secret,
+	}))
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	if conf.SSH.Password != "env-secret" || len(conf.SSH.PasswordFile) > 0 || conf.SSH.Host != "sftp.example.com:22" {
+		t.Errorf("unexpected ssh %+v", conf.SSH)
+	}
+	if conf.Deploy.Production != "/pro/" || conf.Download.Retries != -1 || !conf.Download.AllowPrivate ||
+		len(conf.Download.AllowHosts) != 2 || conf.Download.AllowHosts[1] != "b.example.com" {
+		t.Errorf("unexpected overrides %+v %+v", conf.Deploy, conf.Download)
+	}
+	if conf.Queue.Priority["pro"] != 3 || conf.Tracing.SampleRatio != 0.5 {
+		t.Errorf("unexpected overrides %+v %+v", conf.Queue, conf.Tracing)
+	}
+	// admin.token_file is a setting of its own, PGPSFTP_ADMIN_TOKEN_FILE sets it
+	if conf.Admin.TokenFile != secret || len(conf.Admin.Token) > 0 {
+		t.Errorf("unexpected admin %+v", conf.Admin)
+	}
+
+	err = conf.applyEnv(testLookup(map[string]string{
+		"PGPSFTP_SSH_USER":      "env-user",
+		"PGPSFTP_SSH_USER_FILE": secret,
+	}))
+	if err == nil || !strings.Contains(err.Error(), "PGPSFTP_SSH_USER_FILE") {
+		t.Errorf("expected both set error, got %v", err)
+	}
+	err = conf.applyEnv(testLookup(map[string]string{"PGPSFTP_DOWNLOAD_TIMEOUT": "soon"}))
+	if err == nil || !strings.Contains(err.Error(), "download.timeout") {
+		t.Errorf("expected parse error, got %v", err)
+	}
+}
+
+func Test_SecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "password")
+	err := ioutil.WriteFile(secret, []byte("file-secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	writeTestConfig(t, path, "/upload", "")
+	err, conf := NewConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.SSH.PasswordFile = secret
+	conf.SSH.Jump = []SSHItem{{Host: "bastion:22", PasswordFile: secret}}
+	err = conf.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err, conf = NewConfig(path)
+	if err != nil || conf.SSH.Password != "file-secret" || conf.SSH.Jump[0].Password != "file-secret" {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	// the secret stays in its file
+	err = conf.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), "file-secret") || conf.SSH.Jump[0].Password != "file-secret" {
+		t.Errorf("secret from file was saved into the config")
+	}
+
+	conf.SSH.Password = "inline"
+	err = conf.resolveSecretFiles()
+	if err == nil || !strings.Contains(err.Error(), "ssh.password and ssh.password_file") {
+		t.Errorf("expected both set error, got %v", err)
+	}
+}
+
+func Test_ConfigErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	for content, expected := range map[string]string{
+		"{\n  \"listen\": \"127.0.0.1:3333\",\n  \"ssh\": {\"host\": 22}\n}": ":3:19: ssh.host must be string, got number",
+		"{\n  \"listen\": \"127.0.0.1:3333\"\n  \"tmp_path\": \"/tmp\"\n}":   ":3:3: invalid character",
+	} {
+		err := ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err, _ = NewConfig(path)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q, got %v", expected, err)
+		}
+	}
+
+	// unknown settings are reported, not refused
+	writeTestFile(t, path, "{\n  \"listen\": \"127.0.0.1:3333\",\n  \"lisen\": \"x\",\n  \"ssh\": {\"Host\": \"a:22\", \"hots\": \"b\"},\n  \"destinations\": [{\"name\": \"archive\", \"old\": 1}]\n}")
+	err, loaded := NewConfig(path)
+	expected := []string{
+		path + `: unknown setting "destinations[0].old" is ignored`,
+		path + `: unknown setting "lisen" is ignored`,
+		path + `: unknown setting "ssh.hots" is ignored`,
+	}
+	if err != nil || !reflect.DeepEqual(loaded.Warnings(), expected) || loaded.SSH.Host != "a:22" {
+		t.Errorf("expected the unknown settings as warnings, got %v %v", err, loaded)
+	}
+
+	conf := &Config{
+		Listen:   "3333",
+		TempPath: os.TempDir(),
+		SSH:      SSHItem{Host: "sftp.example.com", Username: "tester", PrivateKey: "/missing/id_rsa"},
+		Download: DownloadConfig{Retries: -2, AllowSchemes: []string{"ftp"}},
+		Log:      LogConfig{Format: "xml", Level: "loud"},
+		Tracing:  TracingConfig{Endpoint: "collector:4318", SampleRatio: 2},
+	}
+	err = conf.Validate()
+	if err == nil {
+		t.Errorf("expected validation errors")
+		return
+	}
+	for _, expected := range []string{
+		"deploy_path.pro is required", `listen "3333" must be host:port`, `ssh.host "sftp.example.com" must be host:port`,
+		"ssh.key:", "download.retries must be >= -1", `unsupported scheme "ftp"`, "log.format", "log.level",
+		"tracing.endpoint", "tracing.sample_ratio",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("missing %q in %v", expected, err)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// config file formats, detected by the file extension
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+func configFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatJSON
+}
+
+// toJSON converts a yaml or toml document to json, so the config keeps one set of field names and one strict decoder
+func toJSON(format string, data []byte) ([]byte, error) {
+	var doc interface{}
+	switch format {
+	case FormatYAML:
+		err := yaml.Unmarshal(data, &doc)
+		if err != nil {
+			return nil, err
+		}
+	case FormatTOML:
+		table := make(map[string]interface{})
+		_, err := toml.Decode(string(data), &table)
+		if err != nil {
+			return nil, err
+		}
+		doc = table
+	default:
+		return data, nil
+	}
+	if doc == nil {
+		// an empty file changes nothing
+		return []byte("{}"), nil
+	}
+	doc, err := jsonValue(doc)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+func jsonValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = converted
+		}
+		return v, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(key)] = converted
+		}
+		return m, nil
+	case []interface{}:
+		for i, item := range v {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+		return v, nil
+	case []map[string]interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = item
+		}
+		return jsonValue(items)
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	}
+	return value, nil
+}
+
+// fromJSON writes the json encoded config in the given format
+func fromJSON(format string, data []byte) ([]byte, error) {
+	switch format {
+	case FormatYAML:
+		// yaml is a superset of json, the node keeps the field order
+		node := &yaml.Node{}
+		err := yaml.Unmarshal(data, node)
+		if err != nil {
+			return nil, err
+		}
+		blockStyle(node)
+		buffer := &bytes.Buffer{}
+		encoder := yaml.NewEncoder(buffer)
+		encoder.SetIndent(2)
+		err = encoder.Encode(node)
+		if err != nil {
+			return nil, err
+		}
+		err = encoder.Close()
+		return buffer.Bytes(), err
+	case FormatTOML:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var doc map[string]interface{}
+		err := decoder.Decode(&doc)
+		if err != nil {
+			return nil, err
+		}
+		buffer := &bytes.Buffer{}
+		encoder := toml.NewEncoder(buffer)
+		encoder.Indent = ""
+		err = encoder.Encode(tomlValue(doc))
+		return buffer.Bytes(), err
+	}
+	buffer := &bytes.Buffer{}
+	err := json.Indent(buffer, data, "", "    ")
+	return buffer.Bytes(), err
+}
+
+// drops the null settings and writes the rest in block style
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	if node.Kind == yaml.MappingNode {
+		content := make([]*yaml.Node, 0, len(node.Content))
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i+1].Tag != "!!null" {
+				content = append(content, node.Content[i], node.Content[i+1])
+			}
+		}
+		node.Content = content
+	}
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+// toml has no null, and keeps integers apart from floats
+func tomlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if item != nil {
+				m[key] = tomlValue(item)
+			}
+		}
+		return m
+	case []interface{}:
+		items := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			if item != nil {
+				items = append(items, tomlValue(item))
+			}
+		}
+		return items
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return value
+}
+
+// patchConfig applies the changes to the original content of a config file. JSON and YAML keep the order
+// of their settings and YAML its comments, toml is written again from its settings.
+func patchConfig(format string, original []byte, changes []configChange) ([]byte, error) {
+	if format == FormatTOML {
+		doc := make(map[string]interface{})
+		data, err := toJSON(format, original)
+		if err == nil {
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.UseNumber()
+			err = decoder.Decode(&doc)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, change := range changes {
+			patchMap(doc, change.path, change.value)
+		}
+		data, err = json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		return fromJSON(format, data)
+	}
+
+	// yaml is a superset of json
+	doc := &yaml.Node{}
+	err := yaml.Unmarshal(original, doc)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) <= 0 {
+		doc = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, errors.New("the settings must be a mapping")
+	}
+	for _, change := range changes {
+		err = patchNode(root, change.path, change.value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	buffer := &bytes.Buffer{}
+	if format == FormatJSON {
+		compact := &bytes.Buffer{}
+		err = nodeJSON(compact, root)
+		if err == nil {
+			err = json.Indent(buffer, compact.Bytes(), "", "    ")
+		}
+		return buffer.Bytes(), err
+	}
+	encoder := yaml.NewEncoder(buffer)
+	encoder.SetIndent(2)
+	err = encoder.Encode(doc)
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.Close()
+	return buffer.Bytes(), err
+}
+
+// patchMap sets path in doc to value, nil removes it
+func patchMap(doc map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		child, ok := doc[key].(map[string]interface{})
+		if !ok {
+			if value == nil {
+				return
+			}
+			child = make(map[string]interface{})
+			doc[key] = child
+		}
+		doc = child
+	}
+	if value == nil {
+		delete(doc, path[len(path)-1])
+		return
+	}
+	doc[path[len(path)-1]] = value
+}
+
+// patchNode sets path in the mapping node to value, nil removes it. The comments of a replaced value stay.
+func patchNode(node *yaml.Node, path []string, value interface{}) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != path[0] {
+			continue
+		}
+		child := node.Content[i+1]
+		if len(path) > 1 && child.Kind == yaml.MappingNode {
+			return patchNode(child, path[1:], value)
+		}
+		if value == nil {
+			if len(path) == 1 {
+				node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			}
+			return nil
+		}
+		head, line, foot := child.HeadComment, child.LineComment, child.FootComment
+		err := child.Encode(nestedValue(path[1:], value))
+		child.HeadComment, child.LineComment, child.FootComment = head, line, foot
+		return err
+	}
+	if value == nil {
+		return nil
+	}
+	child := &yaml.Node{}
+	err := child.Encode(nestedValue(path[1:], value))
+	if err != nil {
+		return err
+	}
+	key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: path[0]}
+	node.Content = append(node.Content, key, child)
+	return nil
+}
+
+// nestedValue wraps value into the maps of path
+func nestedValue(path []string, value interface{}) interface{} {
+	for i := len(path) - 1; i >= 0; i-- {
+		value = map[string]interface{}{path[i]: value}
+	}
+	return value
+}
+
+// nodeJSON writes node as compact json, in the order of its keys
+func nodeJSON(buffer *bytes.Buffer, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.AliasNode:
+		return nodeJSON(buffer, node.Alias)
+	case yaml.MappingNode:
+		buffer.WriteByte('{')
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			key, err := json.Marshal(node.Content[i].Value)
+			if err != nil {
+				return err
+			}
+			buffer.Write(key)
+			buffer.WriteByte(':')
+			err = nodeJSON(buffer, node.Content[i+1])
+			if err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte('}')
+		return nil
+	case yaml.SequenceNode:
+		buffer.WriteByte('[')
+		for i, item := range node.Content {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			err := nodeJSON(buffer, item)
+			if err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte(']')
+		return nil
+	}
+	var value interface{}
+	err := node.Decode(&value)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	buffer.Write(data)
+	return nil
+}
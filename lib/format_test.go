@@ -0,0 +1,198 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testYAMLConfig = `# base config
+listen: 127.0.0.1:3333
+tmp_path: /tmp
+ssh:
+  host: sftp.example.com:22 # zurich
+  user: tester
+  password: secret
+deploy_path:
+  dev: /dev/
+  pro: /pro/
+  test: /test/
+download:
+  allow_hosts: [a.example.com]
+  retries: -1
+queue:
+  priority:
+    pro: 2
+    dev: 1
+`
+
+const testTOMLConfig = `# production overlay
+listen = "0.0.0.0:3333"
+
+[deploy_path]
+pro = "/production/"
+
+[download]
+allow_hosts = ["files.example.com"]
+max_size = 1048576
+
+[queue.priority]
+test = 5
+`
+
+func writeTestFile(t *testing.T, path string, content string) {
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_LayeredConfig(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.yaml")
+	overlay := filepath.Join(dir, "pro.toml")
+	writeTestFile(t, base, testYAMLConfig)
+	writeTestFile(t, overlay, testTOMLConfig)
+
+	err, conf := NewConfig(base, overlay)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	if conf.Listen != "0.0.0.0:3333" || conf.SSH.Host != "sftp.example.com:22" || conf.SSH.Password != "secret" {
+		t.Errorf("unexpected config %+v", conf)
+	}
+	// settings missing from the overlay keep the base value, lists are replaced and maps merged
+	if conf.Deploy.Production != "/production/" || conf.Deploy.Development != "/dev/" {
+		t.Errorf("unexpected deploy_path %+v", conf.Deploy)
+	}
+	if len(conf.Download.AllowHosts) != 1 || conf.Download.AllowHosts[0] != "files.example.com" ||
+		conf.Download.Retries != -1 || conf.Download.MaxSize != 1048576 {
+		t.Errorf("unexpected download %+v", conf.Download)
+	}
+	if conf.Queue.Priority["pro"] != 2 || conf.Queue.Priority["test"] != 5 {
+		t.Errorf("unexpected priority %+v", conf.Queue.Priority)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_SaveConfigFormat(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"config.yaml", "config.toml"} {
+		path := filepath.Join(dir, name)
+		if strings.HasSuffix(name, ".yaml") {
+			writeTestFile(t, path, testYAMLConfig)
+		} else {
+			writeTestFile(t, path, testTOMLConfig)
+		}
+		err, conf := NewConfig(path)
+		if err != nil {
+			t.Log(err)
+			t.Fail()
+			return
+		}
+		conf.Deploy.Testing = "/saved/"
+		err = conf.Save()
+		if err != nil {
+			t.Log(err)
+			t.Fail()
+			return
+		}
+
+		data, _ := ioutil.ReadFile(path)
+		if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+			t.Errorf("%s was saved as json:\n%s", name, data)
+		}
+		err, saved := NewConfig(path)
+		if err != nil {
+			t.Log(err)
+			t.Fail()
+			return
+		}
+		if saved.Deploy.Testing != "/saved/" || saved.Listen != conf.Listen ||
+			saved.Download.MaxSize != conf.Download.MaxSize || saved.Queue.Priority["pro"] != conf.Queue.Priority["pro"] {
+			t.Errorf("%s did not round trip: %+v", name, saved)
+		}
+	}
+}
+
+func Test_SaveLayeredConfig(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.yaml")
+	overlay := filepath.Join(dir, "pro.yaml")
+	writeTestFile(t, base, testYAMLConfig)
+	writeTestFile(t, overlay, "# production overlay\nlisten: 0.0.0.0:3333 # public\ndeploy_path:\n  pro: /production/\n")
+	t.Setenv("PGPSFTP_SSH_PASSWORD", "env-secret")
+
+	err, conf := NewConfig(base, overlay)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	conf.Deploy.Testing = "/saved/"
+	err = conf.Save()
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+
+	// only the overlay and the change, the base and the environment stay where they are
+	data, _ := ioutil.ReadFile(overlay)
+	for _, expected := range []string{"# production overlay", "# public", "pro: /production/", "test: /saved/"} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("expected %q in the saved overlay:\n%s", expected, data)
+		}
+	}
+	for _, unexpected := range []string{"env-secret", "password", "sftp.example.com", "/dev/"} {
+		if strings.Contains(string(data), unexpected) {
+			t.Errorf("unexpected %q in the saved overlay:\n%s", unexpected, data)
+		}
+	}
+	os.Unsetenv("PGPSFTP_SSH_PASSWORD")
+	err, saved := NewConfig(base, overlay)
+	if err != nil || saved.Deploy.Testing != "/saved/" || saved.SSH.Password != "secret" || saved.Listen != "0.0.0.0:3333" {
+		t.Errorf("unexpected saved config %+v %v", saved, err)
+	}
+
+	// json keeps the order of its settings
+	path := filepath.Join(dir, "config.json")
+	writeTestFile(t, path, "{\"tmp_path\": \"/tmp\", \"listen\": \"127.0.0.1:3333\"}")
+	err, conf = NewConfig(path)
+	if err == nil {
+		conf.Listen = "0.0.0.0:3333"
+		err = conf.Save()
+	}
+	expected := "{\n    \"tmp_path\": \"/tmp\",\n    \"listen\": \"0.0.0.0:3333\"\n}"
+	if data, _ := ioutil.ReadFile(path); err != nil || string(data) != expected {
+		t.Errorf("expected the settings in their order, got %v:\n%s", err, data)
+	}
+}
+
+func Test_ConfigFormatErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"bad.yaml":  "listen: [127.0.0.1\n",
+		"type.toml": "[ssh]\nhost = 22\n",
+	} {
+		path := filepath.Join(dir, name)
+		writeTestFile(t, path, content)
+		err, _ := NewConfig(path)
+		if err == nil || !strings.HasPrefix(err.Error(), path+": ") {
+			t.Errorf("expected an error naming %s, got %v", path, err)
+		}
+	}
+
+	path := filepath.Join(dir, "unknown.yaml")
+	writeTestFile(t, path, "lisen: 127.0.0.1:3333\n")
+	err, conf := NewConfig(path)
+	if warnings := conf.Warnings(); err != nil || len(warnings) != 1 || !strings.HasPrefix(warnings[0], path+": ") {
+		t.Errorf("expected a warning naming %s, got %v %v", path, err, warnings)
+	}
+}
@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHealthMinFreeSpace = 100 << 20
+	DefaultHealthCacheTTL     = 30
+)
+
+type HealthConfig struct {
+	// bytes, tmp_path needs at least this much free space, default 100MB
+	MinFreeSpace int64 `json:"min_free_space"`
+	// seconds to reuse the last readiness result, default 30
+	CacheTTL int `json:"cache_ttl"`
+}
+
+func (c *HealthConfig) minFreeSpace() int64 {
+	if c.MinFreeSpace > 0 {
+		return c.MinFreeSpace
+	}
+	return DefaultHealthMinFreeSpace
+}
+
+func (c *HealthConfig) cacheTTL() time.Duration {
+	if c.CacheTTL > 0 {
+		return time.Duration(c.CacheTTL) * time.Second
+	}
+	return DefaultHealthCacheTTL * time.Second
+}
+
+// swagger:model
+type HealthCheck struct {
+	Name     string `json:"name"`
+	Status   bool   `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// swagger:model
+type HealthReport struct {
+	Status  bool           `json:"status"`
+	Checked time.Time      `json:"checked"`
+	Checks  []*HealthCheck `json:"checks"`
+}
+
+// HealthChecker runs the readiness checks and caches the result for the configured TTL
+type HealthChecker struct {
+	config func() *Config
+	mu     sync.Mutex
+	last   *HealthReport
+}
+
+func NewHealthChecker(config func() *Config) *HealthChecker {
+	return &HealthChecker{
+		config: config,
+	}
+}
+
+func (h *HealthChecker) Check() *HealthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	conf := h.config()
+	if h.last != nil && time.Since(h.last.Checked) < conf.Health.cacheTTL() {
+		return h.last
+	}
+
+	report := &HealthReport{
+		Status:  true,
+		Checked: time.Now(),
+	}
+	checks := []struct {
+		name string
+		fn   func(*Config) (string, error)
+	}{
+		{"config", h.checkConfig},
+		{"tmp_path", h.checkTempPath},
+		{conf.Transport.kind(), h.checkTransport},
+	}
+	for index := range conf.Destinations {
+		name := conf.Destinations[index].Name
+		checks = append(checks, struct {
+			name string
+			fn   func(*Config) (string, error)
+		}{"destination." + name, func(conf *Config) (string, error) {
+			destination, err := conf.destination(name)
+			if err != nil {
+				return "", err
+			}
+			return h.checkTransport(destination)
+		}})
+	}
+	for _, item := range checks {
+		started := time.Now()
+		detail, err := item.fn(conf)
+		check := &HealthCheck{
+			Name:     item.name,
+			Status:   err == nil,
+			Detail:   detail,
+			Duration: time.Since(started).String(),
+		}
+		if err != nil {
+			check.Error = err.Error()
+			report.Status = false
+			log.Warningf("readiness check %s failed: %s", item.name, err)
+		}
+		report.Checks = append(report.Checks, check)
+	}
+
+	h.last = report
+	return report
+}
+
+func (h *HealthChecker) checkConfig(conf *Config) (string, error) {
+	return "", conf.Validate()
+}
+
+func (h *HealthChecker) checkTempPath(conf *Config) (string, error) {
+	err := os.MkdirAll(conf.TempPath, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	probe, err := os.CreateTemp(conf.TempPath, ".readyz-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = probe.Write([]byte("ok"))
+	probe.Close()
+	os.Remove(probe.Name())
+	if err != nil {
+		return "", err
+	}
+
+	free, err := FreeSpace(conf.TempPath)
+	if err != nil {
+		return "", err
+	}
+	detail := fmt.Sprintf("%d bytes free", free)
+	if free < conf.Health.minFreeSpace() {
+		return detail, fmt.Errorf("free space below %d bytes", conf.Health.minFreeSpace())
+	}
+	return detail, nil
+}
+
+// logs in to the destination of transport.type, e.g. opens the sftp subsystem
+func (h *HealthChecker) checkTransport(conf *Config) (string, error) {
+	transport := NewTransport(context.Background(), &conf.Transport, &conf.SSH)
+	defer transport.Close()
+
+	return transport.Host(), transport.Check()
+}
+
+func (this *HTTPService) Healthz(writer http.ResponseWriter, request *http.Request) {
+	this.ResponseJSON(ServiceResult{Status: true}, writer, 200)
+}
+
+func (this *HTTPService) Readyz(writer http.ResponseWriter, request *http.Request) {
+	report := this.health.Check()
+	if !report.Status {
+		this.ResponseStatus(report, writer, http.StatusServiceUnavailable)
+		return
+	}
+	this.ResponseJSON(report, writer, 200)
+}
@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getHealthTestConfig(t *testing.T, server *testSFTPServer) *Config {
+	root := t.TempDir()
+	return &Config{
+		Listen:   "127.0.0.1:0",
+		TempPath: t.TempDir(),
+		SSH:      *server.Item,
+		Deploy: DeployPath{
+			Development: root,
+			Production:  root,
+			Testing:     root,
+		},
+		Health: HealthConfig{MinFreeSpace: 1},
+	}
+}
+
+func getReadyz(t *testing.T, httpServer *HTTPService) (int, *HealthReport) {
+	writer := httptest.NewRecorder()
+	httpServer.getHTTPHandler().ServeHTTP(writer, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	resp := writer.Result()
+
+	report := &HealthReport{}
+	err := json.NewDecoder(resp.Body).Decode(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, report
+}
+
+func Test_Readyz(t *testing.T) {
+	server := newTestSFTPServer(t)
+	httpServer := NewHTTP(getHealthTestConfig(t, server))
+
+	code, report := getReadyz(t, httpServer)
+	if code != http.StatusOK || !report.Status || len(report.Checks) != 3 {
+		t.Errorf("expected ready, got %d %s", code, ToJSON(report))
+	}
+
+	// cached result, no new ssh connection
+	connections := server.Connections()
+	getReadyz(t, httpServer)
+	if server.Connections() != connections {
+		t.Errorf("readiness result should be cached")
+	}
+}
+
+func Test_ReadyzFailure(t *testing.T) {
+	server := newTestSFTPServer(t)
+	conf := getHealthTestConfig(t, server)
+	conf.SSH.Password = "wrong"
+	conf.Deploy.Production = ""
+	httpServer := NewHTTP(conf)
+
+	code, report := getReadyz(t, httpServer)
+	if code != http.StatusServiceUnavailable || report.Status {
+		t.Errorf("expected not ready, got %d %s", code, ToJSON(report))
+	}
+	for _, check := range report.Checks {
+		expect := check.Name == "tmp_path"
+		if check.Status != expect {
+			t.Errorf("unexpected check result %s", ToJSON(check))
+		}
+	}
+}
+
+func Test_Healthz(t *testing.T) {
+	httpServer := NewHTTP(&Config{TempPath: t.TempDir()})
+	writer := httptest.NewRecorder()
+	httpServer.getHTTPHandler().ServeHTTP(writer, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if writer.Code != http.StatusOK {
+		t.Errorf("Response code is %v", writer.Code)
+	}
+}
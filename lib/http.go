@@ -1,25 +1,41 @@
 package lib
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
-	"path"
+	"strconv"
 	"strings"
-	
+	"sync"
+	"sync/atomic"
+
 	"github.com/gorilla/mux"
 )
 
 type HTTPService struct {
-	config *Config
+	state     atomic.Pointer[configState]
+	reloadMu  sync.Mutex
+	scheduler *Scheduler
+	queue     *JobQueue
+	health    *HealthChecker
+	audit     *AuditLog
+	server    *http.Server
+	watcher   *Watcher
 }
 
 type ServiceResult struct {
-	Status bool   `json:"status"`
-	Error  string `json:"error"`
+	Status bool          `json:"status"`
+	Error  string        `json:"error"`
+	ID     string        `json:"id,omitempty"`
+	Files  []*FileResult `json:"files,omitempty"`
+	// remote paths of the batch manifests
+	Manifests []string `json:"manifests,omitempty"`
+	// per destination status of a job with destinations
+	Destinations []*DestinationResult `json:"destinations,omitempty"`
 }
 
 // swagger:model
@@ -38,12 +54,47 @@ type MultipleBody struct {
 	ENV string `json:"env"`
 	// notify URL
 	NotifyURL string `json:"notify"`
+	// bundle all files into one encrypted archive
+	// enum: zip, tar.gz
+	Package string `json:"package,omitempty"`
+	// deliver to these destinations of the config instead of the default one, each maybe with its own key
+	Destinations []*DestinationRequest `json:"destinations,omitempty"`
+	// all or nothing, or best_effort, default delivery.mode
+	// enum: all, best_effort
+	Delivery string `json:"delivery,omitempty"`
+}
+
+// Validate checks the required fields
+func (b *MultipleBody) Validate() error {
+	if len(b.Files) <= 0 {
+		return errors.New("File list empty")
+	}
+	if len(b.PGPKey) <= 0 {
+		return errors.New("PGPKey empty")
+	}
+	if len(b.ENV) <= 0 {
+		return errors.New("ENV empty")
+	}
+	if !validPackage(b.Package) {
+		return fmt.Errorf("package must be zip or tar.gz, got %q", b.Package)
+	}
+	if !validDelivery(b.Delivery) {
+		return fmt.Errorf("delivery must be all or best_effort, got %q", b.Delivery)
+	}
+	return nil
 }
 
 func NewHTTP(conf *Config) *HTTPService {
-	return &HTTPService{
-		config: conf,
+	service := &HTTPService{
+		scheduler: NewScheduler(&conf.Concurrency),
+		queue:     NewJobQueue(&conf.Queue, conf.TempPath),
+		audit:     NewAuditLog(conf.Audit.Path),
+		server:    &http.Server{Addr: conf.Listen},
 	}
+	service.state.Store(newConfigState(conf, 1))
+	service.health = NewHealthChecker(service.Config)
+	service.watcher = NewWatcher(conf, service.scheduler, service.audit)
+	return service
 }
 
 func (this *HTTPService) getHTTPHandler() http.Handler {
@@ -52,17 +103,63 @@ func (this *HTTPService) getHTTPHandler() http.Handler {
 	r.HandleFunc("/encrypt", this.Encrypt)
 	r.HandleFunc("/upload", this.Upload)
 	r.HandleFunc("/multiple/upload", this.Multiple)
+	r.HandleFunc("/queue", this.QueueStats)
+	r.Handle("/metrics", this.metricsHandler())
+	r.HandleFunc("/healthz", this.Healthz)
+	r.HandleFunc("/readyz", this.Readyz)
+	r.HandleFunc("/admin/config", this.adminOnly(this.AdminConfig))
+	r.HandleFunc("/admin/reload", this.adminOnly(this.AdminReload))
 	r.PathPrefix("/swagger/").Handler(http.StripPrefix("/swagger/",
-		http.FileServer(http.Dir(fmt.Sprintf("%s/swagger", this.config.WebRoot)))))
+		http.FileServer(http.Dir(fmt.Sprintf("%s/swagger", this.Config().WebRoot)))))
 	r.NotFoundHandler = http.HandlerFunc(this.NotFoundHandle)
-	
-	return r
+	r.Use(this.metricsMiddleware, this.tracingMiddleware)
+
+	return this.requestIDMiddleware(r)
 }
 
 func (this *HTTPService) Start() error {
 	log.Info("http service starting")
-	log.Infof("Please open http://%s\n", this.config.Listen)
-	return http.ListenAndServe(this.config.Listen, this.getHTTPHandler())
+	err := this.audit.Open()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	err = this.resumePendingJobs()
+	if err != nil {
+		return err
+	}
+	this.server.Handler = this.getHTTPHandler()
+	log.Infof("Please open http://%s\n", this.Config().Listen)
+	err = this.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// accepts the caller's X-Request-ID or generates one, echoed in the response
+func (this *HTTPService) requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = NewRequestID()
+		}
+		writer.Header().Set("X-Request-ID", id)
+
+		next.ServeHTTP(writer, request.WithContext(WithRequestID(request.Context(), id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if len(id) <= 0 || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
 }
 
 func (this *HTTPService) NotFoundHandle(writer http.ResponseWriter, request *http.Request) {
@@ -84,18 +181,20 @@ func GetMimeType(src *multipart.FileHeader) (string, string, error) {
 }
 
 func (this *HTTPService) Upload(writer http.ResponseWriter, request *http.Request) {
+	logger := Logger(request.Context())
+	conf := this.Config()
 	err := request.ParseMultipartForm(32 << 20)
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
 		this.ResponseError(err, writer, 500)
 		return
 	}
-	
+
 	var reader io.Reader
-	
+
 	file, header, err := request.FormFile("upload")
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
 		this.ResponseError(err, writer, 500)
 		return
 	}
@@ -105,56 +204,75 @@ func (this *HTTPService) Upload(writer http.ResponseWriter, request *http.Reques
 	key := request.FormValue("key")
 	deploy_type := request.FormValue("deploy")
 
-	mimeType, filename, err := GetMimeType(header)
-	log.Info("filename:", filename)
-	if err == nil && strings.Contains(mimeType, "image") {
-		//convert to pdf
-		reader, err = getPDFBytes(file, this.config.TempPath)
-		if err != nil {
-			log.Error(err)
-			this.ResponseError(err, writer, 500)
-			return
-		}
-		filename = filename + ".pdf"
+	received, err := this.verifyUpload(file, header.Filename, request)
+	if errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrSizeMismatch) {
+		// not the file the caller meant, nothing is uploaded
+		logger.Error(err)
+		this.ResponseErrorStatus(err, writer, http.StatusUnprocessableEntity)
+		return
 	}
-
-	keyReader := strings.NewReader(key)
-	remoteFile := path.Join(this.config.GetDeployPath(deploy_type), filename+".pgp")
-	helper, err := NewPGPHelper(keyReader)
 	if err != nil {
-		log.Error(err)
-		this.ResponseError(err, writer, 500)
+		logger.Error(err)
+		this.ResponseError(err, writer, 400)
 		return
 	}
-	buffer, err := helper.Encrypt(reader)
+
+	mimeType, _, err := GetMimeType(header)
+	image := err == nil && strings.Contains(mimeType, "image")
+	received.Remote, err = Upload(request.Context(), conf, this.scheduler, this.audit, &UploadRequest{
+		Filename:        header.Filename,
+		Reader:          reader,
+		Image:           image,
+		Key:             key,
+		Deploy:          deploy_type,
+		Received:        received,
+		Caller:          callerIdentity(request),
+		RemoteAddr:      request.RemoteAddr,
+		ClaimedClientID: claimedClientID(request),
+	})
 	if err != nil {
-		log.Error(err)
 		this.ResponseError(err, writer, 500)
 		return
 	}
-	ssh := NewSSHClient(&this.config.SSH)
-	err = ssh.Put(remoteFile, buffer)
+
+	this.ResponseJSON(ServiceResult{Status: true, Files: []*FileResult{received}}, writer, 200)
+}
+
+// checks the optional "sha256" / "size" form values against the received file
+func (this *HTTPService) verifyUpload(file multipart.File, filename string, request *http.Request) (*FileResult, error) {
+	received, err := ChecksumReader(filename, file)
 	if err != nil {
-		log.Error(err)
-		this.ResponseError(err, writer, 500)
-		return
+		return nil, err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
 	}
 
-	this.ResponseJSON(ServiceResult{Status:true}, writer, 200)
+	var expectSize int64
+	if size := request.FormValue("size"); len(size) > 0 {
+		expectSize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q", size)
+		}
+	}
+
+	return received, received.Verify(request.FormValue("sha256"), expectSize)
 }
 
 func (this *HTTPService) Encrypt(writer http.ResponseWriter, request *http.Request) {
+	logger := Logger(request.Context())
 	err := request.ParseMultipartForm(32 << 20)
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
 		this.ResponseError(err, writer, 500)
 		return
 	}
-	
+
 	var reader io.Reader
 	file, header, err := request.FormFile("upload")
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
 		http.Error(writer, err.Error(), 500)
 		return
 	}
@@ -163,75 +281,104 @@ func (this *HTTPService) Encrypt(writer http.ResponseWriter, request *http.Reque
 
 	key := request.FormValue("key")
 	mimeType, _, err := GetMimeType(header)
-	if err == nil && strings.Contains(mimeType, "image") {
-		//convert to pdf
-		reader, err = getPDFBytes(file, this.config.TempPath)
-		if err != nil {
-			log.Error(err)
-			this.ResponseError(err, writer, 500)
-			return
-		}
-	}
-	keyReader := strings.NewReader(key)
-	helper, err := NewPGPHelper(keyReader)
+	image := err == nil && strings.Contains(mimeType, "image")
+	helper, err := NewPGPHelper(strings.NewReader(key))
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
 		this.ResponseError(err, writer, 500)
 		return
 	}
-	buffer, err := helper.Encrypt(reader)
+	buffer, _, err := EncryptSource(request.Context(), this.Config(), nil, helper, header.Filename, image, reader)
 	if err != nil {
-		log.Error(err)
 		this.ResponseError(err, writer, 500)
 		return
 	}
-	
+
 	_, err = io.Copy(writer, buffer)
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
 		this.ResponseError(err, writer, 500)
 		return
 	}
 }
 
 func (this *HTTPService) ResponseError(err error, writer http.ResponseWriter, StatusCode int) {
-	this.ResponseJSON(err, writer, 500)
+	this.ResponseJSON(ServiceResult{Status: false, Error: err.Error()}, writer, StatusCode)
 }
 
 func (this *HTTPService) ResponseJSON(obj interface{}, writer http.ResponseWriter, StatusCode int) {
 	jsonString, _ := json.Marshal(obj)
 	writer.Header().Add("Content-Type", "application/json")
-	
+
 	fmt.Fprint(writer, string(jsonString))
 }
 
+// ResponseStatus writes obj with StatusCode, for the endpoints whose callers act on it:
+// the health checks, a full queue and the admin API. The others always answer 200.
+func (this *HTTPService) ResponseStatus(obj interface{}, writer http.ResponseWriter, StatusCode int) {
+	jsonString, _ := json.Marshal(obj)
+	writer.Header().Add("Content-Type", "application/json")
+	writer.WriteHeader(StatusCode)
+	fmt.Fprint(writer, string(jsonString))
+}
+
+func (this *HTTPService) ResponseErrorStatus(err error, writer http.ResponseWriter, StatusCode int) {
+	this.ResponseStatus(ServiceResult{Status: false, Error: err.Error()}, writer, StatusCode)
+}
+
 func (this *HTTPService) Multiple(writer http.ResponseWriter, request *http.Request) {
+	logger := Logger(request.Context())
 	decoder := json.NewDecoder(request.Body)
 	var reqBody MultipleBody
 	err := decoder.Decode(&reqBody)
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
 		this.ResponseError(errors.New("decode request body error"), writer, 500)
 		return
 	}
 
-	if len(reqBody.Files) <= 0 {
-		this.ResponseError(errors.New("File list empty"), writer, 500)
-		return
+	err = reqBody.Validate()
+	if err == nil {
+		err = reqBody.checkDestinations(this.Config())
 	}
-
-	if len(reqBody.PGPKey) <= 0 {
-		this.ResponseError(errors.New("PGPKey empty"), writer, 500)
+	if err != nil {
+		this.ResponseError(err, writer, 500)
 		return
 	}
 
-	if len(reqBody.ENV) <= 0 {
-		this.ResponseError(errors.New("ENV empty"), writer, 500)
+	z := NewZurich(this.Config(), reqBody.Files, reqBody.PGPKey, reqBody.ENV, reqBody.NotifyURL)
+	z.caller = callerIdentity(request)
+	z.remoteAddr = request.RemoteAddr
+	z.claimedClientID = claimedClientID(request)
+	z.withOptions(&reqBody)
+	z.WithContext(request.Context())
+	err = this.submitJob(z)
+	if err != nil {
+		logger.Error(err)
+		writer.Header().Set("Retry-After", strconv.Itoa(this.queue.RetryAfter()))
+		if errors.Is(err, ErrQueueFull) {
+			this.ResponseErrorStatus(err, writer, http.StatusTooManyRequests)
+		} else {
+			this.ResponseErrorStatus(err, writer, http.StatusServiceUnavailable)
+		}
 		return
 	}
 
-	z := NewZurich(this.config, reqBody.Files, reqBody.PGPKey, reqBody.ENV, reqBody.NotifyURL)
-	go z.Process()
+	this.ResponseJSON(ServiceResult{Status: true, ID: z.ID()}, writer, 200)
+}
+
+// WatchFolders delivers the files dropped into watch.folders until ctx is done
+func (this *HTTPService) WatchFolders(ctx context.Context) error {
+	return this.watcher.Run(ctx)
+}
+
+// runs the job on the service's shared scheduler and audit log
+func (this *HTTPService) submitJob(z *Zurich) error {
+	z.scheduler = this.scheduler
+	z.audit = this.audit
+	return this.queue.Submit(z, z.deployENV)
+}
 
-	this.ResponseJSON(ServiceResult{Status:true}, writer, 200)
+func (this *HTTPService) QueueStats(writer http.ResponseWriter, request *http.Request) {
+	this.ResponseJSON(this.queue.Stats(), writer, 200)
 }
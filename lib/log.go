@@ -1,13 +1,212 @@
 package lib
 
-import "github.com/op/go-logging"
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	stdlog "log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/op/go-logging"
+)
 
 var log = logging.MustGetLogger("ipa2s3")
 
-func init() {
-	format := logging.MustStringFormatter(
-		`pgp-sftp-proxy %{color} %{shortfunc} %{level:.4s} %{shortfile}
+// used by ContextLogger, one extra frame so %{shortfile} points to the caller
+var contextLog = logging.MustGetLogger("ipa2s3")
+
+var textFormat = logging.MustStringFormatter(
+	`pgp-sftp-proxy %{color} %{shortfunc} %{level:.4s} %{shortfile}
 %{id:03x}%{color:reset} %{message}`,
-	)
-	logging.SetFormatter(format)
+)
+
+func init() {
+	contextLog.ExtraCalldepth = 1
+	logging.SetFormatter(textFormat)
+}
+
+type LogConfig struct {
+	// text or json, default text
+	Format string `json:"format"`
+	// debug, info, notice, warning, error, critical, default debug
+	Level string `json:"level"`
+}
+
+// SetupLog switches the log backend to the configured format and level
+func SetupLog(conf *LogConfig) error {
+	level := logging.DEBUG
+	if len(conf.Level) > 0 {
+		var err error
+		level, err = logging.LogLevel(conf.Level)
+		if err != nil {
+			return err
+		}
+	}
+
+	var backend logging.Backend
+	switch strings.ToLower(conf.Format) {
+	case "", "text":
+		backend = logging.NewBackendFormatter(logging.NewLogBackend(os.Stderr, "", stdlog.LstdFlags), textFormat)
+	case "json":
+		backend = logging.NewBackendFormatter(logging.NewLogBackend(os.Stderr, "", 0), &jsonFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", conf.Format)
+	}
+
+	leveled := logging.AddModuleLevel(backend)
+	leveled.SetLevel(level, "")
+	logging.SetBackend(leveled)
+	return nil
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	jobIDKey
+)
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+func WithJobID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, jobIDKey, id)
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func JobIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(jobIDKey).(string)
+	return id
+}
+
+func NewRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// logFields lead the record arguments of a ContextLogger, the json format lifts them into keys
+type logFields map[string]string
+
+func (f logFields) String() string {
+	keys := make([]string, 0, len(f))
+	for key := range f {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, key+"="+f[key])
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// ContextLogger tags every line with the request / job id carried by the context
+type ContextLogger struct {
+	fields logFields
+}
+
+func Logger(ctx context.Context) *ContextLogger {
+	fields := logFields{}
+	if ctx != nil {
+		if id := RequestIDFromContext(ctx); len(id) > 0 {
+			fields["request_id"] = id
+		}
+		if id := JobIDFromContext(ctx); len(id) > 0 {
+			fields["job_id"] = id
+		}
+	}
+	return &ContextLogger{fields: fields}
+}
+
+func (l *ContextLogger) args(args []interface{}) []interface{} {
+	if len(l.fields) <= 0 {
+		return args
+	}
+	return append([]interface{}{l.fields}, args...)
+}
+
+func (l *ContextLogger) Debug(args ...interface{}) {
+	contextLog.Debug(l.args(args)...)
+}
+
+func (l *ContextLogger) Debugf(format string, args ...interface{}) {
+	contextLog.Debug(l.args([]interface{}{fmt.Sprintf(format, args...)})...)
+}
+
+func (l *ContextLogger) Info(args ...interface{}) {
+	contextLog.Info(l.args(args)...)
+}
+
+func (l *ContextLogger) Infof(format string, args ...interface{}) {
+	contextLog.Info(l.args([]interface{}{fmt.Sprintf(format, args...)})...)
+}
+
+func (l *ContextLogger) Warning(args ...interface{}) {
+	contextLog.Warning(l.args(args)...)
+}
+
+func (l *ContextLogger) Warningf(format string, args ...interface{}) {
+	contextLog.Warning(l.args([]interface{}{fmt.Sprintf(format, args...)})...)
+}
+
+func (l *ContextLogger) Error(args ...interface{}) {
+	contextLog.Error(l.args(args)...)
+}
+
+func (l *ContextLogger) Errorf(format string, args ...interface{}) {
+	contextLog.Error(l.args([]interface{}{fmt.Sprintf(format, args...)})...)
+}
+
+// one json object per line
+type jsonFormatter struct{}
+
+func (f *jsonFormatter) Format(calldepth int, r *logging.Record, output io.Writer) error {
+	entry := map[string]interface{}{
+		"time":   r.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+		"level":  r.Level.String(),
+		"module": r.Module,
+		"id":     r.ID,
+	}
+	if _, file, line, ok := runtime.Caller(calldepth + 1); ok {
+		entry["caller"] = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+
+	message := ""
+	if fields, ok := firstLogFields(r.Args); ok {
+		for key, value := range fields {
+			entry[key] = value
+		}
+		message = strings.TrimSuffix(fmt.Sprintln(r.Args[1:]...), "\n")
+	} else {
+		message = r.Message()
+	}
+	entry["message"] = message
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(data)
+	return err
+}
+
+func firstLogFields(args []interface{}) (logFields, bool) {
+	if len(args) <= 0 {
+		return nil, false
+	}
+	fields, ok := args[0].(logFields)
+	return fields, ok
 }
@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func captureLog(t *testing.T, formatter logging.Formatter) *bytes.Buffer {
+	buffer := new(bytes.Buffer)
+	logging.SetBackend(logging.NewBackendFormatter(logging.NewLogBackend(buffer, "", 0), formatter))
+	t.Cleanup(func() {
+		SetupLog(&LogConfig{})
+	})
+	return buffer
+}
+
+func Test_JSONLog(t *testing.T) {
+	buffer := captureLog(t, &jsonFormatter{})
+
+	ctx := WithJobID(WithRequestID(context.Background(), "req-1"), "job-1")
+	Logger(ctx).Infof("upload %s", "a.pdf")
+	log.Warning("plain", 2)
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buffer.String())
+	}
+
+	entry := map[string]interface{}{}
+	err := json.Unmarshal([]byte(lines[0]), &entry)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	if entry["message"] != "upload a.pdf" || entry["request_id"] != "req-1" || entry["job_id"] != "job-1" || entry["level"] != "INFO" {
+		t.Errorf("unexpected entry %s", lines[0])
+	}
+	if !strings.HasPrefix(entry["caller"].(string), "log_test.go:") {
+		t.Errorf("caller should point to the test, got %v", entry["caller"])
+	}
+
+	entry = map[string]interface{}{}
+	json.Unmarshal([]byte(lines[1]), &entry)
+	if entry["message"] != "plain 2" || entry["level"] != "WARNING" {
+		t.Errorf("unexpected entry %s", lines[1])
+	}
+}
+
+func Test_TextLogFields(t *testing.T) {
+	buffer := captureLog(t, logging.MustStringFormatter("%{message}"))
+
+	Logger(WithRequestID(context.Background(), "req-2")).Info("hello")
+	if strings.TrimSpace(buffer.String()) != "[request_id=req-2] hello" {
+		t.Errorf("unexpected line %q", buffer.String())
+	}
+}
+
+func Test_RequestID(t *testing.T) {
+	httpServer := NewHTTP(&Config{TempPath: t.TempDir()})
+	handler := httpServer.getHTTPHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/queue", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	if writer.Header().Get("X-Request-ID") != "abc-123" {
+		t.Errorf("request id should be echoed, got %q", writer.Header().Get("X-Request-ID"))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/queue", nil)
+	req.Header.Set("X-Request-ID", "bad id\nwith newline")
+	writer = httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	if id := writer.Header().Get("X-Request-ID"); len(id) != 16 {
+		t.Errorf("invalid request id should be replaced, got %q", id)
+	}
+}
@@ -0,0 +1,178 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const DefaultManifestTemplate = "{job_id}-{name}.pgp"
+
+// manifest.formats
+const (
+	ManifestJSON = "json"
+	ManifestCSV  = "csv"
+)
+
+type ManifestConfig struct {
+	// json and/or csv, empty for no manifest
+	Formats []string `json:"formats"`
+	// remote file name under deploy_path like naming.template, {name} is manifest.json or manifest.csv,
+	// default {job_id}-{name}.pgp
+	Template string `json:"template"`
+}
+
+// Manifest lists the files of a batch, it is uploaded after all of them
+type Manifest struct {
+	BatchID string          `json:"batch_id"`
+	Env     string          `json:"env"`
+	Created time.Time       `json:"created"`
+	Files   []*ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	// original file name
+	Name string `json:"name"`
+	// path of the encrypted file under deploy_path, in a package the path in the archive
+	Remote string `json:"remote"`
+	// size in bytes of the original file
+	Size int64 `json:"size"`
+	// SHA-256 (hex) of the original file
+	SHA256 string `json:"sha256"`
+}
+
+func (c *ManifestConfig) template() string {
+	if len(c.Template) > 0 {
+		return c.Template
+	}
+	return DefaultManifestTemplate
+}
+
+// Encode the manifest as json or csv
+func (m *Manifest) Encode(format string) ([]byte, error) {
+	switch format {
+	case ManifestJSON:
+		return json.MarshalIndent(m, "", "  ")
+	case ManifestCSV:
+		buffer := new(bytes.Buffer)
+		writer := csv.NewWriter(buffer)
+		writer.Write([]string{"batch_id", "name", "remote", "size", "sha256"})
+		for _, file := range m.Files {
+			writer.Write([]string{m.BatchID, file.Name, file.Remote, strconv.FormatInt(file.Size, 10), file.SHA256})
+		}
+		writer.Flush()
+		return buffer.Bytes(), writer.Error()
+	}
+	return nil, fmt.Errorf("unknown manifest format %q", format)
+}
+
+// 生成索引文件，加密后最后上传，接收方收到索引文件即表示整批文件已上传完成
+func (this *Zurich) UploadManifest() error {
+	formats := this.conf.Manifest.Formats
+	if len(formats) <= 0 {
+		return nil
+	}
+	this.logger().Info("begin upload manifest")
+	ctx, span := startSpan(this.ctx, "stage.manifest", attribute.StringSlice("manifest.formats", formats))
+
+	prefixFolder := this.conf.GetDeployPath(this.deployENV)
+	manifest := &Manifest{
+		BatchID: this.ID(),
+		Env:     this.deployENV,
+		Created: time.Now(),
+		Files:   make([]*ManifestFile, 0, len(this.Files)),
+	}
+	for index, zFile := range this.Files {
+		file := &ManifestFile{
+			Name:   zFile.Name,
+			Remote: strings.TrimPrefix(this.pgpFiles[index].remotePath, strings.TrimSuffix(prefixFolder, "/")+"/"),
+		}
+		if zFile.received != nil {
+			file.Size = zFile.received.Size
+			file.SHA256 = zFile.received.SHA256
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	helper, err := NewPGPHelper(strings.NewReader(this.pgpKey))
+	if err != nil {
+		endSpan(span, err)
+		return err
+	}
+	transport := NewTransport(ctx, &this.conf.Transport, &this.conf.SSH)
+	defer transport.Close()
+
+	naming := &NamingConfig{Template: this.conf.Manifest.template()}
+	this.manifests = make([]string, 0, len(formats))
+	for _, format := range formats {
+		err = this.uploadManifest(ctx, transport, helper, naming, manifest, format, prefixFolder)
+		if err != nil {
+			break
+		}
+	}
+	endSpan(span, err)
+	return err
+}
+
+func (this *Zurich) uploadManifest(ctx context.Context, transport Transport, helper *PGPHelper, naming *NamingConfig, manifest *Manifest, format string, prefixFolder string) error {
+	data, err := manifest.Encode(format)
+	if err != nil {
+		this.logger().Error(err)
+		return err
+	}
+	encrypted, err := helper.WithContext(ctx).Encrypt(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("encrypt manifest: %w", err)
+	}
+	remotePath, err := naming.RemotePath(prefixFolder, &NameVars{
+		Name:   "manifest." + format,
+		Env:    this.deployENV,
+		JobID:  this.ID(),
+		Caller: this.caller,
+		Time:   manifest.Created,
+	})
+	if err != nil {
+		this.logger().Error(err)
+		return err
+	}
+	existed, err := existedBefore(transport, remotePath, this.conf.Naming.collision())
+	if err != nil {
+		this.logger().Error(err)
+		return err
+	}
+	written, err := transport.PutAs(remotePath, bytes.NewReader(encrypted.Bytes()), this.conf.Naming.collision())
+	if err != nil {
+		this.logger().Error(err)
+		return err
+	}
+	this.manifests = append(this.manifests, written)
+	if existed {
+		if this.replacedManifests == nil {
+			this.replacedManifests = make(map[string]bool)
+		}
+		this.replacedManifests[written] = true
+	}
+	return nil
+}
+
+// validate the formats and the template, for Config.Validate
+func (c *ManifestConfig) problems() []string {
+	problems := make([]string, 0)
+	for _, format := range c.Formats {
+		if format != ManifestJSON && format != ManifestCSV {
+			problems = append(problems, fmt.Sprintf("manifest.formats must be json or csv, got %q", format))
+		}
+	}
+	sample := &NameVars{Name: "manifest.json", Env: "pro", JobID: "1", Caller: "cli", Time: time.Now()}
+	if _, err := (&NamingConfig{Template: c.template()}).RemotePath("/", sample); err != nil {
+		problems = append(problems, strings.Replace(err.Error(), "naming.template", "manifest.template", 1))
+	}
+	return problems
+}
@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// decrypts a file of the test sftp server with keyring
+func readTestPGPFile(t *testing.T, keyring openpgp.EntityList, name string) []byte {
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	block, err := armor.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := openpgp.ReadMessage(block.Body, keyring, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(message.UnverifiedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func Test_Manifest(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	files := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("content of " + path.Base(request.URL.Path)))
+	}))
+	defer files.Close()
+	server := newTestSFTPServer(t)
+	conf := getHealthTestConfig(t, server)
+	conf.Download = DownloadConfig{AllowPrivate: true, Timeout: 5}
+	conf.Naming = NamingConfig{Template: "{job_id}/{seq}-{name}.pgp"}
+	conf.Manifest = ManifestConfig{Formats: []string{ManifestJSON, ManifestCSV}}
+
+	keyring := writeTestMasterKey(t, filepath.Join(t.TempDir(), "private.asc"))
+	publicKey := new(bytes.Buffer)
+	writer, _ := armor.Encode(publicKey, openpgp.PublicKeyType, nil)
+	keyring[0].Serialize(writer)
+	writer.Close()
+
+	body := &MultipleBody{
+		Files:  []*ZurichFile{{Name: "a.txt", Url: files.URL + "/a.txt"}, {Name: "b.txt", Url: files.URL + "/b.txt"}},
+		PGPKey: publicKey.String(),
+		ENV:    "dev",
+	}
+	result := RunJob(context.Background(), conf, body, "cli", nil)
+	if !result.Status || len(result.Manifests) != 2 {
+		t.Log(result.Error)
+		t.Fail()
+		return
+	}
+	expected := filepath.Join(conf.Deploy.Development, result.ID+"-manifest.json.pgp")
+	if result.Manifests[0] != expected {
+		t.Errorf("expected %s, got %s", expected, result.Manifests[0])
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(readTestPGPFile(t, keyring, result.Manifests[0]), manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.BatchID != result.ID || manifest.Env != "dev" || len(manifest.Files) != 2 {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+	for i, file := range manifest.Files {
+		received := result.Files[i]
+		if file.Name != received.Name || file.Size != received.Size || file.SHA256 != received.SHA256 ||
+			filepath.Join(conf.Deploy.Development, file.Remote) != received.Remote {
+			t.Errorf("unexpected file %+v, received %+v", file, received)
+		}
+	}
+	if manifest.Files[1].Remote != result.ID+"/2-b.txt.pgp" {
+		t.Errorf("unexpected remote %s", manifest.Files[1].Remote)
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(readTestPGPFile(t, keyring, result.Manifests[1]))).ReadAll()
+	if err != nil || len(records) != 3 || strings.Join(records[2], ",") != strings.Join([]string{result.ID, "b.txt", manifest.Files[1].Remote, "16", manifest.Files[1].SHA256}, ",") {
+		t.Errorf("unexpected csv %v %v", records, err)
+	}
+
+	// the manifest is the last file written
+	manifestInfo, _ := os.Stat(result.Manifests[1])
+	for _, file := range result.Files {
+		if info, err := os.Stat(file.Remote); err != nil || info.ModTime().After(manifestInfo.ModTime()) {
+			t.Errorf("expected %s before the manifest", file.Remote)
+		}
+	}
+
+	if problems := (&ManifestConfig{Formats: []string{"xml"}, Template: "{hash}"}).problems(); len(problems) != 2 {
+		t.Errorf("unexpected problems %v", problems)
+	}
+}
@@ -0,0 +1,202 @@
+package lib
+
+import (
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "pgp_sftp_proxy"
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route and status code.",
+	}, []string{"route", "code"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route"})
+	encryptedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "encrypted_bytes_total",
+		Help:      "Plaintext bytes encrypted with PGP.",
+	})
+	pdfConversions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pdf_conversions_total",
+		Help:      "Image to PDF conversions by result.",
+	}, []string{"result"})
+	downloadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "download_duration_seconds",
+		Help:      "Remote file download latency including retries, by result.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"result"})
+	uploadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sftp_upload_duration_seconds",
+		Help:      "SFTP upload latency by destination.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"destination"})
+	uploadFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sftp_upload_failures_total",
+		Help:      "Failed SFTP uploads by destination.",
+	}, []string{"destination"})
+	uploadRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sftp_upload_retries_total",
+		Help:      "SFTP upload retries after a connection drop, by destination.",
+	}, []string{"destination"})
+	sshConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ssh_connections_total",
+		Help:      "SSH dials (initial connects and reconnects) by destination and result.",
+	}, []string{"destination", "result"})
+	notifyAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "notify_attempts_total",
+		Help:      "Notification attempts by result.",
+	}, []string{"result"})
+	auditFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audit_record_failures_total",
+		Help:      "Audit log entries that could not be written, the deliveries failed with them.",
+	})
+)
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+func observeUpload(destination string, started time.Time, err error) {
+	uploadDuration.WithLabelValues(destination).Observe(time.Since(started).Seconds())
+	if err != nil {
+		uploadFailures.WithLabelValues(destination).Inc()
+	}
+}
+
+// reports the size of the files in tmp_path and the free space of its filesystem on scrape
+type tempDirCollector struct {
+	tempPath  func() string
+	usedDesc  *prometheus.Desc
+	freeDesc  *prometheus.Desc
+	filesDesc *prometheus.Desc
+}
+
+func newTempDirCollector(tempPath func() string) *tempDirCollector {
+	return &tempDirCollector{
+		tempPath:  tempPath,
+		usedDesc:  prometheus.NewDesc(metricsNamespace+"_temp_dir_used_bytes", "Bytes used by files in tmp_path.", nil, nil),
+		freeDesc:  prometheus.NewDesc(metricsNamespace+"_temp_dir_free_bytes", "Free bytes on the tmp_path filesystem.", nil, nil),
+		filesDesc: prometheus.NewDesc(metricsNamespace+"_temp_dir_files", "Files in tmp_path.", nil, nil),
+	}
+}
+
+func (c *tempDirCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.usedDesc
+	ch <- c.freeDesc
+	ch <- c.filesDesc
+}
+
+func (c *tempDirCollector) Collect(ch chan<- prometheus.Metric) {
+	tempPath := c.tempPath()
+	var used, files int64
+	filepath.WalkDir(tempPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			used += info.Size()
+			files++
+		}
+		return nil
+	})
+	ch <- prometheus.MustNewConstMetric(c.usedDesc, prometheus.GaugeValue, float64(used))
+	ch <- prometheus.MustNewConstMetric(c.filesDesc, prometheus.GaugeValue, float64(files))
+
+	if free, err := FreeSpace(tempPath); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.freeDesc, prometheus.GaugeValue, float64(free))
+	}
+}
+
+func (this *HTTPService) metricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		encryptedBytes,
+		pdfConversions,
+		downloadDuration,
+		uploadDuration,
+		uploadFailures,
+		uploadRetries,
+		sshConnections,
+		notifyAttempts,
+		auditFailures,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "job_queue_queued",
+			Help:      "Jobs waiting in the queue.",
+		}, func() float64 {
+			return float64(this.queue.Stats().Queued)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "job_queue_running",
+			Help:      "Jobs currently running.",
+		}, func() float64 {
+			return float64(this.queue.Stats().Running)
+		}),
+		newTempDirCollector(func() string {
+			return this.Config().TempPath
+		}),
+	)
+
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// counts requests by route template, unmatched paths share one label
+func (this *HTTPService) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		started := time.Now()
+		sw := &statusWriter{ResponseWriter: writer, status: http.StatusOK}
+
+		next.ServeHTTP(sw, request)
+
+		route := "unmatched"
+		if current := mux.CurrentRoute(request); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		httpRequests.WithLabelValues(route, strconv.Itoa(sw.status)).Inc()
+		httpDuration.WithLabelValues(route).Observe(time.Since(started).Seconds())
+	})
+}
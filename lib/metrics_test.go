@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_Metrics(t *testing.T) {
+	httpServer := NewHTTP(&Config{TempPath: t.TempDir()})
+	handler := httpServer.getHTTPHandler()
+
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, httptest.NewRequest(http.MethodGet, "/queue", nil))
+
+	writer = httptest.NewRecorder()
+	handler.ServeHTTP(writer, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	resp := writer.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Response code is %v", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+
+	for _, expect := range []string{
+		`pgp_sftp_proxy_http_requests_total{code="200",route="/queue"}`,
+		"pgp_sftp_proxy_job_queue_queued 0",
+		"pgp_sftp_proxy_temp_dir_used_bytes 0",
+		"pgp_sftp_proxy_temp_dir_free_bytes",
+		"pgp_sftp_proxy_audit_record_failures_total",
+	} {
+		if !strings.Contains(string(body), expect) {
+			t.Errorf("metrics missing %s", expect)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultNameTemplate = "{name}.pgp"
+
+// naming.collision
+const (
+	CollisionOverwrite = "overwrite"
+	CollisionFail      = "fail"
+	CollisionSuffix    = "suffix"
+)
+
+// tried names of the suffix policy, name-1 ... name-999
+const maxCollisionSuffix = 999
+
+var ErrRemoteExists = errors.New("remote file exists")
+
+var nameVariable = regexp.MustCompile(`\{([a-z_]+)(?::(\d+))?\}`)
+
+type NamingConfig struct {
+	// remote file name under deploy_path, a "/" makes subfolders, default {name}.pgp
+	Template string `json:"template"`
+	// when the remote file exists: overwrite (default), fail or suffix, which adds -1, -2 ... to the name
+	Collision string `json:"collision"`
+}
+
+// NameVars are the values of the naming template
+type NameVars struct {
+	// file name, with .pdf added to converted images
+	Name string
+	// dev, pro or test
+	Env   string
+	JobID string
+	// position in the batch, from 1
+	Seq int
+	// hex SHA-256 of the received file
+	SHA256 string
+	Caller string
+	Time   time.Time
+}
+
+func (c *NamingConfig) template() string {
+	if len(c.Template) > 0 {
+		return c.Template
+	}
+	return DefaultNameTemplate
+}
+
+func (c *NamingConfig) collision() string {
+	if len(c.Collision) > 0 {
+		return c.Collision
+	}
+	return CollisionOverwrite
+}
+
+// RemotePath renders the template for vars under deployPath
+func (c *NamingConfig) RemotePath(deployPath string, vars *NameVars) (string, error) {
+	var err error
+	name := nameVariable.ReplaceAllStringFunc(c.template(), func(variable string) string {
+		match := nameVariable.FindStringSubmatch(variable)
+		value, e := vars.value(match[1], match[2])
+		if e != nil && err == nil {
+			err = e
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") || len(strings.TrimSpace(name)) <= 0 {
+		return "", fmt.Errorf("naming.template %q gives the invalid name %q", c.template(), name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("naming.template %q gives the invalid name %q", c.template(), name)
+		}
+	}
+	return path.Join(deployPath, name), nil
+}
+
+func (v *NameVars) value(name string, width string) (string, error) {
+	size := 0
+	if len(width) > 0 {
+		size, _ = strconv.Atoi(width)
+	}
+	switch name {
+	case "name":
+		return safeName(v.Name), nil
+	case "base", "ext":
+		ext := path.Ext(v.Name)
+		if name == "ext" {
+			return safeName(ext), nil
+		}
+		return safeName(strings.TrimSuffix(v.Name, ext)), nil
+	case "env":
+		return safeName(v.Env), nil
+	case "job_id":
+		return safeName(v.JobID), nil
+	case "caller":
+		return safeName(v.Caller), nil
+	case "seq":
+		return fmt.Sprintf("%0*d", size, v.Seq), nil
+	case "hash":
+		if len(v.SHA256) <= 0 {
+			return "", errors.New("naming.template: {hash} needs the checksum of the file")
+		}
+		if size <= 0 || size > len(v.SHA256) {
+			size = 8
+		}
+		return v.SHA256[:size], nil
+	case "date":
+		return v.Time.Format("20060102"), nil
+	case "time":
+		return v.Time.Format("150405"), nil
+	case "year":
+		return v.Time.Format("2006"), nil
+	case "month":
+		return v.Time.Format("01"), nil
+	case "day":
+		return v.Time.Format("02"), nil
+	}
+	return "", fmt.Errorf("naming.template: unknown variable {%s}", name)
+}
+
+// the characters the sftp servers, windows ones included, refuse in a file name
+func safeName(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// suffixName adds -n before the extension of the file name, e.g. invoice.pdf.pgp becomes invoice-1.pdf.pgp
+func suffixName(remotePath string, n int) string {
+	dir, file := path.Split(remotePath)
+	pgp := ""
+	if strings.HasSuffix(file, ".pgp") {
+		pgp = ".pgp"
+		file = strings.TrimSuffix(file, pgp)
+	}
+	ext := path.Ext(file)
+	return fmt.Sprintf("%s%s-%d%s%s", dir, strings.TrimSuffix(file, ext), n, ext, pgp)
+}
+
+// validate the template and the collision policy, for Config.Validate
+func (c *NamingConfig) problems() []string {
+	problems := make([]string, 0)
+	sample := &NameVars{Name: "invoice.pdf", Env: "pro", JobID: "1", Seq: 1, SHA256: strings.Repeat("0", 64), Caller: "cli", Time: time.Now()}
+	if _, err := c.RemotePath("/", sample); err != nil {
+		problems = append(problems, err.Error())
+	}
+	switch c.collision() {
+	case CollisionOverwrite, CollisionFail, CollisionSuffix:
+	default:
+		problems = append(problems, fmt.Sprintf("naming.collision must be overwrite, fail or suffix, got %q", c.Collision))
+	}
+	return problems
+}
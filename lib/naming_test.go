@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_RemoteName(t *testing.T) {
+	vars := &NameVars{
+		Name:   "invoice.pdf",
+		Env:    "pro",
+		JobID:  "42",
+		Seq:    7,
+		SHA256: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		Caller: "cli:bob",
+		Time:   time.Date(2024, 3, 9, 14, 5, 6, 0, time.Local),
+	}
+	for template, expected := range map[string]string{
+		"":                                       "/deploy/invoice.pdf.pgp",
+		"{year}/{month}/{day}/{name}.pgp":        "/deploy/2024/03/09/invoice.pdf.pgp",
+		"{env}-{job_id}-{seq:3}-{base}{ext}.pgp": "/deploy/pro-42-007-invoice.pdf.pgp",
+		"{date}_{time}_{hash}_{name}.pgp":        "/deploy/20240309_140506_9f86d081_invoice.pdf.pgp",
+		"{caller}/{hash:4}-{seq}-{name}.pgp":     "/deploy/cli_bob/9f86-7-invoice.pdf.pgp",
+	} {
+		naming := &NamingConfig{Template: template}
+		remotePath, err := naming.RemotePath("/deploy", vars)
+		if err != nil || remotePath != expected {
+			t.Errorf("%q: expected %s, got %s %v", template, expected, remotePath, err)
+		}
+	}
+
+	for template, expected := range map[string]string{
+		"{nam}.pgp":      "unknown variable {nam}",
+		"../{name}.pgp":  "invalid name",
+		"/{name}.pgp":    "invalid name",
+		"{year}//{name}": "invalid name",
+	} {
+		naming := &NamingConfig{Template: template}
+		if _, err := naming.RemotePath("/deploy", vars); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expected %q, got %v", template, expected, err)
+		}
+	}
+	if _, err := (&NamingConfig{Template: "{hash}.pgp"}).RemotePath("/deploy", &NameVars{Name: "a.txt"}); err == nil {
+		t.Errorf("expected an error for {hash} without checksum")
+	}
+	if problems := (&NamingConfig{Template: "{when}", Collision: "rename"}).problems(); len(problems) != 2 {
+		t.Errorf("unexpected problems %v", problems)
+	}
+
+	for name, expected := range map[string]string{
+		"/a/invoice.pdf.pgp": "/a/invoice-2.pdf.pgp",
+		"/a/report.pgp":      "/a/report-2.pgp",
+		"/a/archive.tar.gz":  "/a/archive.tar-2.gz",
+	} {
+		if suffixed := suffixName(name, 2); suffixed != expected {
+			t.Errorf("expected %s, got %s", expected, suffixed)
+		}
+	}
+}
+
+func Test_NamingCollision(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	server := newTestSFTPServer(t)
+	conf := getHealthTestConfig(t, server)
+	conf.Naming = NamingConfig{Template: "{year}/{name}.pgp", Collision: CollisionSuffix}
+	upload := func() (string, error) {
+		return Upload(context.Background(), conf, nil, nil, &UploadRequest{
+			Filename: "invoice.txt",
+			Reader:   strings.NewReader("plain text"),
+			Key:      getTestPGPKey(t),
+			Deploy:   "pro",
+		})
+	}
+
+	first, err := upload()
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	expected := path.Join(conf.Deploy.Production, time.Now().Format("2006"), "invoice.txt.pgp")
+	if first != expected {
+		t.Errorf("expected %s, got %s", expected, first)
+	}
+	second, err := upload()
+	if err != nil || second != path.Join(filepath.Dir(first), "invoice-1.txt.pgp") {
+		t.Errorf("expected a suffixed name, got %s %v", second, err)
+	}
+
+	conf.Naming.Collision = CollisionFail
+	if _, err := upload(); !errors.Is(err, ErrRemoteExists) {
+		t.Errorf("expected ErrRemoteExists, got %v", err)
+	}
+	conf.Naming.Collision = CollisionOverwrite
+	if again, err := upload(); err != nil || again != first {
+		t.Errorf("expected %s to be overwritten, got %s %v", first, again, err)
+	}
+}
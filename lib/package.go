@@ -0,0 +1,264 @@
+package lib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const DefaultPackageTemplate = "{name}.pgp"
+
+// MultipleBody.Package
+const (
+	PackageZip   = "zip"
+	PackageTarGz = "tar.gz"
+)
+
+type PackageConfig struct {
+	// remote file name of the archive under deploy_path like naming.template, {name} is <job_id>.zip
+	// or <job_id>.tar.gz and {hash} the SHA-256 of the archive, default {name}.pgp
+	Template string `json:"template"`
+}
+
+func (c *PackageConfig) template() string {
+	if len(c.Template) > 0 {
+		return c.Template
+	}
+	return DefaultPackageTemplate
+}
+
+// validate the template, for Config.Validate
+func (c *PackageConfig) problems() []string {
+	sample := &NameVars{Name: "1.zip", Env: "pro", JobID: "1", Seq: 1, SHA256: strings.Repeat("0", 64), Caller: "cli", Time: time.Now()}
+	if _, err := (&NamingConfig{Template: c.template()}).RemotePath("/", sample); err != nil {
+		return []string{strings.Replace(err.Error(), "naming.template", "package.template", 1)}
+	}
+	return nil
+}
+
+func validPackage(format string) bool {
+	return format == "" || format == PackageZip || format == PackageTarGz
+}
+
+type archiveWriter interface {
+	add(name string, data []byte, modified time.Time) error
+	Close() error
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (a *zipArchive) add(name string, data []byte, modified time.Time) error {
+	writer, err := a.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	return err
+}
+
+type tarGzArchive struct {
+	*tar.Writer
+	gz *gzip.Writer
+}
+
+func (a *tarGzArchive) add(name string, data []byte, modified time.Time) error {
+	err := a.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modified})
+	if err != nil {
+		return err
+	}
+	_, err = a.Write(data)
+	return err
+}
+
+func (a *tarGzArchive) Close() error {
+	err := a.Writer.Close()
+	if err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+func newArchiveWriter(format string, writer io.Writer) archiveWriter {
+	if format == PackageTarGz {
+		gz := gzip.NewWriter(writer)
+		return &tarGzArchive{Writer: tar.NewWriter(gz), gz: gz}
+	}
+	return &zipArchive{zip.NewWriter(writer)}
+}
+
+// 把所有文件（图片转换为PDF后）打包成一个压缩文件，加密后上传
+func (this *Zurich) UploadPackage() error {
+	this.logger().Info("begin package files:", this.packageFormat)
+	ctx, span := startSpan(this.ctx, "stage.package",
+		attribute.String("package.format", this.packageFormat),
+		attribute.Int("job.files", len(this.Files)))
+
+	archive, checksum, err := this.encryptPackage(ctx)
+	if err != nil {
+		endSpan(span, err)
+		return err
+	}
+
+	remotePath, err := this.packagePath(checksum)
+	if err != nil {
+		this.logger().Error(err)
+		endSpan(span, err)
+		return err
+	}
+	transport := NewTransport(ctx, &this.conf.Transport, &this.conf.SSH)
+	defer transport.Close()
+	archive.remotePath = remotePath
+	existed, err := existedBefore(transport, remotePath, this.conf.Naming.collision())
+	if err != nil {
+		this.logger().Error(err)
+		endSpan(span, err)
+		return err
+	}
+	written, err := UploadFileAs(transport, archive.Path, remotePath, this.conf.Naming.collision())
+	if err != nil {
+		this.logger().Error(err)
+		endSpan(span, err)
+		return err
+	}
+	archive.remotePath = written
+	archive.delivered = true
+	archive.created = !existed
+	endSpan(span, nil)
+	return nil
+}
+
+// remote path of the archive, checksum is the SHA-256 of the archive before the encryption
+func (this *Zurich) packagePath(checksum string) (string, error) {
+	naming := &NamingConfig{Template: this.conf.Package.template()}
+	return naming.RemotePath(this.conf.GetDeployPath(this.deployENV), &NameVars{
+		Name:   this.ID() + "." + this.packageFormat,
+		Env:    this.deployENV,
+		JobID:  this.ID(),
+		Seq:    1,
+		SHA256: checksum,
+		Caller: this.caller,
+		Time:   time.Now(),
+	})
+}
+
+// encryptPackage streams the archive of all files through PGPHelper into one local file,
+// which stands for every file of the batch in pgpFiles. Returns it and the SHA-256 of the archive.
+func (this *Zurich) encryptPackage(ctx context.Context) (*ZurichFile, string, error) {
+	helper, err := NewPGPHelper(strings.NewReader(this.pgpKey))
+	if err != nil {
+		return nil, "", err
+	}
+	archive := &ZurichFile{
+		Path: this.encryptedPath(this.ID() + "." + this.packageFormat + ".pgp"),
+	}
+	err = os.MkdirAll(filepath.Dir(archive.Path), os.ModePerm)
+	if err != nil {
+		this.logger().Error(err)
+		return nil, "", err
+	}
+	file, err := os.Create(archive.Path)
+	if err != nil {
+		this.logger().Error(err)
+		return nil, "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	reader, writer := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := this.writeArchive(ctx, io.MultiWriter(writer, hash))
+		writer.CloseWithError(err)
+		written <- err
+	}()
+	err = helper.WithContext(ctx).EncryptTo(file, reader)
+	// stops the archive when the encryption failed
+	reader.CloseWithError(io.ErrClosedPipe)
+	if archiveErr := <-written; archiveErr != nil {
+		err = archiveErr
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		this.logger().Error(err)
+		return nil, "", fmt.Errorf("package: %w", err)
+	}
+	archive.received, err = ChecksumFile(filepath.Base(archive.Path), archive.Path)
+	if err != nil {
+		this.logger().Error(err)
+		return nil, "", err
+	}
+	for index := range this.pgpFiles {
+		this.pgpFiles[index] = archive
+	}
+	return archive, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeArchive writes the files and the manifests, json and the formats of manifest.formats
+func (this *Zurich) writeArchive(ctx context.Context, writer io.Writer) error {
+	formats := []string{ManifestJSON}
+	for _, format := range this.conf.Manifest.Formats {
+		if format != ManifestJSON {
+			formats = append(formats, format)
+		}
+	}
+	names := make(map[string]bool)
+	for _, format := range formats {
+		names["manifest."+format] = true
+	}
+
+	created := time.Now()
+	manifest := &Manifest{
+		BatchID: this.ID(),
+		Env:     this.deployENV,
+		Created: created,
+		Files:   make([]*ManifestFile, 0, len(this.Files)),
+	}
+	archive := newArchiveWriter(this.packageFormat, writer)
+	for _, zFile := range this.Files {
+		data, err := this.readFile(ctx, zFile)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(zFile.Path)
+		for n := 1; names[name]; n++ {
+			name = suffixName(filepath.Base(zFile.Path), n)
+		}
+		names[name] = true
+		err = archive.add(name, data, created)
+		if err != nil {
+			return err
+		}
+		file := &ManifestFile{Name: zFile.Name, Remote: name}
+		if zFile.received != nil {
+			file.Size = zFile.received.Size
+			file.SHA256 = zFile.received.SHA256
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+	for _, format := range formats {
+		data, err := manifest.Encode(format)
+		if err != nil {
+			return err
+		}
+		err = archive.add("manifest."+format, data, created)
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
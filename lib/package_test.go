@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// the entries of a zip or tar.gz archive
+func readTestArchive(t *testing.T, format string, data []byte) map[string]string {
+	entries := make(map[string]string)
+	if format == PackageZip {
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range archive.File {
+			reader, err := file.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := ioutil.ReadAll(reader)
+			reader.Close()
+			entries[file.Name] = string(content)
+		}
+		return entries
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(archive)
+		entries[header.Name] = string(content)
+	}
+}
+
+func Test_Package(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	files := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("content of " + path.Base(request.URL.Path)))
+	}))
+	defer files.Close()
+	server := newTestSFTPServer(t)
+	conf := getHealthTestConfig(t, server)
+	conf.Download = DownloadConfig{AllowPrivate: true, Timeout: 5}
+	conf.Manifest = ManifestConfig{Formats: []string{ManifestCSV}}
+	conf.Package = PackageConfig{Template: "{env}/{name}-{hash:6}.pgp"}
+
+	keyring := writeTestMasterKey(t, filepath.Join(t.TempDir(), "private.asc"))
+	publicKey := new(bytes.Buffer)
+	writer, _ := armor.Encode(publicKey, openpgp.PublicKeyType, nil)
+	keyring[0].Serialize(writer)
+	writer.Close()
+
+	for _, format := range []string{PackageZip, PackageTarGz} {
+		body := &MultipleBody{
+			Files:   []*ZurichFile{{Name: "a.txt", Url: files.URL + "/a.txt"}, {Name: "b.txt", Url: files.URL + "/b.txt"}},
+			PGPKey:  publicKey.String(),
+			ENV:     "test",
+			Package: format,
+		}
+		if err := body.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		result := RunJob(context.Background(), conf, body, "cli", nil)
+		if !result.Status || len(result.Files) != 2 || len(result.Manifests) != 0 {
+			t.Log(format, result.Error)
+			t.Fail()
+			return
+		}
+		remote := result.Files[0].Remote
+		if filepath.Dir(remote) != filepath.Join(conf.Deploy.Testing, "test") || result.Files[1].Remote != remote {
+			t.Errorf("%s: expected one archive for both files, got %s and %s", format, remote, result.Files[1].Remote)
+		}
+
+		data := readTestPGPFile(t, keyring, remote)
+		entries := readTestArchive(t, format, data)
+		if len(entries) != 4 || entries["a.txt"] != "content of a.txt" || entries["b.txt"] != "content of b.txt" {
+			t.Errorf("%s: unexpected entries %v", format, entries)
+		}
+		manifest := &Manifest{}
+		if err := json.Unmarshal([]byte(entries["manifest.json"]), manifest); err != nil || manifest.BatchID != result.ID || len(manifest.Files) != 2 {
+			t.Errorf("%s: unexpected manifest %+v %v", format, manifest, err)
+		} else if manifest.Files[1].Remote != "b.txt" || manifest.Files[1].SHA256 != result.Files[1].SHA256 {
+			t.Errorf("%s: unexpected manifest file %+v", format, manifest.Files[1])
+		}
+		if len(entries["manifest.csv"]) <= 0 {
+			t.Errorf("%s: expected the csv manifest", format)
+		}
+	}
+
+	if err := (&MultipleBody{Files: []*ZurichFile{{Name: "a.txt"}}, PGPKey: "key", ENV: "dev", Package: "rar"}).Validate(); err == nil {
+		t.Errorf("expected an error for an unknown package format")
+	}
+	if problems := (&PackageConfig{Template: "{file}"}).problems(); len(problems) != 1 {
+		t.Errorf("unexpected problems %v", problems)
+	}
+}
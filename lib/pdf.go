@@ -17,7 +17,10 @@ import (
 	"github.com/signintech/gopdf"
 )
 
-func GetPDF(imagePath string) ([]byte, error) {
+func GetPDF(imagePath string) (_ []byte, err error) {
+	defer func() {
+		pdfConversions.WithLabelValues(resultLabel(err)).Inc()
+	}()
 	imgFile, err := os.Open(imagePath)
 	if err != nil {
 		log.Error(err)
@@ -51,7 +54,10 @@ func GetPDF(imagePath string) ([]byte, error) {
 	return pdf.GetBytesPdf(), nil
 }
 
-func getPDFBytes(imageFile io.Reader, tmpDir string) (io.Reader, error) {
+func getPDFBytes(imageFile io.Reader, tmpDir string) (_ io.Reader, err error) {
+	defer func() {
+		pdfConversions.WithLabelValues(resultLabel(err)).Inc()
+	}()
 	tempFileName := fmt.Sprintf("%d", rand.Int())
 	tempDir := filepath.Join(tmpDir, tempFileName)
 	if _, err := os.Stat(tempDir); err != nil && os.IsNotExist(err) {
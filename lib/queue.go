@@ -0,0 +1,255 @@
+package lib
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultQueueMaxQueued  = 100
+	DefaultQueueMaxRunning = 4
+	DefaultQueueRetryAfter = 30
+)
+
+var (
+	ErrQueueFull      = errors.New("job queue is full")
+	ErrQueueDiskSpace = errors.New("not enough free space in tmp_path")
+	ErrQueueClosed    = errors.New("job queue is closed, the service is shutting down")
+)
+
+type QueueConfig struct {
+	// jobs waiting to run, default 100
+	MaxQueued int `json:"max_queued"`
+	// jobs running at the same time, default 4
+	MaxRunning int `json:"max_running"`
+	// higher runs first, default: pro 2, dev 1, test 0
+	Priority map[string]int `json:"priority"`
+	// seconds suggested to clients in Retry-After, default 30
+	RetryAfter int `json:"retry_after"`
+	// bytes, reject new jobs when tmp_path has less free space, 0 disables the check
+	MinFreeSpace int64 `json:"min_free_space"`
+}
+
+func (c *QueueConfig) maxQueued() int {
+	if c.MaxQueued > 0 {
+		return c.MaxQueued
+	}
+	return DefaultQueueMaxQueued
+}
+
+func (c *QueueConfig) maxRunning() int {
+	if c.MaxRunning > 0 {
+		return c.MaxRunning
+	}
+	return DefaultQueueMaxRunning
+}
+
+func (c *QueueConfig) retryAfter() int {
+	if c.RetryAfter > 0 {
+		return c.RetryAfter
+	}
+	return DefaultQueueRetryAfter
+}
+
+func (c *QueueConfig) priority(env string) int {
+	if c.Priority != nil {
+		return c.Priority[env]
+	}
+	switch env {
+	case "pro":
+		return 2
+	case "dev":
+		return 1
+	}
+	return 0
+}
+
+type QueueTask interface {
+	ID() string
+	Process()
+}
+
+type queuedJob struct {
+	task     QueueTask
+	priority int
+	seq      uint64
+	queued   time.Time
+}
+
+// higher priority first, FIFO within the same priority
+type jobHeap []*queuedJob
+
+func (h jobHeap) Len() int { return len(h) }
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h jobHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *jobHeap) Push(x interface{}) { *h = append(*h, x.(*queuedJob)) }
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// swagger:model
+type QueueStats struct {
+	Queued     int         `json:"queued"`
+	Running    int         `json:"running"`
+	MaxQueued  int         `json:"max_queued"`
+	MaxRunning int         `json:"max_running"`
+	ByPriority map[int]int `json:"queued_by_priority"`
+}
+
+type JobQueue struct {
+	conf     *QueueConfig
+	tempPath string
+	mu       sync.Mutex
+	pending  jobHeap
+	running  map[*queuedJob]bool
+	seq      uint64
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func NewJobQueue(conf *QueueConfig, tempPath string) *JobQueue {
+	return &JobQueue{
+		conf:     conf,
+		tempPath: tempPath,
+		running:  make(map[*queuedJob]bool),
+	}
+}
+
+// Submit queues the task or rejects it when the queue is full or tmp_path is low on disk
+func (q *JobQueue) Submit(task QueueTask, env string) error {
+	if q.conf.MinFreeSpace > 0 {
+		free, err := FreeSpace(q.tempPath)
+		if err != nil {
+			log.Error(err)
+		} else if free < q.conf.MinFreeSpace {
+			return ErrQueueDiskSpace
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if q.pending.Len() >= q.conf.maxQueued() {
+		return ErrQueueFull
+	}
+	q.seq++
+	heap.Push(&q.pending, &queuedJob{
+		task:     task,
+		priority: q.conf.priority(env),
+		seq:      q.seq,
+		queued:   time.Now(),
+	})
+	log.Infof("job %s queued, %d waiting", task.ID(), q.pending.Len())
+	q.dispatch()
+
+	return nil
+}
+
+// must be called with q.mu held
+func (q *JobQueue) dispatch() {
+	for !q.closed && len(q.running) < q.conf.maxRunning() && q.pending.Len() > 0 {
+		job := heap.Pop(&q.pending).(*queuedJob)
+		q.running[job] = true
+		q.wg.Add(1)
+		go q.run(job)
+	}
+}
+
+func (q *JobQueue) run(job *queuedJob) {
+	log.Infof("job %s started after %s in queue", job.task.ID(), time.Since(job.queued))
+
+	job.task.Process()
+
+	q.mu.Lock()
+	delete(q.running, job)
+	q.dispatch()
+	q.mu.Unlock()
+	q.wg.Done()
+}
+
+// Close rejects new jobs and returns the ones that have not started, in the order they would have run
+func (q *JobQueue) Close() []QueueTask {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	tasks := make([]QueueTask, 0, q.pending.Len())
+	for q.pending.Len() > 0 {
+		tasks = append(tasks, heap.Pop(&q.pending).(*queuedJob).task)
+	}
+	return tasks
+}
+
+// Wait blocks until the running jobs finish or ctx is done
+func (q *JobQueue) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Running returns the jobs still processing
+func (q *JobQueue) Running() []QueueTask {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]*queuedJob, 0, len(q.running))
+	for job := range q.running {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].seq < jobs[j].seq
+	})
+	tasks := make([]QueueTask, 0, len(jobs))
+	for _, job := range jobs {
+		tasks = append(tasks, job.task)
+	}
+	return tasks
+}
+
+// RetryAfter in seconds for rejected submissions
+func (q *JobQueue) RetryAfter() int {
+	return q.conf.retryAfter()
+}
+
+func (q *JobQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	byPriority := make(map[int]int)
+	for _, job := range q.pending {
+		byPriority[job.priority]++
+	}
+
+	return QueueStats{
+		Queued:     q.pending.Len(),
+		Running:    len(q.running),
+		MaxQueued:  q.conf.maxQueued(),
+		MaxRunning: q.conf.maxRunning(),
+		ByPriority: byPriority,
+	}
+}
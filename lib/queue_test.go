@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type blockingTask struct {
+	id      string
+	release chan struct{}
+	started chan string
+}
+
+func (b *blockingTask) ID() string {
+	return b.id
+}
+
+func (b *blockingTask) Process() {
+	b.started <- b.id
+	<-b.release
+}
+
+func newBlockingTask(id string, release chan struct{}, started chan string) *blockingTask {
+	return &blockingTask{id: id, release: release, started: started}
+}
+
+func Test_QueuePriority(t *testing.T) {
+	queue := NewJobQueue(&QueueConfig{MaxRunning: 1, MaxQueued: 10}, t.TempDir())
+	release := make(chan struct{})
+	started := make(chan string, 10)
+
+	queue.Submit(newBlockingTask("first", release, started), "dev")
+	if got := <-started; got != "first" {
+		t.Errorf("unexpected start %s", got)
+	}
+	queue.Submit(newBlockingTask("test-1", release, started), "test")
+	queue.Submit(newBlockingTask("test-2", release, started), "test")
+	queue.Submit(newBlockingTask("pro", release, started), "pro")
+
+	stats := queue.Stats()
+	if stats.Queued != 3 || stats.Running != 1 || stats.ByPriority[0] != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	for _, expect := range []string{"pro", "test-1", "test-2"} {
+		release <- struct{}{}
+		select {
+		case got := <-started:
+			if got != expect {
+				t.Errorf("expected %s, got %s", expect, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not started", expect)
+		}
+	}
+	close(release)
+}
+
+func Test_QueueFull(t *testing.T) {
+	queue := NewJobQueue(&QueueConfig{MaxRunning: 1, MaxQueued: 2}, t.TempDir())
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan string, 10)
+
+	for i := 0; i < 3; i++ {
+		err := queue.Submit(newBlockingTask(fmt.Sprint(i), release, started), "pro")
+		if err != nil {
+			t.Log(err)
+			t.Fail()
+			return
+		}
+	}
+	err := queue.Submit(newBlockingTask("overflow", release, started), "pro")
+	if !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected queue full, got %v", err)
+	}
+}
+
+func Test_MultipleQueueFull(t *testing.T) {
+	httpServer := NewHTTP(&Config{
+		TempPath: t.TempDir(),
+		Queue:    QueueConfig{MaxRunning: 1, MaxQueued: 1, RetryAfter: 12},
+	})
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan string, 10)
+	httpServer.queue.Submit(newBlockingTask("running", release, started), "pro")
+	httpServer.queue.Submit(newBlockingTask("queued", release, started), "pro")
+
+	body := `{"files":[{"name":"a.pdf","url":"https://example.com/a.pdf"}],"key":"key","env":"test"}`
+	req := httptest.NewRequest(http.MethodPost, "/multiple/upload", strings.NewReader(body))
+	writer := httptest.NewRecorder()
+
+	httpServer.Multiple(writer, req)
+
+	resp := writer.Result()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Response code is %v", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") != "12" {
+		t.Errorf("unexpected Retry-After %q", resp.Header.Get("Retry-After"))
+	}
+}
+
+func Test_QueueClose(t *testing.T) {
+	queue := NewJobQueue(&QueueConfig{MaxRunning: 1, MaxQueued: 10}, t.TempDir())
+	release := make(chan struct{})
+	started := make(chan string, 10)
+
+	queue.Submit(newBlockingTask("running", release, started), "dev")
+	<-started
+	queue.Submit(newBlockingTask("test", release, started), "test")
+	queue.Submit(newBlockingTask("pro", release, started), "pro")
+
+	pending := queue.Close()
+	if len(pending) != 2 || pending[0].ID() != "pro" || pending[1].ID() != "test" {
+		t.Errorf("unexpected pending %v", pending)
+	}
+	err := queue.Submit(newBlockingTask("late", release, started), "pro")
+	if !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("expected queue closed, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := queue.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline, got %v", err)
+	}
+	if running := queue.Running(); len(running) != 1 || running[0].ID() != "running" {
+		t.Errorf("unexpected running %v", running)
+	}
+
+	close(release)
+	if err := queue.Wait(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if len(queue.Running()) != 0 || len(started) != 0 {
+		t.Errorf("closed queue must not start pending jobs")
+	}
+}
@@ -0,0 +1,295 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultReloadWatchInterval = 5
+	redactedValue              = "******"
+)
+
+var ErrAdminForbidden = errors.New("admin endpoint forbidden")
+
+type ReloadConfig struct {
+	// seconds between checks of the config file for changes, default 5, -1 disables the watch
+	WatchInterval int `json:"watch_interval"`
+}
+
+func (c *ReloadConfig) watchInterval() time.Duration {
+	if c.WatchInterval > 0 {
+		return time.Duration(c.WatchInterval) * time.Second
+	}
+	return DefaultReloadWatchInterval * time.Second
+}
+
+type AdminConfig struct {
+	// bearer token for /admin/*, without one only loopback callers are allowed
+	Token string `json:"token" secret:"true"`
+	// file holding the token
+	TokenFile string `json:"token_file,omitempty"`
+}
+
+// swagger:model
+type ConfigVersion struct {
+	Version int64     `json:"version"`
+	Loaded  time.Time `json:"loaded"`
+	// sha256 over the config files
+	Checksum string   `json:"checksum"`
+	Paths    []string `json:"paths"`
+	// active config, secrets redacted
+	Config *Config `json:"config,omitempty"`
+}
+
+type configState struct {
+	config  *Config
+	version ConfigVersion
+}
+
+func newConfigState(conf *Config, version int64) *configState {
+	checksum, _ := filesChecksum(conf.Paths())
+	return &configState{
+		config: conf,
+		version: ConfigVersion{
+			Version:  version,
+			Loaded:   time.Now(),
+			Checksum: checksum,
+			Paths:    conf.Paths(),
+		},
+	}
+}
+
+func filesChecksum(paths []string) (string, error) {
+	if len(paths) <= 0 {
+		return "", nil
+	}
+	hash := sha256.New()
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(data)
+		hash.Write(sum[:])
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Config is the active config, requests and jobs keep the one they started with
+func (this *HTTPService) Config() *Config {
+	return this.state.Load().config
+}
+
+// ConfigVersion of the active config, with the secrets redacted
+func (this *HTTPService) ConfigVersion() (*ConfigVersion, error) {
+	state := this.state.Load()
+	redacted, err := RedactConfig(state.config)
+	if err != nil {
+		return nil, err
+	}
+	version := state.version
+	version.Config = redacted
+	return &version, nil
+}
+
+// Reload reads the config files again and swaps it in when it is valid, otherwise the active config stays
+func (this *HTTPService) Reload() (*ConfigVersion, error) {
+	this.reloadMu.Lock()
+	defer this.reloadMu.Unlock()
+
+	current := this.state.Load()
+	err, conf := NewConfig(current.config.Paths()...)
+	if err != nil {
+		return nil, err
+	}
+	err = conf.Validate()
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	err = SetupLog(&conf.Log)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if changed := restartRequired(current.config, conf); len(changed) > 0 {
+		log.Warningf("config reloaded, changes to %s take effect after a restart", strings.Join(changed, ", "))
+	}
+
+	next := newConfigState(conf, current.version.Version+1)
+	this.state.Store(next)
+	log.Infof("config version %d loaded from %s", next.version.Version, strings.Join(next.version.Paths, ", "))
+
+	return this.ConfigVersion()
+}
+
+// settings bound to long-lived components when the service starts
+func restartRequired(old *Config, conf *Config) []string {
+	fields := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"listen", old.Listen, conf.Listen},
+		{"web_root", old.WebRoot, conf.WebRoot},
+		{"concurrency", old.Concurrency, conf.Concurrency},
+		{"queue", old.Queue, conf.Queue},
+		{"audit", old.Audit, conf.Audit},
+		{"tracing", old.Tracing, conf.Tracing},
+		{"shutdown", old.Shutdown, conf.Shutdown},
+		{"reload", old.Reload, conf.Reload},
+		{"watch", old.Watch, conf.Watch},
+	}
+	changed := make([]string, 0)
+	for _, field := range fields {
+		if !reflect.DeepEqual(field.old, field.new) {
+			changed = append(changed, field.name)
+		}
+	}
+	return changed
+}
+
+// WatchConfig reloads when the content of one of the config files changes, until ctx is done
+func (this *HTTPService) WatchConfig(ctx context.Context) {
+	state := this.state.Load()
+	if state.config.Reload.WatchInterval < 0 || len(state.version.Paths) <= 0 {
+		return
+	}
+	ticker := time.NewTicker(state.config.Reload.watchInterval())
+	defer ticker.Stop()
+
+	// an invalid file is reported once, not on every tick
+	seen := state.version.Checksum
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		checksum, err := filesChecksum(state.version.Paths)
+		if err != nil || checksum == seen {
+			continue
+		}
+		seen = checksum
+		log.Infof("config %s changed, reloading", strings.Join(state.version.Paths, ", "))
+		this.Reload()
+	}
+}
+
+// RedactConfig returns a copy of c with the values of fields tagged secret:"true" replaced
+func RedactConfig(c *Config) (*Config, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	redacted := &Config{}
+	err = json.Unmarshal(data, redacted)
+	if err != nil {
+		return nil, err
+	}
+	redactValue(reflect.ValueOf(redacted).Elem())
+	return redacted, nil
+}
+
+func redactValue(value reflect.Value) {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() {
+			redactValue(value.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if field.Tag.Get("secret") == "true" {
+				redactSecret(value.Field(i))
+				continue
+			}
+			redactValue(value.Field(i))
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			redactValue(value.Index(i))
+		}
+	}
+}
+
+func redactSecret(value reflect.Value) {
+	switch value.Kind() {
+	case reflect.String:
+		if value.Len() > 0 {
+			value.SetString(redactedValue)
+		}
+	case reflect.Map:
+		for _, key := range value.MapKeys() {
+			if value.Type().Elem().Kind() == reflect.String {
+				value.SetMapIndex(key, reflect.ValueOf(redactedValue).Convert(value.Type().Elem()))
+			}
+		}
+	default:
+		value.Set(reflect.Zero(value.Type()))
+	}
+}
+
+// requires the admin token, or a loopback caller when none is configured
+func (this *HTTPService) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token := this.Config().Admin.Token
+		if len(token) > 0 {
+			given := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				this.ResponseErrorStatus(ErrAdminForbidden, writer, http.StatusUnauthorized)
+				return
+			}
+		} else if !isLoopback(request.RemoteAddr) {
+			this.ResponseErrorStatus(ErrAdminForbidden, writer, http.StatusForbidden)
+			return
+		}
+		next(writer, request)
+	}
+}
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (this *HTTPService) AdminConfig(writer http.ResponseWriter, request *http.Request) {
+	version, err := this.ConfigVersion()
+	if err != nil {
+		Logger(request.Context()).Error(err)
+		this.ResponseErrorStatus(err, writer, 500)
+		return
+	}
+	this.ResponseStatus(version, writer, 200)
+}
+
+func (this *HTTPService) AdminReload(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		this.ResponseErrorStatus(errors.New("method not allowed"), writer, http.StatusMethodNotAllowed)
+		return
+	}
+	version, err := this.Reload()
+	if err != nil {
+		Logger(request.Context()).Error(err)
+		this.ResponseErrorStatus(err, writer, 400)
+		return
+	}
+	this.ResponseStatus(version, writer, 200)
+}
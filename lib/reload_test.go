@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, path string, deploy string, password string) {
+	conf := &Config{
+		Listen:   "127.0.0.1:3333",
+		TempPath: t.TempDir(),
+		SSH: SSHItem{
+			Host:     "sftp.example.com:22",
+			Username: "tester",
+			Password: password,
+		},
+		Deploy: DeployPath{
+			Development: deploy,
+			Production:  deploy,
+			Testing:     deploy,
+		},
+		Reload: ReloadConfig{WatchInterval: 1},
+	}
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getReloadTestServer(t *testing.T) (*HTTPService, string) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeTestConfig(t, path, "/upload/v1", "first-secret")
+	err, conf := NewConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewHTTP(conf), path
+}
+
+func Test_Reload(t *testing.T) {
+	httpServer, path := getReloadTestServer(t)
+	old := httpServer.Config()
+
+	writeTestConfig(t, path, "/upload/v2", "second-secret")
+	version, err := httpServer.Reload()
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	if version.Version != 2 || httpServer.Config().GetDeployPath("dev") != "/upload/v2" {
+		t.Errorf("unexpected config after reload %+v", version)
+	}
+	// jobs holding the old config keep it
+	if old.GetDeployPath("dev") != "/upload/v1" || old.SSH.Password != "first-secret" {
+		t.Errorf("old config was modified")
+	}
+
+	// an invalid file leaves the active config in place
+	writeTestConfig(t, path, "", "third-secret")
+	_, err = httpServer.Reload()
+	if err == nil {
+		t.Errorf("expected validation error")
+	}
+	active, _ := httpServer.ConfigVersion()
+	if active.Version != 2 || httpServer.Config().SSH.Password != "second-secret" {
+		t.Errorf("invalid config must not be swapped in, version %d", active.Version)
+	}
+}
+
+func Test_RedactConfig(t *testing.T) {
+	conf := &Config{
+		SSH:     SSHItem{Host: "sftp.example.com:22", Password: "secret"},
+		Tracing: TracingConfig{Headers: map[string]string{"api-key": "secret"}},
+		Admin:   AdminConfig{Token: "secret"},
+	}
+	redacted, err := RedactConfig(conf)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	if redacted.SSH.Password != redactedValue || redacted.Tracing.Headers["api-key"] != redactedValue ||
+		redacted.Admin.Token != redactedValue || redacted.SSH.Host != conf.SSH.Host {
+		t.Errorf("unexpected redacted config %+v", redacted)
+	}
+	if conf.SSH.Password != "secret" || conf.Tracing.Headers["api-key"] != "secret" {
+		t.Errorf("original config was modified")
+	}
+}
+
+func Test_AdminConfig(t *testing.T) {
+	httpServer, _ := getReloadTestServer(t)
+	handler := httpServer.getHTTPHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/config", nil)
+	req.RemoteAddr = "127.0.0.1:5000"
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	body := writer.Body.String()
+	if writer.Code != 200 || strings.Contains(body, "first-secret") || !strings.Contains(body, redactedValue) {
+		t.Errorf("unexpected response %d %s", writer.Code, body)
+	}
+
+	// remote callers need the token
+	req = httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+	writer = httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	if writer.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", writer.Code)
+	}
+
+	httpServer.Config().Admin.Token = "admin-token"
+	req = httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+	req.RemoteAddr = "127.0.0.1:5000"
+	writer = httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	if writer.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", writer.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+	req.Header.Set("Authorization", "Bearer admin-token")
+	writer = httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	version := &ConfigVersion{}
+	json.NewDecoder(writer.Body).Decode(version)
+	if writer.Code != 200 || version.Version != 2 {
+		t.Errorf("unexpected reload response %d %+v", writer.Code, version)
+	}
+}
+
+func Test_WatchConfig(t *testing.T) {
+	httpServer, path := getReloadTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go httpServer.WatchConfig(ctx)
+
+	writeTestConfig(t, path, "/upload/watched", "first-secret")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if httpServer.Config().GetDeployPath("dev") == "/upload/watched" {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("config change was not picked up")
+}
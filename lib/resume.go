@@ -0,0 +1,270 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	DefaultSSHRetries    = 3
+	DefaultSSHRetryDelay = 1
+)
+
+func (c *SSHItem) retries() int {
+	if c.Retries < 0 {
+		return 0
+	}
+	if c.Retries == 0 {
+		return DefaultSSHRetries
+	}
+	return c.Retries
+}
+
+func (c *SSHItem) retryDelay() time.Duration {
+	if c.RetryDelay > 0 {
+		return time.Duration(c.RetryDelay) * time.Second
+	}
+	return DefaultSSHRetryDelay * time.Second
+}
+
+// putResumable writes reader to remotePath, or the name the collision policy picks. After a connection drop
+// it dials again and, when reader can seek, continues the remote partial file an earlier attempt created once
+// the SHA-256 of its content matches the start of reader. Returns the remote path written.
+func (c *SSHClient) putResumable(remotePath string, reader io.Reader, collision string, span trace.Span) (string, error) {
+	retries := c.config.retries()
+	if _, ok := reader.(io.ReadSeeker); !ok {
+		// a plain reader cannot be sent again
+		retries = 0
+	}
+	delay := c.config.retryDelay()
+	// remotePath was created by an attempt before, a file of someone else is never continued or truncated
+	created := false
+	for attempt := 0; ; attempt++ {
+		span.SetAttributes(attribute.Int("sftp.attempts", attempt+1))
+		var written string
+		var offset int64
+		client, err := c.getClient()
+		if err == nil {
+			written, offset, err = c.put(client, remotePath, reader, created, collision)
+		}
+		if len(written) > 0 {
+			// the retries continue the file the collision policy picked
+			remotePath = written
+			created = true
+		}
+		if err == nil {
+			if offset > 0 {
+				span.SetAttributes(attribute.Int64("sftp.resume_offset", offset))
+			}
+			return remotePath, nil
+		}
+		if attempt >= retries || !c.dropped(client, err) {
+			c.logger().Error(err)
+			return "", err
+		}
+		uploadRetries.WithLabelValues(c.config.Host).Inc()
+		c.logger().Warningf("upload %s failed (attempt %d/%d), retry in %s: %s", remotePath, attempt+1, retries+1, delay, err)
+		// the next attempt dials again
+		c.invalidate(client)
+		select {
+		case <-c.ctx.Done():
+			return "", c.ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// put is one attempt, it continues the partial file when created tells an attempt before created remotePath,
+// otherwise it creates remotePath with the collision policy. Returns the remote path once it is created,
+// and where it continued.
+func (c *SSHClient) put(client *ssh.Client, remotePath string, reader io.Reader, created bool, collision string) (string, int64, error) {
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return "", 0, err
+	}
+	defer sftpClient.Close()
+
+	remotePath = filepath.ToSlash(remotePath)
+	remoteDir := filepath.ToSlash(filepath.Dir(remotePath))
+	if _, err := sftpClient.Stat(remoteDir); err != nil {
+		err = sftpClient.MkdirAll(remoteDir)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	c.logger().Debug(remotePath)
+
+	var remoteFile *sftp.File
+	var offset int64
+	if created {
+		remoteFile, offset, err = c.resumeFile(client, sftpClient, remotePath, reader.(io.ReadSeeker))
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	if remoteFile == nil && (created || collision == CollisionOverwrite) {
+		remoteFile, err = sftpClient.Create(remotePath)
+	} else if remoteFile == nil {
+		remoteFile, remotePath, err = createNew(sftpClient, remotePath, collision)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	_, err = io.Copy(remoteFile, reader)
+	if err != nil {
+		remoteFile.Close()
+		return remotePath, offset, err
+	}
+	return remotePath, offset, remoteFile.Close()
+}
+
+// createNew creates remotePath only when it does not exist, with the suffix policy the first free name-n
+func createNew(sftpClient *sftp.Client, remotePath string, collision string) (*sftp.File, string, error) {
+	name := remotePath
+	for n := 1; ; n++ {
+		// checked before, the exclusive create catches the uploads racing for the name
+		_, err := sftpClient.Stat(name)
+		if err != nil {
+			var file *sftp.File
+			file, err = sftpClient.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+			if err == nil {
+				return file, name, nil
+			}
+			if _, statErr := sftpClient.Stat(name); statErr != nil {
+				return nil, "", err
+			}
+		}
+		if collision != CollisionSuffix || n > maxCollisionSuffix {
+			return nil, "", fmt.Errorf("%w: %s", ErrRemoteExists, name)
+		}
+		name = suffixName(remotePath, n)
+	}
+}
+
+// resumeFile opens the partial remotePath at its end and moves reader there, when the partial file
+// is the start of reader. Returns no file when the upload starts over, reader is then at its start.
+func (c *SSHClient) resumeFile(client *ssh.Client, sftpClient *sftp.Client, remotePath string, reader io.ReadSeeker) (*sftp.File, int64, error) {
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = reader.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := sftpClient.Stat(remotePath)
+	if err != nil || info.Size() <= 0 || info.Size() > size {
+		return nil, 0, nil
+	}
+	offset := info.Size()
+
+	remoteHash, err := hashPrefix(sftpClient, remotePath, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	localHash := sha256.New()
+	_, err = io.CopyN(localHash, reader, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(remoteHash, localHash.Sum(nil)) {
+		c.logger().Warningf("the partial file %s differs from the upload, starting over", remotePath)
+		_, err = reader.Seek(0, io.SeekStart)
+		return nil, 0, err
+	}
+
+	remoteFile, err := sftpClient.OpenFile(remotePath, os.O_WRONLY)
+	if err != nil {
+		if c.dropped(client, err) {
+			return nil, 0, err
+		}
+		// the server does not allow writing into an existing file
+		c.logger().Warningf("cannot continue the partial file %s, starting over: %s", remotePath, err)
+		_, err = reader.Seek(0, io.SeekStart)
+		return nil, 0, err
+	}
+	_, err = remoteFile.Seek(offset, io.SeekStart)
+	if err != nil {
+		// writing at 0 would overwrite the verified start
+		remoteFile.Close()
+		c.logger().Warningf("cannot continue the partial file %s at %d, starting over: %s", remotePath, offset, err)
+		_, err = reader.Seek(0, io.SeekStart)
+		return nil, 0, err
+	}
+	c.logger().Infof("continuing %s at %d of %d bytes", remotePath, offset, size)
+	return remoteFile, offset, nil
+}
+
+// hashPrefix returns the SHA-256 of the first n bytes of the remote file
+func hashPrefix(sftpClient *sftp.Client, remotePath string, n int64) ([]byte, error) {
+	file, err := sftpClient.Open(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.CopyN(hash, file, n)
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// dropped tells whether err comes from a lost connection, which is retried, and not from a refusal of the server.
+// sftp wraps the connection errors as text, so client, the connection of the upload, is asked for a keepalive.
+func (c *SSHClient) dropped(client *ssh.Client, err error) bool {
+	if errors.Is(err, ErrRemoteExists) {
+		return false
+	}
+	var status *sftp.StatusError
+	if errors.As(err, &status) {
+		return status.FxCode() == sftp.ErrSSHFxConnectionLost || status.FxCode() == sftp.ErrSSHFxNoConnection
+	}
+	var netErr net.Error
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) || errors.As(err, &netErr) {
+		return true
+	}
+
+	if client == nil {
+		// the login failed
+		return false
+	}
+	alive := make(chan bool, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		alive <- err == nil
+	}()
+	select {
+	case ok := <-alive:
+		return !ok
+	case <-time.After(c.config.timeout()):
+		return true
+	}
+}
+
+// invalidate closes the shared connection after client dropped, unless a concurrent upload
+// already replaced it, and keeps the connection the other uploads dialed since
+func (c *SSHClient) invalidate(client *ssh.Client) {
+	if client == nil {
+		return
+	}
+	c.conn.mu.Lock()
+	defer c.conn.mu.Unlock()
+	if c.conn.ssh_client != client {
+		return
+	}
+	c.conn.close()
+	sshPool.remove(c.conn)
+}
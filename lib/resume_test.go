@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// closes the ssh connection once after reading past after bytes
+type droppingReader struct {
+	io.Reader
+	after   int64
+	read    int64
+	drops   int
+	dropped func()
+}
+
+func (r *droppingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	if r.drops == 0 && r.read >= r.after {
+		r.drops++
+		r.dropped()
+	}
+	return n, err
+}
+
+func (r *droppingReader) Seek(offset int64, whence int) (int64, error) {
+	position, err := r.Reader.(io.Seeker).Seek(offset, whence)
+	r.read = position
+	return position, err
+}
+
+func Test_ResumeUpload(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	server := newTestSFTPServer(t)
+	conf := *server.Item
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	remoteFile := filepath.Join(t.TempDir(), "report.pdf.pgp")
+	client := NewSSHClient(&conf)
+	defer client.Close()
+
+	sshClient, err := client.getClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// continues a partial file matching the upload
+	writeTestFile(t, remoteFile, string(data[:300000]))
+	_, offset, err := client.put(sshClient, remoteFile, bytes.NewReader(data), true, CollisionOverwrite)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	if written, _ := ioutil.ReadFile(remoteFile); offset != 300000 || !bytes.Equal(written, data) {
+		t.Errorf("expected the upload to continue at 300000, got %d and %d bytes", offset, len(written))
+	}
+
+	// starts over when the partial file differs
+	writeTestFile(t, remoteFile, "another file")
+	_, offset, err = client.put(sshClient, remoteFile, bytes.NewReader(data), true, CollisionOverwrite)
+	if written, _ := ioutil.ReadFile(remoteFile); err != nil || offset != 0 || !bytes.Equal(written, data) {
+		t.Errorf("expected the upload to start over, got %d %v", offset, err)
+	}
+
+	// a connection drop is retried with a new connection
+	reader := &droppingReader{Reader: bytes.NewReader(data), after: 400000}
+	reader.dropped = func() {
+		client.conn.ssh_client.Close()
+	}
+	err = client.Put(remoteFile, reader)
+	if written, _ := ioutil.ReadFile(remoteFile); err != nil || reader.drops != 1 || !bytes.Equal(written, data) {
+		t.Errorf("expected the upload to survive the drop, got %v", err)
+	}
+	if server.Connections() < 2 {
+		t.Errorf("expected a new connection, got %d", server.Connections())
+	}
+
+	// a reader which cannot seek is not sent again
+	conf.Retries = 5
+	plain := &droppingReader{Reader: bytes.NewReader(data), after: 400000}
+	plain.dropped = func() {
+		client.conn.ssh_client.Close()
+	}
+	err = client.Put(remoteFile, struct{ io.Reader }{plain})
+	if err == nil || plain.drops != 1 {
+		t.Errorf("expected the upload of a plain reader to fail, got %v", err)
+	}
+	// dropped before the file was created, the file of another batch with the name is not ours to continue
+	conf.Retries = 1
+	taken := filepath.Join(t.TempDir(), "invoice.pdf.pgp")
+	writeTestFile(t, taken, "another batch")
+	for _, item := range []struct {
+		collision string
+		expected  string
+	}{
+		{CollisionFail, ""},
+		{CollisionSuffix, suffixName(taken, 1)},
+	} {
+		client.Close()
+		if err := client.Check(); err != nil {
+			t.Fatal(err)
+		}
+		client.conn.ssh_client.Close()
+		written, err := client.PutAs(taken, bytes.NewReader(data), item.collision)
+		if item.expected == "" && !errors.Is(err, ErrRemoteExists) {
+			t.Errorf("%s: expected ErrRemoteExists, got %s %v", item.collision, written, err)
+		}
+		if item.expected != "" && (err != nil || written != item.expected) {
+			t.Errorf("%s: expected %s, got %s %v", item.collision, item.expected, written, err)
+		}
+		if other, _ := ioutil.ReadFile(taken); string(other) != "another batch" {
+			t.Errorf("%s: the file of another batch was overwritten", item.collision)
+		}
+	}
+
+	if client.dropped(nil, &sftp.StatusError{Code: 3}) {
+		t.Errorf("a permission error should not be retried")
+	}
+}
+
+func Test_InvalidateConnection(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	server := newTestSFTPServer(t)
+	client := NewSSHClient(server.Item)
+	defer client.Close()
+	// another worker of the job, sharing the connection
+	worker := client.WithContext(context.Background())
+
+	failed, err := client.getClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed.Close()
+	worker.invalidate(failed)
+	redialed, err := worker.getClient()
+	if err != nil || redialed == failed {
+		t.Fatalf("expected a new connection, got %v", err)
+	}
+
+	// the drop seen late by the other worker keeps the new connection
+	client.invalidate(failed)
+	if current, _ := client.getClient(); current != redialed {
+		t.Error("expected the connection dialed since to be kept")
+	}
+	if err := client.Check(); err != nil {
+		t.Error(err)
+	}
+	if server.Connections() != 2 {
+		t.Errorf("expected 2 connections, got %d", server.Connections())
+	}
+}
@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"container/list"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	StageDownload = "download"
+	StageEncrypt  = "encrypt"
+	StageUpload   = "upload"
+
+	DefaultDownloadConcurrency = 4
+	DefaultUploadConcurrency   = 4
+	DefaultGlobalConcurrency   = 16
+)
+
+type ConcurrencyConfig struct {
+	// parallel downloads per stage, default 4
+	Download int `json:"download"`
+	// parallel encryptions, default number of CPUs
+	Encrypt int `json:"encrypt"`
+	// parallel sftp uploads, default 4
+	Upload int `json:"upload"`
+	// parallel tasks of all stages and all jobs, default 16
+	Global int `json:"global"`
+}
+
+func (c *ConcurrencyConfig) limit(stage string) int {
+	switch stage {
+	case StageDownload:
+		if c.Download > 0 {
+			return c.Download
+		}
+		return DefaultDownloadConcurrency
+	case StageEncrypt:
+		if c.Encrypt > 0 {
+			return c.Encrypt
+		}
+		return runtime.NumCPU()
+	case StageUpload:
+		if c.Upload > 0 {
+			return c.Upload
+		}
+		return DefaultUploadConcurrency
+	}
+	if c.Global > 0 {
+		return c.Global
+	}
+	return DefaultGlobalConcurrency
+}
+
+// counting semaphore which serves waiters in arrival order
+type semaphore struct {
+	mu      sync.Mutex
+	size    int
+	used    int
+	waiters list.List
+}
+
+func newSemaphore(size int) *semaphore {
+	return &semaphore{size: size}
+}
+
+func (s *semaphore) Acquire() {
+	s.mu.Lock()
+	if s.used < s.size && s.waiters.Len() == 0 {
+		s.used++
+		s.mu.Unlock()
+		return
+	}
+	ready := make(chan struct{})
+	s.waiters.PushBack(ready)
+	s.mu.Unlock()
+
+	<-ready
+}
+
+func (s *semaphore) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if front := s.waiters.Front(); front != nil {
+		// hand the slot over directly
+		s.waiters.Remove(front)
+		close(front.Value.(chan struct{}))
+		return
+	}
+	s.used--
+}
+
+// Scheduler limits the tasks of every stage, shared by all running jobs
+type Scheduler struct {
+	conf   *ConcurrencyConfig
+	global *semaphore
+	stages map[string]*semaphore
+}
+
+func NewScheduler(conf *ConcurrencyConfig) *Scheduler {
+	stages := make(map[string]*semaphore)
+	for _, stage := range []string{StageDownload, StageEncrypt, StageUpload} {
+		stages[stage] = newSemaphore(conf.limit(stage))
+	}
+
+	return &Scheduler{
+		conf:   conf,
+		global: newSemaphore(conf.limit("")),
+		stages: stages,
+	}
+}
+
+// Do runs fn once a slot of the stage and a global slot are available
+func (s *Scheduler) Do(stage string, fn func() error) error {
+	stageSem := s.stages[stage]
+	stageSem.Acquire()
+	defer stageSem.Release()
+	s.global.Acquire()
+	defer s.global.Release()
+
+	return fn()
+}
+
+// Run calls fn for every index below n, a job never occupies more workers than the
+// stage limit so the FIFO queues interleave concurrent jobs. Stops dispatching after
+// the first error and returns it.
+func (s *Scheduler) Run(stage string, n int, fn func(index int) error) error {
+	workers := min(s.conf.limit(stage), n)
+	next := int64(-1)
+	var firstErr atomic.Value
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for firstErr.Load() == nil {
+				index := int(atomic.AddInt64(&next, 1))
+				if index >= n {
+					return
+				}
+				err := s.Do(stage, func() error {
+					return fn(index)
+				})
+				if err != nil {
+					firstErr.CompareAndSwap(nil, errorValue{err})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, ok := firstErr.Load().(errorValue); ok {
+		return v.err
+	}
+	return nil
+}
+
+// atomic.Value requires a consistent concrete type
+type errorValue struct {
+	err error
+}
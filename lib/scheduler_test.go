@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type concurrencyProbe struct {
+	current int32
+	max     int32
+}
+
+func (p *concurrencyProbe) run() {
+	current := atomic.AddInt32(&p.current, 1)
+	for {
+		max := atomic.LoadInt32(&p.max)
+		if current <= max || atomic.CompareAndSwapInt32(&p.max, max, current) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond * 5)
+	atomic.AddInt32(&p.current, -1)
+}
+
+func Test_SchedulerStageLimit(t *testing.T) {
+	scheduler := NewScheduler(&ConcurrencyConfig{Download: 3, Global: 10})
+	probe := &concurrencyProbe{}
+	var done int32
+
+	err := scheduler.Run(StageDownload, 50, func(index int) error {
+		probe.run()
+		atomic.AddInt32(&done, 1)
+		return nil
+	})
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	if done != 50 {
+		t.Errorf("expected 50 tasks, got %d", done)
+	}
+	if probe.max > 3 {
+		t.Errorf("stage limit exceeded: %d", probe.max)
+	}
+}
+
+func Test_SchedulerGlobalLimit(t *testing.T) {
+	scheduler := NewScheduler(&ConcurrencyConfig{Download: 4, Upload: 4, Global: 5})
+	probe := &concurrencyProbe{}
+	var wg sync.WaitGroup
+
+	// several jobs in different stages share the global capacity
+	for _, stage := range []string{StageDownload, StageUpload, StageDownload, StageUpload} {
+		wg.Add(1)
+		go func(stage string) {
+			defer wg.Done()
+			scheduler.Run(stage, 20, func(index int) error {
+				probe.run()
+				return nil
+			})
+		}(stage)
+	}
+	wg.Wait()
+
+	if probe.max > 5 {
+		t.Errorf("global limit exceeded: %d", probe.max)
+	}
+}
+
+func Test_SchedulerError(t *testing.T) {
+	scheduler := NewScheduler(&ConcurrencyConfig{Encrypt: 2})
+	failed := errors.New("failed")
+	var calls int32
+
+	err := scheduler.Run(StageEncrypt, 100, func(index int) error {
+		atomic.AddInt32(&calls, 1)
+		if index == 1 {
+			return failed
+		}
+		return nil
+	})
+	if !errors.Is(err, failed) {
+		t.Errorf("expected first error, got %v", err)
+	}
+	if calls >= 100 {
+		t.Errorf("dispatch should stop after an error, got %d calls", calls)
+	}
+}
+
+func Test_SemaphoreFIFO(t *testing.T) {
+	sem := newSemaphore(1)
+	sem.Acquire()
+
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			sem.Acquire()
+			order <- i
+			sem.Release()
+		}(i)
+		// wait until the goroutine is queued
+		for {
+			sem.mu.Lock()
+			queued := sem.waiters.Len()
+			sem.mu.Unlock()
+			if queued == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	sem.Release()
+
+	for i := 0; i < 3; i++ {
+		if got := <-order; got != i {
+			t.Errorf("expected waiter %d, got %d", i, got)
+		}
+	}
+}
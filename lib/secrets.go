@@ -0,0 +1,305 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// master key, armored PGP private key, or PGPSFTP_MASTER_KEY_FILE naming the file holding it
+	EnvMasterKey = EnvPrefix + "MASTER_KEY"
+	// passphrase of the master key, or PGPSFTP_MASTER_KEY_PASSPHRASE_FILE
+	EnvMasterKeyPassphrase = EnvPrefix + "MASTER_KEY_PASSPHRASE"
+
+	encryptedSecretPrefix = "ENC[PGP,"
+	encryptedSecretSuffix = "]"
+)
+
+var (
+	ErrNoMasterKey       = errors.New("config has encrypted secrets but no master key, set " + EnvMasterKey + " or secrets.master_key_file")
+	ErrMasterKeyLocked   = errors.New("master key is protected by a passphrase, set " + EnvMasterKeyPassphrase)
+	encryptedSecretRegex = regexp.MustCompile(`ENC\[PGP,([A-Za-z0-9+/=]+)\]`)
+)
+
+type SecretsConfig struct {
+	// armored PGP private key decrypting the ENC[PGP,...] secrets, PGPSFTP_MASTER_KEY takes precedence
+	MasterKeyFile string `json:"master_key_file,omitempty"`
+}
+
+// IsEncryptedSecret tells whether value is an ENC[PGP,...] secret
+func IsEncryptedSecret(value string) bool {
+	return strings.HasPrefix(value, encryptedSecretPrefix) && strings.HasSuffix(value, encryptedSecretSuffix)
+}
+
+// ReadMasterKey reads an armored key ring, the private keys are unlocked when a passphrase is given
+func ReadMasterKey(r io.Reader, passphrase string) (openpgp.EntityList, error) {
+	keyring, err := openpgp.ReadArmoredKeyRing(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) <= 0 {
+		return keyring, nil
+	}
+	for _, entity := range keyring {
+		if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
+			err = entity.PrivateKey.Decrypt([]byte(passphrase))
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, subkey := range entity.Subkeys {
+			if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+				err = subkey.PrivateKey.Decrypt([]byte(passphrase))
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return keyring, nil
+}
+
+// ReadMasterKeyFile reads the key ring in filename, see ReadMasterKey
+func ReadMasterKeyFile(filename string, passphrase string) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := ReadMasterKey(bytes.NewReader(data), passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return keyring, nil
+}
+
+// master key from the environment, otherwise from secrets.master_key_file, nil when there is none
+func (c *Config) loadMasterKey(lookup func(string) (string, bool)) (openpgp.EntityList, error) {
+	passphrase, _, err := lookupEnv(lookup, EnvMasterKeyPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	armored, ok, err := lookupEnv(lookup, EnvMasterKey)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		keyring, err := ReadMasterKey(strings.NewReader(armored), passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", EnvMasterKey, err)
+		}
+		return keyring, nil
+	}
+	if len(c.Secrets.MasterKeyFile) > 0 {
+		return ReadMasterKeyFile(c.Secrets.MasterKeyFile, passphrase)
+	}
+	return nil, nil
+}
+
+// EncryptSecret encrypts plaintext to the keys of keyring as ENC[PGP,<base64>]
+func EncryptSecret(keyring openpgp.EntityList, plaintext string) (string, error) {
+	buffer := &bytes.Buffer{}
+	writer, err := openpgp.Encrypt(buffer, keyring, nil, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.WriteString(writer, plaintext)
+	if err != nil {
+		return "", err
+	}
+	err = writer.Close()
+	if err != nil {
+		return "", err
+	}
+	return encryptedSecretPrefix + base64.StdEncoding.EncodeToString(buffer.Bytes()) + encryptedSecretSuffix, nil
+}
+
+// DecryptSecret decrypts an ENC[PGP,...] value with the private keys of keyring
+func DecryptSecret(keyring openpgp.EntityList, value string) (string, error) {
+	if !IsEncryptedSecret(value) {
+		return "", errors.New("not an encrypted secret")
+	}
+	if len(keyring) <= 0 {
+		return "", ErrNoMasterKey
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(strings.TrimPrefix(value, encryptedSecretPrefix), encryptedSecretSuffix))
+	if err != nil {
+		return "", err
+	}
+	// the prompt is only asked when the matching keys are still locked
+	message, err := openpgp.ReadMessage(bytes.NewReader(data), keyring, func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		return nil, ErrMasterKeyLocked
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := ioutil.ReadAll(message.UnverifiedBody)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// decryptSecrets replaces the ENC[PGP,...] secrets by their plaintext, the master key is kept for Save
+func (c *Config) decryptSecrets(lookup func(string) (string, bool)) error {
+	keyring, err := c.loadMasterKey(lookup)
+	if err != nil {
+		return err
+	}
+	c.masterKey = keyring
+	return walkSecrets(reflect.ValueOf(c).Elem(), "", func(path string, value string) (string, error) {
+		if !IsEncryptedSecret(value) {
+			return value, nil
+		}
+		plaintext, err := DecryptSecret(keyring, value)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", path, err)
+		}
+		return plaintext, nil
+	})
+}
+
+// encryptSecrets encrypts every secret of value to keyring
+func encryptSecrets(value reflect.Value, keyring openpgp.EntityList) error {
+	return walkSecrets(value, "", func(path string, value string) (string, error) {
+		if len(value) <= 0 || IsEncryptedSecret(value) {
+			return value, nil
+		}
+		return EncryptSecret(keyring, value)
+	})
+}
+
+// walkSecrets replaces the strings tagged secret:"true", and the values of such maps, by the result of fn.
+// Maps and lists of structs are copied before they change, value may share them with another config.
+func walkSecrets(value reflect.Value, path string, fn func(path string, value string) (string, error)) error {
+	for _, field := range jsonFields(value.Type()) {
+		fieldValue := value.Field(field.index)
+		fieldPath := joinPath(path, field.name)
+		if fieldValue.Kind() == reflect.Struct {
+			err := walkSecrets(fieldValue, fieldPath, fn)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if ok, err := eachStructInSlice(fieldValue, fieldPath, func(item reflect.Value, path string) error {
+			return walkSecrets(item, path, fn)
+		}); ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if value.Type().Field(field.index).Tag.Get("secret") != "true" {
+			continue
+		}
+		switch {
+		case fieldValue.Kind() == reflect.String:
+			result, err := fn(fieldPath, fieldValue.String())
+			if err != nil {
+				return err
+			}
+			fieldValue.SetString(result)
+		case fieldValue.Kind() == reflect.Map && fieldValue.Type().Elem().Kind() == reflect.String && !fieldValue.IsNil():
+			m := reflect.MakeMapWithSize(fieldValue.Type(), fieldValue.Len())
+			for _, key := range fieldValue.MapKeys() {
+				result, err := fn(joinPath(fieldPath, key.String()), fieldValue.MapIndex(key).String())
+				if err != nil {
+					return err
+				}
+				m.SetMapIndex(key, reflect.ValueOf(result).Convert(fieldValue.Type().Elem()))
+			}
+			fieldValue.Set(m)
+		}
+	}
+	return nil
+}
+
+// EncryptConfigSecret encrypts value to the master key of conf, for pasting into the config file
+func EncryptConfigSecret(conf *Config, value string) (string, error) {
+	if len(conf.masterKey) <= 0 {
+		return "", ErrNoMasterKey
+	}
+	return EncryptSecret(conf.masterKey, value)
+}
+
+// RotateSecrets re-encrypts the ENC[PGP,...] values in a config document from oldKey to newKey,
+// the rest of the document, comments included, stays as it is
+func RotateSecrets(data []byte, oldKey openpgp.EntityList, newKey openpgp.EntityList) ([]byte, int, error) {
+	count := 0
+	var rotateErr error
+	rotated := encryptedSecretRegex.ReplaceAllFunc(data, func(match []byte) []byte {
+		if rotateErr != nil {
+			return match
+		}
+		plaintext, err := DecryptSecret(oldKey, string(match))
+		if err == nil {
+			var encrypted string
+			encrypted, err = EncryptSecret(newKey, plaintext)
+			match = []byte(encrypted)
+		}
+		if err != nil {
+			rotateErr = err
+			return match
+		}
+		count++
+		return match
+	})
+	if rotateErr != nil {
+		return nil, 0, rotateErr
+	}
+	return rotated, count, nil
+}
+
+// RotateMasterKey re-encrypts the secrets of every config file of conf to the key in newKeyFile.
+// Returns the number of secrets per file; no file is written unless all of them can be rotated.
+func RotateMasterKey(conf *Config, newKeyFile string) (map[string]int, error) {
+	if len(conf.masterKey) <= 0 {
+		return nil, ErrNoMasterKey
+	}
+	newKey, err := ReadMasterKeyFile(newKeyFile, "")
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	rotated := make(map[string][]byte)
+	counts := make(map[string]int)
+	for _, path := range conf.Paths() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		rotated[path], counts[path], err = RotateSecrets(data, conf.masterKey, newKey)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", path, err)
+			log.Error(err)
+			return nil, err
+		}
+	}
+	for path, data := range rotated {
+		if counts[path] <= 0 {
+			continue
+		}
+		mode := os.FileMode(0600)
+		if info, err := os.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		}
+		err = ioutil.WriteFile(path, data, mode)
+		if err != nil {
+			log.Error(err)
+			return counts, err
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func writeTestMasterKey(t *testing.T, path string) openpgp.EntityList {
+	entity, err := openpgp.NewEntity("master", "", "master@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := new(bytes.Buffer)
+	writer, err := armor.Encode(buffer, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = entity.SerializePrivate(writer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	writeTestFile(t, path, buffer.String())
+	return openpgp.EntityList{entity}
+}
+
+func Test_EncryptedSecrets(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "master.asc")
+	keyring := writeTestMasterKey(t, keyFile)
+	password, err := EncryptSecret(keyring, "sftp-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := EncryptSecret(keyring, "collector-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "config.yaml")
+	writeTestFile(t, path, "ssh:\n  host: sftp.example.com:22\n  password: "+password+"\n"+
+		"tracing:\n  headers:\n    api-key: "+header+"\n"+
+		"secrets:\n  master_key_file: "+keyFile+"\n")
+	err, conf := NewConfig(path)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	if conf.SSH.Password != "sftp-secret" || conf.Tracing.Headers["api-key"] != "collector-secret" {
+		t.Errorf("secrets were not decrypted %+v %+v", conf.SSH, conf.Tracing)
+	}
+
+	// Save keeps the secrets encrypted
+	conf.SSH.Password = "changed-secret"
+	err = conf.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), "changed-secret") || strings.Contains(string(data), "collector-secret") {
+		t.Errorf("plaintext secret was saved:\n%s", data)
+	}
+	err, conf = NewConfig(path)
+	if err != nil || conf.SSH.Password != "changed-secret" || conf.Tracing.Headers["api-key"] != "collector-secret" {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+
+	// the environment takes precedence over secrets.master_key_file
+	t.Setenv(EnvMasterKey+"_FILE", filepath.Join(dir, "missing.asc"))
+	err, _ = NewConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "missing.asc") {
+		t.Errorf("expected the env master key to be used, got %v", err)
+	}
+
+	os.Unsetenv(EnvMasterKey + "_FILE")
+	writeTestFile(t, path, "ssh:\n  password: "+password+"\n")
+	err, _ = NewConfig(path)
+	if !errors.Is(err, ErrNoMasterKey) {
+		t.Errorf("expected ErrNoMasterKey, got %v", err)
+	}
+}
+
+func Test_DecryptSecretWithoutKey(t *testing.T) {
+	keyring := writeTestMasterKey(t, filepath.Join(t.TempDir(), "master.asc"))
+	encrypted, err := EncryptSecret(keyring, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = DecryptSecret(nil, encrypted)
+	if !errors.Is(err, ErrNoMasterKey) {
+		t.Errorf("expected ErrNoMasterKey, got %v", err)
+	}
+	other := writeTestMasterKey(t, filepath.Join(t.TempDir(), "other.asc"))
+	_, err = DecryptSecret(other, encrypted)
+	if err == nil {
+		t.Errorf("expected an error decrypting with another key")
+	}
+}
+
+func Test_RotateMasterKey(t *testing.T) {
+	dir := t.TempDir()
+	oldFile := filepath.Join(dir, "old.asc")
+	newFile := filepath.Join(dir, "new.asc")
+	oldKey := writeTestMasterKey(t, oldFile)
+	writeTestMasterKey(t, newFile)
+	password, err := EncryptSecret(oldKey, "sftp-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "config.yaml")
+	writeTestFile(t, path, "# keep this comment\nssh:\n  password: "+password+"\n")
+	t.Setenv(EnvMasterKey+"_FILE", oldFile)
+	err, conf := NewConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts, err := RotateMasterKey(conf, newFile)
+	if err != nil || counts[path] != 1 {
+		t.Log(counts, err)
+		t.Fail()
+		return
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	if !strings.HasPrefix(string(data), "# keep this comment\n") || strings.Contains(string(data), password) {
+		t.Errorf("unexpected rotated file:\n%s", data)
+	}
+	err, _ = NewConfig(path)
+	if err == nil {
+		t.Errorf("the old key must no longer decrypt the secrets")
+	}
+	t.Setenv(EnvMasterKey+"_FILE", newFile)
+	err, conf = NewConfig(path)
+	if err != nil || conf.SSH.Password != "sftp-secret" {
+		t.Log(err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,195 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// in-process ssh server with the sftp subsystem, serving the local filesystem
+type testSFTPServer struct {
+	Item        *SSHItem
+	connections int32
+	// public keys and certificate authorities allowed to log in as Item.Username
+	AuthorizedKeys []ssh.PublicKey
+	UserCAs        []ssh.PublicKey
+	// the public host key
+	HostKey ssh.PublicKey
+	// direct-tcpip channels opened through the server, as a jump hop
+	forwards int32
+	listener net.Listener
+	config   *ssh.ServerConfig
+}
+
+func newTestSFTPServer(t *testing.T) *testSFTPServer {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &testSFTPServer{
+		Item: &SSHItem{
+			Username: "tester",
+			Password: "secret",
+		},
+	}
+	server.config = &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == server.Item.Username && string(password) == server.Item.Password {
+				return nil, nil
+			}
+			return nil, errors.New("invalid password")
+		},
+		PublicKeyCallback: server.checkPublicKey,
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge(conn.User(), "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if conn.User() == server.Item.Username && len(answers) == 1 && answers[0] == server.Item.Password {
+				return nil, nil
+			}
+			return nil, errors.New("invalid password")
+		},
+	}
+	server.config.AddHostKey(signer)
+	server.HostKey = signer.PublicKey()
+
+	server.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Item.Host = server.listener.Addr().String()
+	t.Cleanup(func() {
+		server.listener.Close()
+	})
+
+	go server.serve()
+	return server
+}
+
+func (s *testSFTPServer) checkPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			for _, ca := range s.UserCAs {
+				if bytes.Equal(ca.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+		UserKeyFallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, authorized := range s.AuthorizedKeys {
+				if conn.User() == s.Item.Username && bytes.Equal(authorized.Marshal(), key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, errors.New("unknown public key")
+		},
+	}
+	return checker.Authenticate(conn, key)
+}
+
+func (s *testSFTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testSFTPServer) handle(conn net.Conn) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer serverConn.Close()
+	atomic.AddInt32(&s.connections, 1)
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() == "direct-tcpip" {
+			go s.forward(newChannel)
+			continue
+		}
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range channelRequests {
+				if req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp" {
+					req.Reply(true, nil)
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						return
+					}
+					server.Serve()
+					return
+				}
+				req.Reply(req.Type == "shell", nil)
+			}
+		}()
+	}
+}
+
+// forward a direct-tcpip channel, like sshd does for ProxyJump
+func (s *testSFTPServer) forward(newChannel ssh.NewChannel) {
+	target := struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}{}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	atomic.AddInt32(&s.forwards, 1)
+	go ssh.DiscardRequests(requests)
+	go func() {
+		io.Copy(conn, channel)
+		conn.Close()
+	}()
+	io.Copy(channel, conn)
+	channel.Close()
+}
+
+func (s *testSFTPServer) Forwards() int {
+	return int(atomic.LoadInt32(&s.forwards))
+}
+
+func (s *testSFTPServer) Connections() int {
+	return int(atomic.LoadInt32(&s.connections))
+}
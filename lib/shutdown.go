@@ -0,0 +1,178 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	DefaultShutdownTimeout = 60
+	defaultPendingJobsFile = "pending-jobs.json"
+)
+
+type ShutdownConfig struct {
+	// seconds to wait for in-flight requests and running jobs, default 60
+	Timeout int `json:"timeout"`
+	// unfinished jobs are saved here and resumed on the next start, default tmp_path/pending-jobs.json
+	PendingFile string `json:"pending_file"`
+}
+
+func (c *ShutdownConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Second
+	}
+	return DefaultShutdownTimeout * time.Second
+}
+
+func (c *Config) pendingFile() string {
+	if len(c.Shutdown.PendingFile) > 0 {
+		return c.Shutdown.PendingFile
+	}
+	return filepath.Join(c.TempPath, defaultPendingJobsFile)
+}
+
+// ShutdownTimeout is the deadline main gives Shutdown
+func (c *Config) ShutdownTimeout() time.Duration {
+	return c.Shutdown.timeout()
+}
+
+// a /multiple/upload job that had not finished at shutdown
+type PendingJob struct {
+	MultipleBody
+	ID              string `json:"id"`
+	Caller          string `json:"caller"`
+	RemoteAddr      string `json:"remote_addr"`
+	ClaimedClientID string `json:"claimed_client_id,omitempty"`
+	RequestID       string `json:"request_id,omitempty"`
+}
+
+// Shutdown stops accepting requests and jobs, waits for the running ones until ctx is done,
+// saves the unfinished jobs for the next start and closes the ssh connections still open
+func (this *HTTPService) Shutdown(ctx context.Context) error {
+	log.Info("http service shutting down")
+	pending := this.queue.Close()
+
+	err := this.server.Shutdown(ctx)
+	if err != nil {
+		log.Error(err)
+	}
+
+	waitErr := this.queue.Wait(ctx)
+	if waitErr != nil {
+		log.Warningf("jobs still running at the shutdown deadline: %s", waitErr)
+	}
+	// unfinished files stay in the watch folders and are picked up at the next start
+	watchErr := this.watcher.Wait(ctx)
+	if watchErr != nil {
+		log.Warningf("watch folder files still being delivered at the shutdown deadline: %s", watchErr)
+	}
+	running := this.queue.Running()
+
+	jobs := make([]*PendingJob, 0, len(pending)+len(running))
+	for _, task := range append(running, pending...) {
+		if z, ok := task.(*Zurich); ok {
+			jobs = append(jobs, z.Pending())
+		}
+	}
+	conf := this.Config()
+	saveErr := savePendingJobs(conf.pendingFile(), jobs)
+	if saveErr != nil {
+		log.Error(saveErr)
+	} else if len(jobs) > 0 {
+		log.Infof("%d unfinished jobs saved to %s", len(jobs), conf.pendingFile())
+	}
+
+	if closed := CloseSSHConnections(); closed > 0 {
+		log.Infof("closed %d ssh connections", closed)
+	}
+	for _, task := range running {
+		if z, ok := task.(*Zurich); ok {
+			z.ClearAllFiles()
+		}
+	}
+	this.audit.Close()
+
+	return errors.Join(err, waitErr, watchErr, saveErr)
+}
+
+func savePendingJobs(path string, jobs []*PendingJob) error {
+	if len(jobs) <= 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(jobs, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	// the file holds public keys and download urls, keep it private
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func loadPendingJobs(path string) ([]*PendingJob, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*PendingJob
+	err = json.Unmarshal(data, &jobs)
+	return jobs, err
+}
+
+// resumes the jobs saved by the last shutdown. Each job is removed from the file once queued,
+// the jobs the queue refuses stay for the next start.
+func (this *HTTPService) resumePendingJobs() error {
+	conf := this.Config()
+	path := conf.pendingFile()
+	jobs, err := loadPendingJobs(path)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if len(jobs) <= 0 {
+		return nil
+	}
+
+	refused := make([]*PendingJob, 0)
+	for index, job := range jobs {
+		z := NewZurichFromPending(conf, job)
+		err = this.submitJob(z)
+		if err != nil {
+			log.Errorf("resume job %s: %s", job.ID, err)
+			refused = append(refused, job)
+			continue
+		}
+		left := append(append([]*PendingJob{}, refused...), jobs[index+1:]...)
+		err = rewritePendingJobs(path, left)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	log.Infof("resumed %d of %d jobs from %s", len(jobs)-len(refused), len(jobs), path)
+	if len(refused) > 0 {
+		log.Warningf("%d jobs left in %s for the next start", len(refused), path)
+	}
+	return nil
+}
+
+// rewritePendingJobs saves the jobs still to resume, or removes the file when none is left
+func rewritePendingJobs(path string, jobs []*PendingJob) error {
+	if len(jobs) <= 0 {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return savePendingJobs(path, jobs)
+}
@@ -0,0 +1,138 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_ShutdownSavesPendingJobs(t *testing.T) {
+	release := make(chan struct{})
+	files := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		select {
+		case <-release:
+		case <-request.Context().Done():
+		}
+		writer.WriteHeader(http.StatusNotFound)
+	}))
+	defer files.Close()
+	releaseAll := sync.OnceFunc(func() {
+		close(release)
+	})
+	defer releaseAll()
+
+	conf := &Config{
+		TempPath: t.TempDir(),
+		Download: DownloadConfig{AllowPrivate: true, Timeout: 5, Retries: -1},
+		Queue:    QueueConfig{MaxRunning: 1},
+	}
+	httpServer := NewHTTP(conf)
+
+	ids := make(map[string]bool)
+	for _, name := range []string{"a.pdf", "b.pdf", "c.pdf"} {
+		z := NewZurich(conf, []*ZurichFile{{Name: name, Url: files.URL + "/" + name}}, "key", "dev", "")
+		z.caller = "tester"
+		z.WithContext(WithRequestID(context.Background(), "req-"+name))
+		ids[z.ID()] = true
+		err := httpServer.submitJob(z)
+		if err != nil {
+			t.Log(err)
+			t.Fail()
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := httpServer.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the running job to hit the deadline, got %v", err)
+	}
+	err = httpServer.submitJob(NewZurich(conf, nil, "key", "dev", ""))
+	if !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("expected queue closed, got %v", err)
+	}
+
+	jobs, err := loadPendingJobs(conf.pendingFile())
+	if err != nil || len(jobs) != 3 {
+		t.Log(len(jobs), err)
+		t.Fail()
+		return
+	}
+	for _, job := range jobs {
+		if !ids[job.ID] || job.Caller != "tester" || job.RequestID != "req-"+job.Files[0].Name || len(job.Files[0].Path) > 0 {
+			t.Errorf("unexpected saved job %+v", job)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(conf.TempPath, jobs[0].ID)); !os.IsNotExist(err) {
+		t.Errorf("temp files of the running job should be removed: %v", err)
+	}
+
+	resumed := NewHTTP(conf)
+	err = resumed.resumePendingJobs()
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	stats := resumed.queue.Stats()
+	if stats.Queued+stats.Running != 3 {
+		t.Errorf("unexpected queue after resume %+v", stats)
+	}
+	if _, err := os.Stat(conf.pendingFile()); !os.IsNotExist(err) {
+		t.Errorf("pending file should be removed after resume: %v", err)
+	}
+	resumed.queue.Close()
+
+	// a full queue takes what fits, the rest stays for the next start
+	err = savePendingJobs(conf.pendingFile(), jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited := *conf
+	limited.Queue.MaxQueued = 1
+	full := NewHTTP(&limited)
+	err = full.resumePendingJobs()
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	if stats := full.queue.Stats(); stats.Queued+stats.Running != 2 {
+		t.Errorf("unexpected queue after resume %+v", stats)
+	}
+	left, err := loadPendingJobs(conf.pendingFile())
+	if err != nil || len(left) != 1 || left[0].ID != jobs[2].ID {
+		t.Errorf("expected the refused job to stay, got %d %v", len(left), err)
+	}
+	full.queue.Close()
+
+	releaseAll()
+	httpServer.queue.Wait(context.Background())
+	resumed.queue.Wait(context.Background())
+	full.queue.Wait(context.Background())
+}
+
+func Test_CloseSSHConnections(t *testing.T) {
+	server := newTestSFTPServer(t)
+	client := NewSSHClient(server.Item)
+	_, err := client.getClient()
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+
+	if closed := CloseSSHConnections(); closed != 1 {
+		t.Errorf("expected 1 closed connection, got %d", closed)
+	}
+	if err := client.Close(); err != nil {
+		t.Error(err)
+	}
+}
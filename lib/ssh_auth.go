@@ -0,0 +1,254 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const KeyboardInteractiveRetryCount = 3
+
+// ssh.auth_methods
+const (
+	AuthPublicKey           = "publickey"
+	AuthAgent               = "agent"
+	AuthPassword            = "password"
+	AuthKeyboardInteractive = "keyboard-interactive"
+)
+
+const certificateSuffix = "-cert.pub"
+
+func (c *SSHItem) hasKey() bool {
+	return len(c.PrivateKey) > 0 || len(c.KeyData) > 0
+}
+
+// the configured auth methods, by default the key, the ssh-agent of SSH_AUTH_SOCK, then the password
+func (c *SSHItem) methods() []string {
+	if len(c.AuthMethods) > 0 {
+		return c.AuthMethods
+	}
+	methods := make([]string, 0)
+	if c.hasKey() {
+		methods = append(methods, AuthPublicKey)
+	}
+	if len(os.Getenv("SSH_AUTH_SOCK")) > 0 {
+		methods = append(methods, AuthAgent)
+	}
+	if len(c.Password) > 0 {
+		methods = append(methods, AuthPassword, AuthKeyboardInteractive)
+	}
+	return methods
+}
+
+// keySigner parses ssh.key or ssh.key_data, with the certificate when there is one
+func (c *SSHItem) keySigner() (ssh.Signer, error) {
+	data := []byte(c.KeyData)
+	if len(c.PrivateKey) > 0 {
+		var err error
+		data, err = ioutil.ReadFile(c.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+	} else if !strings.Contains(c.KeyData, "\n") {
+		// a single line environment variable, e.g. from a .env file
+		data = []byte(strings.ReplaceAll(c.KeyData, `\n`, "\n"))
+	}
+
+	var signer ssh.Signer
+	var err error
+	if len(c.KeyPassphrase) > 0 {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(c.KeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(data)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			err = errors.New("the ssh key is encrypted, set ssh.key_passphrase")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := c.certificate()
+	if err != nil || cert == nil {
+		return signer, err
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// certificate reads ssh.certificate, nil without one
+func (c *SSHItem) certificate() (*ssh.Certificate, error) {
+	data := []byte(c.Certificate)
+	switch {
+	case len(c.Certificate) <= 0:
+		if len(c.PrivateKey) <= 0 {
+			return nil, nil
+		}
+		var err error
+		data, err = ioutil.ReadFile(c.PrivateKey + certificateSuffix)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	case !strings.Contains(c.Certificate, "-cert-v01@openssh.com"):
+		var err error
+		data, err = ioutil.ReadFile(c.Certificate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("ssh.certificate: %w", err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("ssh.certificate: not an OpenSSH certificate")
+	}
+	return cert, nil
+}
+
+// agentSigners returns the keys of the ssh-agent, the connection is needed until the handshake is done
+func agentSigners() ([]ssh.Signer, func(), error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if len(socket) <= 0 {
+		return nil, nil, errors.New("ssh agent: SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ssh agent: %w", err)
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("ssh agent: %w", err)
+	}
+	return signers, func() { conn.Close() }, nil
+}
+
+// authMethods builds ssh.auth_methods in order. The key and the agent share one publickey method,
+// as the ssh client tries every method name only once. closeAgent is called after the handshake.
+func (c *SSHClient) authMethods() (methods []ssh.AuthMethod, closeAgent func(), err error) {
+	closers := make([]func(), 0)
+	closeAgent = func() {
+		for _, closer := range closers {
+			closer()
+		}
+	}
+	signers := make([]ssh.Signer, 0)
+	publicKeys := -1
+	for _, name := range c.config.methods() {
+		switch name {
+		case AuthPublicKey:
+			signer, err := c.config.keySigner()
+			if err != nil {
+				closeAgent()
+				return nil, nil, err
+			}
+			signers = append(signers, signer)
+		case AuthAgent:
+			found, closer, err := agentSigners()
+			if err != nil {
+				// the other methods may still log in
+				c.logger().Warning(err)
+				continue
+			}
+			closers = append(closers, closer)
+			signers = append(signers, found...)
+		case AuthPassword:
+			methods = append(methods, ssh.Password(c.config.Password))
+			continue
+		case AuthKeyboardInteractive:
+			methods = append(methods, c.keyboardInteractive())
+			continue
+		default:
+			closeAgent()
+			return nil, nil, fmt.Errorf("unknown ssh auth method %q", name)
+		}
+		if publicKeys < 0 {
+			publicKeys = len(methods)
+			methods = append(methods, nil)
+		}
+	}
+	if publicKeys >= 0 {
+		if len(signers) > 0 {
+			methods[publicKeys] = ssh.PublicKeys(signers...)
+		} else {
+			methods = append(methods[:publicKeys], methods[publicKeys+1:]...)
+		}
+	}
+	if len(methods) <= 0 {
+		closeAgent()
+		return nil, nil, errors.New("no ssh auth method available, set ssh.password, ssh.key or SSH_AUTH_SOCK")
+	}
+	return methods, closeAgent, nil
+}
+
+// answers every question with the password
+func (c *SSHClient) keyboardInteractive() ssh.AuthMethod {
+	retryCounter := 0
+	return ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) (answers []string, err error) {
+		answers = make([]string, len(questions))
+		for n := range questions {
+			answers[n] = c.config.Password
+		}
+		retryCounter++
+		if retryCounter >= KeyboardInteractiveRetryCount {
+			return nil, errors.New("too many login attempts, invalid username or password")
+		}
+		return answers, nil
+	})
+}
+
+// validate the ssh settings, for Config.Validate
+func (c *SSHItem) problems() []string {
+	return append(c.authProblems("ssh"), c.dialProblems("ssh", false)...)
+}
+
+// validate the login settings of the host or a jump hop
+func (c *SSHItem) authProblems(name string) []string {
+	problems := make([]string, 0)
+	if len(c.PrivateKey) > 0 && len(c.KeyData) > 0 {
+		problems = append(problems, fmt.Sprintf("%s.key and %s.key_data are both set, use one", name, name))
+	}
+	if _, err := os.Stat(c.PrivateKey); len(c.PrivateKey) > 0 && err != nil {
+		problems = append(problems, fmt.Sprintf("%s.key: %s", name, err))
+	} else if c.hasKey() {
+		if _, err := c.keySigner(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.key: %s", name, err))
+		}
+	}
+
+	methods := c.methods()
+	if len(methods) <= 0 {
+		problems = append(problems, fmt.Sprintf("%s.password, %s.key or %s.key_data is required", name, name, name))
+	}
+	for _, method := range methods {
+		switch method {
+		case AuthPublicKey:
+			if !c.hasKey() {
+				problems = append(problems, fmt.Sprintf("%s.auth_methods: publickey needs %s.key or %s.key_data", name, name, name))
+			}
+		case AuthAgent:
+			if len(os.Getenv("SSH_AUTH_SOCK")) <= 0 {
+				problems = append(problems, fmt.Sprintf("%s.auth_methods: agent needs SSH_AUTH_SOCK", name))
+			}
+		case AuthPassword, AuthKeyboardInteractive:
+			if len(c.Password) <= 0 {
+				problems = append(problems, fmt.Sprintf("%s.auth_methods: %s needs %s.password", name, method, name))
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("%s.auth_methods: unknown method %q, use publickey, agent, password or keyboard-interactive", name, method))
+		}
+	}
+	return problems
+}
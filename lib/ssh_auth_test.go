@@ -0,0 +1,183 @@
+package lib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func newTestSSHKey(t *testing.T) (ed25519.PrivateKey, ssh.Signer) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, signer
+}
+
+func testSSHLogin(conf *SSHItem) error {
+	client := NewSSHClient(conf)
+	defer client.Close()
+	_, err := client.getClient()
+	return err
+}
+
+func Test_SSHKeyAuth(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	server := newTestSFTPServer(t)
+	key, signer := newTestSSHKey(t)
+	server.AuthorizedKeys = []ssh.PublicKey{signer.PublicKey()}
+
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("open sesame"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	writeTestFile(t, keyFile, string(pem.EncodeToMemory(block)))
+	conf := &SSHItem{Host: server.Item.Host, Username: "tester", PrivateKey: keyFile}
+	if err := testSSHLogin(conf); err == nil || !strings.Contains(err.Error(), "ssh.key_passphrase") {
+		t.Errorf("expected a missing passphrase error, got %v", err)
+	}
+	conf.KeyPassphrase = "open sesame"
+	if err := testSSHLogin(conf); err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+
+	// inline key of a single line environment variable
+	block, err = ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inline := strings.ReplaceAll(string(pem.EncodeToMemory(block)), "\n", `\n`)
+	conf = &SSHItem{Host: server.Item.Host, Username: "tester", KeyData: inline}
+	if problems := conf.problems(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	if err := testSSHLogin(conf); err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+}
+
+func Test_SSHCertificateAuth(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	server := newTestSFTPServer(t)
+	_, ca := newTestSSHKey(t)
+	server.UserCAs = []ssh.PublicKey{ca.PublicKey()}
+	key, signer := newTestSSHKey(t)
+
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "tester",
+		ValidPrincipals: []string{"tester"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	writeTestFile(t, keyFile, string(pem.EncodeToMemory(block)))
+	conf := &SSHItem{Host: server.Item.Host, Username: "tester", PrivateKey: keyFile}
+	// the key alone is not authorized
+	if err := testSSHLogin(conf); err == nil {
+		t.Errorf("expected the login without certificate to fail")
+	}
+
+	// <key>-cert.pub is picked up like ssh does
+	writeTestFile(t, keyFile+certificateSuffix, string(ssh.MarshalAuthorizedKey(cert)))
+	if err := testSSHLogin(conf); err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	conf.Certificate = string(ssh.MarshalAuthorizedKey(cert))
+	if err := testSSHLogin(conf); err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+}
+
+func Test_SSHAgentAuth(t *testing.T) {
+	server := newTestSFTPServer(t)
+	key, signer := newTestSSHKey(t)
+	server.AuthorizedKeys = []ssh.PublicKey{signer.PublicKey()}
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", socket)
+
+	conf := &SSHItem{Host: server.Item.Host, Username: "tester", AuthMethods: []string{AuthAgent}}
+	if problems := conf.problems(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	if err := testSSHLogin(conf); err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+}
+
+func Test_SSHAuthMethods(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	server := newTestSFTPServer(t)
+	for _, method := range []string{AuthPassword, AuthKeyboardInteractive} {
+		conf := *server.Item
+		conf.AuthMethods = []string{method}
+		if err := testSSHLogin(&conf); err != nil {
+			t.Errorf("%s: %v", method, err)
+		}
+	}
+
+	conf := *server.Item
+	conf.Password = "wrong"
+	if err := testSSHLogin(&conf); err == nil {
+		t.Errorf("expected the login with a wrong password to fail")
+	}
+
+	conf = SSHItem{Host: server.Item.Host, Username: "tester", AuthMethods: []string{"publickey", "kerberos", "password"}}
+	problems := strings.Join(conf.problems(), "; ")
+	for _, expected := range []string{"publickey needs ssh.key", `unknown method "kerberos"`, "password needs ssh.password"} {
+		if !strings.Contains(problems, expected) {
+			t.Errorf("missing %q in %s", expected, problems)
+		}
+	}
+	if problems := (&SSHItem{}).problems(); len(problems) != 1 {
+		t.Errorf("expected a missing login error, got %v", problems)
+	}
+}
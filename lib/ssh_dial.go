@@ -0,0 +1,323 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+const DefaultSSHTimeout = 15
+
+// ssh.host_key_policy
+const (
+	HostKeyStrict    = "strict"
+	HostKeyAcceptNew = "accept-new"
+	HostKeyInsecure  = "insecure"
+)
+
+// serializes the accept-new writes to known_hosts files
+var knownHostsMu sync.Mutex
+
+func (c *SSHItem) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Second
+	}
+	return DefaultSSHTimeout * time.Second
+}
+
+func (c *SSHItem) hostKeyPolicy() string {
+	if len(c.HostKeyPolicy) > 0 {
+		return c.HostKeyPolicy
+	}
+	if len(c.HostKey) > 0 || len(c.KnownHosts) > 0 {
+		return HostKeyStrict
+	}
+	return HostKeyInsecure
+}
+
+// dial connects to the jump hops in order, each through the previous one, then to the host.
+// Returns the clients, the one of the host last.
+func (c *SSHClient) dial() ([]*ssh.Client, error) {
+	hops := append(append([]SSHItem{}, c.config.Jump...), *c.config)
+	clients := make([]*ssh.Client, 0, len(hops))
+	var previous *ssh.Client
+	for i := range hops {
+		client, err := c.dialHop(&hops[i], previous)
+		if err != nil {
+			for j := len(clients) - 1; j >= 0; j-- {
+				clients[j].Close()
+			}
+			return nil, err
+		}
+		clients = append(clients, client)
+		previous = client
+	}
+	return clients, nil
+}
+
+// dialHop logs in to hop, through previous or, for the first hop, through ssh.proxy
+func (c *SSHClient) dialHop(hop *SSHItem, previous *ssh.Client) (client *ssh.Client, err error) {
+	_, span := startSpan(c.ctx, "ssh.connect", attribute.String("sftp.host", hop.Host))
+	defer func() {
+		endSpan(span, err)
+		sshConnections.WithLabelValues(hop.Host, resultLabel(err)).Inc()
+	}()
+
+	authMethods, closeAgent, err := (&SSHClient{config: hop, conn: c.conn, ctx: c.ctx}).authMethods()
+	if err != nil {
+		return nil, err
+	}
+	defer closeAgent()
+	hostKeyCallback, err := hop.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{
+		User:            hop.Username,
+		Auth:            authMethods,
+		HostKeyCallback: hostKeyCallback,
+		BannerCallback: func(message string) error {
+			c.logger().Info(message)
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, hop.timeout())
+	defer cancel()
+	var conn net.Conn
+	if previous == nil {
+		conn, err = dialProxy(ctx, c.config.Proxy, hop.Host)
+	} else {
+		conn, err = previous.DialContext(ctx, "tcp", hop.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the tunnels through a jump hop have no deadlines
+	timer := time.AfterFunc(hop.timeout(), func() {
+		conn.Close()
+	})
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, hop.Host, config)
+	if !timer.Stop() {
+		if err == nil {
+			sshConn.Close()
+		}
+		return nil, fmt.Errorf("ssh: login to %s timed out", hop.Host)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(sshConn, channels, requests), nil
+}
+
+// dialProxy connects to addr directly, or through a SOCKS5 or HTTP CONNECT proxy
+func dialProxy(ctx context.Context, proxyURL string, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	if len(proxyURL) <= 0 {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		socks, err := proxy.SOCKS5("tcp", u.Host, auth, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return socks.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	case "http":
+		return dialHTTPProxy(ctx, dialer, u.Host, auth, addr)
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q, use socks5 or http", u.Scheme)
+}
+
+func dialHTTPProxy(ctx context.Context, dialer *net.Dialer, proxyHost string, auth *proxy.Auth, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxyHost)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if auth != nil {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth.User+":"+auth.Password)))
+	}
+	reader := bufio.NewReader(conn)
+	err = req.Write(conn)
+	var resp *http.Response
+	if err == nil {
+		resp, err = http.ReadResponse(reader, req)
+	}
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("proxy %s: CONNECT %s: %s", proxyHost, addr, resp.Status)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// the ssh server may send its version before the CONNECT response was read to the end
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// hostKeyCallback checks the host key against ssh.host_key or ssh.known_hosts, accepting any one of them
+func (c *SSHItem) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	policy := c.hostKeyPolicy()
+	if policy == HostKeyInsecure {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	var pinned ssh.PublicKey
+	if len(c.HostKey) > 0 && !strings.HasPrefix(c.HostKey, "SHA256:") {
+		var err error
+		pinned, _, _, _, err = ssh.ParseAuthorizedKey([]byte(c.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("ssh.host_key: %w", err)
+		}
+	}
+	if len(c.KnownHosts) > 0 && policy == HostKeyAcceptNew {
+		knownHostsMu.Lock()
+		file, err := os.OpenFile(c.KnownHosts, os.O_CREATE|os.O_RDONLY, 0600)
+		knownHostsMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if len(c.HostKey) > 0 {
+			if ssh.FingerprintSHA256(key) == c.HostKey || (pinned != nil && bytes.Equal(pinned.Marshal(), key.Marshal())) {
+				return nil
+			}
+			if len(c.KnownHosts) <= 0 {
+				return fmt.Errorf("ssh: host key %s of %s does not match ssh.host_key", ssh.FingerprintSHA256(key), hostname)
+			}
+		}
+		if len(c.KnownHosts) <= 0 {
+			return fmt.Errorf("ssh: no ssh.host_key or ssh.known_hosts to check the host key of %s", hostname)
+		}
+
+		knownHostsMu.Lock()
+		defer knownHostsMu.Unlock()
+		check, err := knownhosts.New(c.KnownHosts)
+		if err != nil {
+			return err
+		}
+		err = check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if policy != HostKeyAcceptNew || !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return err
+		}
+		// an unknown host, a changed key is still refused
+		file, err := os.OpenFile(c.KnownHosts, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = fmt.Fprintln(file, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+		if err == nil {
+			log.Warningf("ssh: added the host key %s of %s to %s", ssh.FingerprintSHA256(key), hostname, c.KnownHosts)
+		}
+		return err
+	}, nil
+}
+
+// validate the jump hops, proxy, timeout and host key settings, for SSHItem.problems
+func (c *SSHItem) dialProblems(name string, hop bool) []string {
+	problems := make([]string, 0)
+	if c.Timeout < 0 {
+		problems = append(problems, fmt.Sprintf("%s.timeout must be >= 0, got %d", name, c.Timeout))
+	}
+
+	switch policy := c.hostKeyPolicy(); policy {
+	case HostKeyStrict:
+		if len(c.HostKey) <= 0 && len(c.KnownHosts) <= 0 {
+			problems = append(problems, fmt.Sprintf("%s.host_key_policy strict needs %s.host_key or %s.known_hosts", name, name, name))
+		}
+		if _, err := os.Stat(c.KnownHosts); len(c.KnownHosts) > 0 && err != nil {
+			problems = append(problems, fmt.Sprintf("%s.known_hosts: %s", name, err))
+		}
+	case HostKeyAcceptNew:
+		if len(c.KnownHosts) <= 0 {
+			problems = append(problems, fmt.Sprintf("%s.host_key_policy accept-new needs %s.known_hosts", name, name))
+		}
+	case HostKeyInsecure:
+	default:
+		problems = append(problems, fmt.Sprintf("%s.host_key_policy must be strict, accept-new or insecure, got %q", name, policy))
+	}
+	if len(c.HostKey) > 0 && !strings.HasPrefix(c.HostKey, "SHA256:") {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(c.HostKey)); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.host_key: %s", name, err))
+		}
+	}
+
+	if len(c.Proxy) > 0 {
+		if hop {
+			problems = append(problems, fmt.Sprintf("%s.proxy: only ssh.proxy is used, it dials the first hop", name))
+		} else if u, err := url.Parse(c.Proxy); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.proxy: %s", name, err))
+		} else if _, _, err := net.SplitHostPort(u.Host); err != nil || (u.Scheme != "socks5" && u.Scheme != "socks5h" && u.Scheme != "http") {
+			problems = append(problems, fmt.Sprintf("%s.proxy must be socks5://host:port or http://host:port", name))
+		}
+	}
+
+	for i := range c.Jump {
+		jump := &c.Jump[i]
+		jumpName := fmt.Sprintf("%s.jump[%d]", name, i)
+		if _, _, err := net.SplitHostPort(jump.Host); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.host %q must be host:port", jumpName, jump.Host))
+		}
+		if len(strings.TrimSpace(jump.Username)) <= 0 {
+			problems = append(problems, fmt.Sprintf("%s.user is required", jumpName))
+		}
+		if len(jump.Jump) > 0 {
+			problems = append(problems, fmt.Sprintf("%s.jump: list every hop in %s.jump", jumpName, name))
+		}
+		problems = append(problems, jump.authProblems(jumpName)...)
+		problems = append(problems, jump.dialProblems(jumpName, true)...)
+	}
+	return problems
+}
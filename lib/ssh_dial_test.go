@@ -0,0 +1,208 @@
+package lib
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func Test_SSHJump(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	bastion := newTestSFTPServer(t)
+	target := newTestSFTPServer(t)
+	conf := *target.Item
+	conf.HostKey = ssh.FingerprintSHA256(target.HostKey)
+	conf.Jump = []SSHItem{*bastion.Item}
+	conf.Jump[0].HostKey = string(ssh.MarshalAuthorizedKey(bastion.HostKey))
+	if problems := conf.problems(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+
+	remoteFile := filepath.Join(t.TempDir(), "report.txt.pgp")
+	client := NewSSHClient(&conf)
+	err := client.Put(remoteFile, strings.NewReader("encrypted"))
+	client.Close()
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	if data, err := ioutil.ReadFile(remoteFile); err != nil || string(data) != "encrypted" {
+		t.Errorf("unexpected remote file %q %v", data, err)
+	}
+	if bastion.Forwards() != 1 || target.Connections() != 1 {
+		t.Errorf("expected one connection through the bastion, got %d forwards and %d connections", bastion.Forwards(), target.Connections())
+	}
+
+	conf.Jump[0].Password = "wrong"
+	if err := testSSHLogin(&conf); err == nil {
+		t.Errorf("expected the login to the bastion to fail")
+	}
+	conf.Jump[0] = SSHItem{Host: "bastion", Proxy: "socks5://127.0.0.1:1080"}
+	problems := strings.Join(conf.problems(), "; ")
+	for _, expected := range []string{`ssh.jump[0].host "bastion" must be host:port`, "ssh.jump[0].user is required", "ssh.jump[0].password", "ssh.jump[0].proxy"} {
+		if !strings.Contains(problems, expected) {
+			t.Errorf("missing %q in %s", expected, problems)
+		}
+	}
+}
+
+func Test_SSHHostKey(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	server := newTestSFTPServer(t)
+	conf := *server.Item
+	conf.KnownHosts = filepath.Join(t.TempDir(), "known_hosts")
+	if err := testSSHLogin(&conf); err == nil {
+		t.Errorf("expected an unknown host to be refused")
+	}
+
+	conf.HostKeyPolicy = HostKeyAcceptNew
+	if err := testSSHLogin(&conf); err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	conf.HostKeyPolicy = ""
+	if err := testSSHLogin(&conf); err != nil {
+		t.Errorf("expected the accepted host key to be known: %v", err)
+	}
+
+	// a changed key is refused by accept-new too
+	_, other := newTestSSHKey(t)
+	writeTestFile(t, conf.KnownHosts, knownhosts.Line([]string{knownhosts.Normalize(conf.Host)}, other.PublicKey())+"\n")
+	conf.HostKeyPolicy = HostKeyAcceptNew
+	if err := testSSHLogin(&conf); err == nil {
+		t.Errorf("expected a changed host key to be refused")
+	}
+
+	conf = *server.Item
+	conf.HostKey = ssh.FingerprintSHA256(other.PublicKey())
+	if err := testSSHLogin(&conf); err == nil || !strings.Contains(err.Error(), "does not match ssh.host_key") {
+		t.Errorf("expected a host key mismatch, got %v", err)
+	}
+	conf.HostKey = ssh.FingerprintSHA256(server.HostKey)
+	if err := testSSHLogin(&conf); err != nil {
+		t.Errorf("expected the pinned host key to match: %v", err)
+	}
+}
+
+func Test_SSHProxy(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	server := newTestSFTPServer(t)
+	httpProxy := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodConnect {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if request.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")) {
+			writer.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		target, err := net.Dial("tcp", request.Host)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, buffered, err := writer.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipeTestConn(conn, buffered, target)
+	}))
+	defer httpProxy.Close()
+
+	conf := *server.Item
+	conf.Proxy = "http://user:pass@" + httpProxy.Listener.Addr().String()
+	if err := testSSHLogin(&conf); err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	conf.Proxy = "http://user:wrong@" + httpProxy.Listener.Addr().String()
+	if err := testSSHLogin(&conf); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("expected the proxy to refuse the login, got %v", err)
+	}
+
+	conf.Proxy = "socks5://" + newTestSOCKS5Proxy(t)
+	if err := testSSHLogin(&conf); err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	conf.Proxy = "ftp://proxy"
+	if problems := conf.problems(); len(problems) != 1 || !strings.Contains(problems[0], "ssh.proxy") {
+		t.Errorf("unexpected problems %v", problems)
+	}
+}
+
+func pipeTestConn(conn net.Conn, reader io.Reader, target net.Conn) {
+	go func() {
+		io.Copy(target, reader)
+		target.Close()
+	}()
+	io.Copy(conn, target)
+	conn.Close()
+}
+
+// a SOCKS5 proxy without authentication
+func newTestSOCKS5Proxy(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 256)
+				// greeting, then the connect request
+				if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+					conn.Close()
+					return
+				}
+				io.ReadFull(conn, buf[:buf[1]])
+				conn.Write([]byte{5, 0})
+				io.ReadFull(conn, buf[:4])
+				host := ""
+				switch buf[3] {
+				case 1:
+					io.ReadFull(conn, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 3:
+					io.ReadFull(conn, buf[:1])
+					n := int(buf[0])
+					io.ReadFull(conn, buf[:n])
+					host = string(buf[:n])
+				}
+				io.ReadFull(conn, buf[:2])
+				target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(buf[0])<<8|int(buf[1]))))
+				if err != nil {
+					conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+					conn.Close()
+					return
+				}
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				pipeTestConn(conn, conn, target)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
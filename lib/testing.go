@@ -3,7 +3,6 @@ package lib
 import (
 	"bytes"
 	"encoding/json"
-	"github.com/op/go-logging"
 	"os"
 	"path/filepath"
 	"github.com/joho/godotenv"
@@ -11,13 +10,6 @@ import (
 )
 
 func init() {
-	format := logging.MustStringFormatter(
-		`PGP-SFTP-PROXY %{color} %{shortfunc} %{level:.4s} %{shortfile}
-%{id:03x}%{color:reset} %{message}`,
-	)
-	logging.SetFormatter(format)
-	log := logging.MustGetLogger("PGP-SFTP-PROXY")
-
 	err := godotenv.Load(getLocalPath("../.env"))
 	if err != nil {
 		log.Error("Error loading environment")
@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DefaultTracingServiceName = "pgp-sftp-proxy"
+	defaultTracingURLPath     = "/v1/traces"
+)
+
+// looked up on every span, a tracer taken from the global provider stays bound to the first one set
+func tracer() trace.Tracer {
+	return otel.Tracer("pgp-sftp-proxy/lib")
+}
+
+type TracingConfig struct {
+	// OTLP/HTTP collector, e.g. http://otel-collector:4318, empty disables the exporter
+	Endpoint string `json:"endpoint"`
+	// extra headers sent to the collector, e.g. an API key
+	Headers map[string]string `json:"headers" secret:"true"`
+	// default pgp-sftp-proxy
+	ServiceName string `json:"service_name"`
+	// fraction of new traces to sample, 0 means 1, incoming sampled traces are always kept
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+func (c *TracingConfig) serviceName() string {
+	if len(c.ServiceName) > 0 {
+		return c.ServiceName
+	}
+	return DefaultTracingServiceName
+}
+
+func (c *TracingConfig) sampleRatio() float64 {
+	if c.SampleRatio > 0 && c.SampleRatio <= 1 {
+		return c.SampleRatio
+	}
+	return 1
+}
+
+// SetupTracing installs the W3C trace context propagator and, when an endpoint is configured,
+// an OTLP exporter. The returned function flushes and stops the exporter.
+func SetupTracing(conf *TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if len(conf.Endpoint) <= 0 {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.Trim(endpoint.Path, "/")) <= 0 {
+		endpoint.Path = defaultTracingURLPath
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(endpoint.String())}
+	if len(conf.Headers) > 0 {
+		options = append(options, otlptracehttp.WithHeaders(conf.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", conf.serviceName()),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.sampleRatio()))),
+	)
+	otel.SetTracerProvider(provider)
+	log.Infof("tracing exported to %s", endpoint.String())
+
+	return provider.Shutdown, nil
+}
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// ends span, marking it failed when err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// adds the traceparent of ctx to an outbound request
+func injectTrace(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// continues the caller's traceparent, one server span per request named by the route template
+func (this *HTTPService) tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		route := "unmatched"
+		if current := mux.CurrentRoute(request); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+		ctx, span := tracer().Start(ctx, request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", request.Method),
+				attribute.String("http.route", route),
+				attribute.String("request.id", RequestIDFromContext(ctx)),
+			))
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: writer, status: http.StatusOK}
+		next.ServeHTTP(sw, request.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+		if sw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
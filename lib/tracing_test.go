@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace/noop"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"google.golang.org/protobuf/proto"
+)
+
+const testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+// stands in for an OTLP/HTTP collector, keeping the received span names by trace id
+type testCollector struct {
+	mu    sync.Mutex
+	spans map[string][]string
+}
+
+func newTestCollector(t *testing.T) (*testCollector, *httptest.Server) {
+	collector := &testCollector{spans: map[string][]string{}}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			writer.WriteHeader(500)
+			return
+		}
+		export := &collectortrace.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, export); err != nil {
+			writer.WriteHeader(400)
+			return
+		}
+		collector.mu.Lock()
+		for _, resourceSpans := range export.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				for _, span := range scopeSpans.Spans {
+					traceID := hex.EncodeToString(span.TraceId)
+					collector.spans[traceID] = append(collector.spans[traceID], span.Name)
+				}
+			}
+		}
+		collector.mu.Unlock()
+		writer.Header().Set("Content-Type", "application/x-protobuf")
+		writer.WriteHeader(200)
+	}))
+	t.Cleanup(server.Close)
+	return collector, server
+}
+
+func (c *testCollector) Spans(traceID string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.spans[traceID]
+}
+
+func getTestPGPKey(t *testing.T) string {
+	entity, err := openpgp.NewEntity("tester", "", "tester@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := new(bytes.Buffer)
+	writer, err := armor.Encode(buffer, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = entity.Serialize(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	return buffer.String()
+}
+
+func setupTestTracing(t *testing.T) (*testCollector, func()) {
+	collector, server := newTestCollector(t)
+	shutdown, err := SetupTracing(&TracingConfig{Endpoint: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flush := func() {
+		if err := shutdown(context.Background()); err != nil {
+			t.Log(err)
+			t.Fail()
+		}
+	}
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+	return collector, flush
+}
+
+func hasSpans(spans []string, names ...string) bool {
+	for _, name := range names {
+		found := false
+		for _, span := range spans {
+			found = found || span == name
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func Test_TracingJob(t *testing.T) {
+	collector, flush := setupTestTracing(t)
+
+	var downstream []string
+	var mu sync.Mutex
+	files := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mu.Lock()
+		downstream = append(downstream, request.Header.Get("traceparent"))
+		mu.Unlock()
+		if request.Method == http.MethodPost {
+			writer.Write([]byte("success"))
+			return
+		}
+		writer.Write([]byte("plain text"))
+	}))
+	defer files.Close()
+
+	server := newTestSFTPServer(t)
+	conf := getHealthTestConfig(t, server)
+	conf.Download = DownloadConfig{AllowPrivate: true, Timeout: 5}
+
+	incoming := http.Header{}
+	incoming.Set("traceparent", "00-"+testTraceID+"-00f067aa0ba902b7-01")
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(incoming))
+
+	z := NewZurich(conf, []*ZurichFile{
+		{Name: "a.txt", Url: files.URL + "/a.txt"},
+		{Name: "b.txt", Url: files.URL + "/b.txt"},
+	}, getTestPGPKey(t), "dev", files.URL+"/notify").WithContext(ctx)
+	z.Process()
+	if !z.Result().Status {
+		t.Log(z.Result().Error)
+		t.Fail()
+		return
+	}
+	flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(downstream) != 3 {
+		t.Log(downstream)
+		t.Fail()
+		return
+	}
+	for _, traceparent := range downstream {
+		if !strings.Contains(traceparent, testTraceID) {
+			t.Log("traceparent not propagated:", traceparent)
+			t.Fail()
+		}
+	}
+
+	spans := collector.Spans(testTraceID)
+	if !hasSpans(spans, "job", "stage.download", "download", "stage.encrypt", "pgp.encrypt",
+		"stage.upload", "ssh.connect", "sftp.upload", "notify") {
+		t.Log(spans)
+		t.Fail()
+	}
+}
+
+func Test_TracingHTTP(t *testing.T) {
+	collector, flush := setupTestTracing(t)
+
+	server := newTestSFTPServer(t)
+	httpServer := NewHTTP(getHealthTestConfig(t, server))
+
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	req.Header.Set("traceparent", "00-"+testTraceID+"-00f067aa0ba902b7-01")
+	writer := httptest.NewRecorder()
+	httpServer.getHTTPHandler().ServeHTTP(writer, req)
+	flush()
+
+	spans := collector.Spans(testTraceID)
+	if !hasSpans(spans, "GET /healthz") {
+		t.Log(spans)
+		t.Fail()
+	}
+}
@@ -0,0 +1,282 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// transport.type
+const (
+	TransportSFTP   = "sftp"
+	TransportLocal  = "local"
+	TransportFTPS   = "ftps"
+	TransportS3     = "s3"
+	TransportWebDAV = "webdav"
+)
+
+// Transport delivers the encrypted files to a destination
+type Transport interface {
+	// PutAs writes reader to remotePath, or the name the collision policy picks when it exists.
+	// Returns the remote path written.
+	PutAs(remotePath string, reader io.Reader, collision string) (string, error)
+	// Check logs in and looks at the destination, for the readiness check
+	Check() error
+	// Remove deletes remotePath, a missing file is no error. Takes back a delivery.
+	Remove(remotePath string) error
+	// Host names the destination in the logs, metrics and audit log
+	Host() string
+	Close() error
+}
+
+type TransportConfig struct {
+	// sftp (default, with the ssh settings), local, ftps, s3 or webdav
+	Type   string       `json:"type"`
+	Local  LocalConfig  `json:"local"`
+	FTPS   FTPSConfig   `json:"ftps"`
+	S3     S3Config     `json:"s3"`
+	WebDAV WebDAVConfig `json:"webdav"`
+}
+
+type LocalConfig struct {
+	// folder the remote paths are written under, e.g. a mounted NFS share
+	Path string `json:"path"`
+}
+
+func (c *TransportConfig) kind() string {
+	if len(c.Type) > 0 {
+		return strings.ToLower(c.Type)
+	}
+	return TransportSFTP
+}
+
+// NewTransport returns the transport of transport.type, the sftp one uses sshConf
+func NewTransport(ctx context.Context, conf *TransportConfig, sshConf *SSHItem) Transport {
+	switch conf.kind() {
+	case TransportLocal:
+		return &localTransport{config: &conf.Local, ctx: ctx}
+	case TransportFTPS:
+		return newFTPSTransport(ctx, &conf.FTPS)
+	case TransportS3:
+		return newS3Transport(ctx, &conf.S3)
+	case TransportWebDAV:
+		return newWebDAVTransport(ctx, &conf.WebDAV)
+	}
+	return NewSSHClient(sshConf).WithContext(ctx)
+}
+
+// Host of the destination from the settings, the same as Transport.Host, for the audit log
+func (c *TransportConfig) Host(sshConf *SSHItem) string {
+	switch c.kind() {
+	case TransportLocal:
+		return c.Local.Path
+	case TransportFTPS:
+		return c.FTPS.Host
+	case TransportS3:
+		return c.S3.host()
+	case TransportWebDAV:
+		return c.WebDAV.host()
+	}
+	return sshConf.Host
+}
+
+// UploadFileAs uploads the local filename with transport, see Transport.PutAs
+func UploadFileAs(transport Transport, filename string, remotePath string, collision string) (string, error) {
+	localFile, err := os.Open(filename)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	defer localFile.Close()
+	// seekable, the sftp transport continues the partial file after a drop
+	return transport.PutAs(remotePath, localFile, collision)
+}
+
+// remoteLookup is implemented by every transport, sftp included
+type remoteLookup interface {
+	exists(name string) (bool, error)
+}
+
+// existedBefore tells whether an upload with collision is about to replace remotePath, a file the job
+// did not create and a roll back must keep. Only the overwrite policy replaces a file.
+func existedBefore(transport Transport, remotePath string, collision string) (bool, error) {
+	if collision != CollisionOverwrite {
+		return false, nil
+	}
+	lookup, ok := transport.(remoteLookup)
+	if !ok {
+		// cannot tell, kept
+		return true, nil
+	}
+	return lookup.exists(remotePath)
+}
+
+// remoteWriter is the part a transport other than sftp implements, putAs adds the collision policy
+type remoteWriter interface {
+	remoteLookup
+	// write returns ErrRemoteExists when name exists and overwrite is false
+	write(name string, reader io.Reader, overwrite bool) error
+}
+
+// putAs writes reader with writer to remotePath, or with the suffix policy to the first free name-n
+func putAs(writer remoteWriter, remotePath string, reader io.Reader, collision string) (string, error) {
+	if collision == CollisionOverwrite {
+		return remotePath, writer.write(remotePath, reader, true)
+	}
+	name := remotePath
+	for n := 1; ; n++ {
+		exists, err := writer.exists(name)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			err = writer.write(name, reader, false)
+			if !errors.Is(err, ErrRemoteExists) {
+				if err != nil {
+					return "", err
+				}
+				return name, nil
+			}
+			// created since the check, the next name needs the data again
+			seeker, ok := reader.(io.Seeker)
+			if !ok {
+				return "", err
+			}
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return "", err
+			}
+		}
+		if collision != CollisionSuffix || n > maxCollisionSuffix {
+			return "", fmt.Errorf("%w: %s", ErrRemoteExists, name)
+		}
+		name = suffixName(remotePath, n)
+	}
+}
+
+// observePut traces and measures one upload of a transport other than sftp
+func observePut(ctx context.Context, kind string, host string, remotePath string, put func() (string, error)) (written string, err error) {
+	started := time.Now()
+	_, span := startSpan(ctx, kind+".upload",
+		attribute.String("transport.host", host),
+		attribute.String("transport.path", remotePath))
+	defer func() {
+		observeUpload(host, started, err)
+		endSpan(span, err)
+	}()
+	written, err = put()
+	if err != nil {
+		Logger(ctx).Error(err)
+	}
+	return written, err
+}
+
+// validate the settings of transport.type, for Config.Validate
+func (c *TransportConfig) problems() []string {
+	problems := make([]string, 0)
+	switch c.kind() {
+	case TransportSFTP:
+	case TransportLocal:
+		if info, err := os.Stat(c.Local.Path); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("transport.local.path %q must be a folder", c.Local.Path))
+		}
+	case TransportFTPS:
+		problems = append(problems, c.FTPS.problems()...)
+	case TransportS3:
+		problems = append(problems, c.S3.problems()...)
+	case TransportWebDAV:
+		problems = append(problems, c.WebDAV.problems()...)
+	default:
+		problems = append(problems, fmt.Sprintf("transport.type must be sftp, local, ftps, s3 or webdav, got %q", c.Type))
+	}
+	return problems
+}
+
+// localTransport writes under a local folder, each file appears at once under its name
+type localTransport struct {
+	config *LocalConfig
+	ctx    context.Context
+}
+
+func (t *localTransport) Host() string {
+	return t.config.Path
+}
+
+func (t *localTransport) Close() error {
+	return nil
+}
+
+// the folder exists and can be written
+func (t *localTransport) Check() error {
+	probe, err := os.CreateTemp(t.config.Path, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+func (t *localTransport) PutAs(remotePath string, reader io.Reader, collision string) (string, error) {
+	return observePut(t.ctx, TransportLocal, t.Host(), remotePath, func() (string, error) {
+		return putAs(t, remotePath, reader, collision)
+	})
+}
+
+func (t *localTransport) Remove(remotePath string) error {
+	err := os.Remove(t.localPath(remotePath))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (t *localTransport) localPath(name string) string {
+	return filepath.Join(t.config.Path, filepath.FromSlash(name))
+}
+
+func (t *localTransport) exists(name string) (bool, error) {
+	_, err := os.Stat(t.localPath(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// write copies to a hidden .part file first, so readers of the folder never see a partial file
+func (t *localTransport) write(name string, reader io.Reader, overwrite bool) error {
+	target := t.localPath(name)
+	err := os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	part, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(part.Name())
+	_, err = io.Copy(part, reader)
+	if err == nil {
+		err = part.Sync()
+	}
+	if closeErr := part.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if overwrite {
+		return os.Rename(part.Name(), target)
+	}
+	// a link fails when target exists
+	err = os.Link(part.Name(), target)
+	if os.IsExist(err) {
+		return fmt.Errorf("%w: %s", ErrRemoteExists, name)
+	}
+	return err
+}
@@ -0,0 +1,372 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultFTPSTimeout = 15
+
+type FTPSConfig struct {
+	// host:port, usually 21 with explicit TLS (AUTH TLS) and 990 with implicit TLS
+	Host     string `json:"host"`
+	User     string `json:"user"`
+	Password string `json:"password" secret:"true"`
+	// file holding the password
+	PasswordFile string `json:"password_file,omitempty"`
+	// TLS from the first byte instead of AUTH TLS
+	Implicit bool `json:"implicit,omitempty"`
+	// PEM file of the CA certificates of the server, default the system ones
+	CAFile string `json:"ca_file,omitempty"`
+	// seconds to connect and log in, default 15
+	Timeout int `json:"timeout,omitempty"`
+}
+
+func (c *FTPSConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Second
+	}
+	return DefaultFTPSTimeout * time.Second
+}
+
+var pasvReply = regexp.MustCompile(`(\d+),(\d+),(\d+),(\d+),(\d+),(\d+)`)
+
+// ftpsTransport stores each file with STOR over a TLS data connection. The control connections
+// are kept for the next uploads, one per concurrent upload as FTP handles one command at a time.
+type ftpsTransport struct {
+	config *FTPSConfig
+	ctx    context.Context
+	mu     sync.Mutex
+	tls    *tls.Config
+	idle   []*ftpConn
+	// the folders created or found, MKD is sent once
+	folders map[string]bool
+}
+
+type ftpConn struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+func newFTPSTransport(ctx context.Context, conf *FTPSConfig) *ftpsTransport {
+	return &ftpsTransport{
+		config:  conf,
+		ctx:     ctx,
+		folders: make(map[string]bool),
+	}
+}
+
+func (t *ftpsTransport) Host() string {
+	return t.config.Host
+}
+
+func (t *ftpsTransport) PutAs(remotePath string, reader io.Reader, collision string) (string, error) {
+	return observePut(t.ctx, TransportFTPS, t.Host(), remotePath, func() (string, error) {
+		return putAs(t, remotePath, reader, collision)
+	})
+}
+
+// logs in and asks for the current folder
+func (t *ftpsTransport) Check() error {
+	conn, err := t.get()
+	if err != nil {
+		return err
+	}
+	_, _, err = conn.cmd(257, "PWD")
+	t.release(conn, err)
+	return err
+}
+
+func (t *ftpsTransport) Close() error {
+	t.mu.Lock()
+	idle := t.idle
+	t.idle = nil
+	t.mu.Unlock()
+	for _, conn := range idle {
+		conn.cmd(0, "QUIT")
+		conn.conn.Close()
+	}
+	return nil
+}
+
+// the client TLS settings, shared so the data connections resume the session of the control connection
+func (t *ftpsTransport) tlsConfig() (*tls.Config, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tls != nil {
+		return t.tls, nil
+	}
+	host, _, err := net.SplitHostPort(t.config.Host)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		ServerName:         host,
+		MinVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(16),
+	}
+	if len(t.config.CAFile) > 0 {
+		data, err := ioutil.ReadFile(t.config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("transport.ftps.ca_file %s: no certificate", t.config.CAFile)
+		}
+	}
+	t.tls = config
+	return config, nil
+}
+
+// get an idle control connection, or dial and log in
+func (t *ftpsTransport) get() (*ftpConn, error) {
+	t.mu.Lock()
+	if len(t.idle) > 0 {
+		conn := t.idle[len(t.idle)-1]
+		t.idle = t.idle[:len(t.idle)-1]
+		t.mu.Unlock()
+		return conn, nil
+	}
+	t.mu.Unlock()
+	return t.dial()
+}
+
+// release keeps conn for the next upload, unless err broke it
+func (t *ftpsTransport) release(conn *ftpConn, err error) {
+	var protocolErr *textproto.Error
+	if err != nil && !errors.As(err, &protocolErr) && !errors.Is(err, ErrRemoteExists) {
+		conn.conn.Close()
+		return
+	}
+	t.mu.Lock()
+	t.idle = append(t.idle, conn)
+	t.mu.Unlock()
+}
+
+func (t *ftpsTransport) dial() (*ftpConn, error) {
+	config, err := t.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: t.config.timeout()}
+	conn, err := dialer.DialContext(t.ctx, "tcp", t.config.Host)
+	if err != nil {
+		return nil, err
+	}
+	if t.config.Implicit {
+		conn = tls.Client(conn, config)
+	}
+	// the login, not the transfers
+	conn.SetDeadline(time.Now().Add(t.config.timeout()))
+	ftp := &ftpConn{conn: conn, text: textproto.NewConn(conn)}
+	err = t.login(ftp, config)
+	if err != nil {
+		ftp.conn.Close()
+		return nil, fmt.Errorf("ftps %s: %w", t.config.Host, err)
+	}
+	ftp.conn.SetDeadline(time.Time{})
+	return ftp, nil
+}
+
+func (t *ftpsTransport) login(ftp *ftpConn, config *tls.Config) error {
+	_, _, err := ftp.text.ReadResponse(220)
+	if err != nil {
+		return err
+	}
+	if !t.config.Implicit {
+		_, _, err = ftp.cmd(234, "AUTH TLS")
+		if err != nil {
+			return err
+		}
+		secure := tls.Client(ftp.conn, config)
+		err = secure.Handshake()
+		if err != nil {
+			return err
+		}
+		ftp.conn = secure
+		ftp.text = textproto.NewConn(secure)
+	}
+	code, message, err := ftp.cmd(0, "USER %s", t.config.User)
+	if err == nil && code == 331 {
+		code, message, err = ftp.cmd(0, "PASS %s", t.config.Password)
+	}
+	if err != nil {
+		return err
+	}
+	if code != 230 {
+		return &textproto.Error{Code: code, Msg: message}
+	}
+	for _, command := range []string{"PBSZ 0", "PROT P", "TYPE I"} {
+		_, _, err = ftp.cmd(200, command)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cmd sends one command and reads its reply, expect is the code or its first digit, 0 takes any
+func (c *ftpConn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	err := c.text.PrintfLine(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	return c.text.ReadResponse(expect)
+}
+
+// passive data connection, to the host of the control connection whatever address PASV gives
+func (c *ftpConn) data(config *tls.Config, timeout time.Duration) (*tls.Conn, error) {
+	_, message, err := c.cmd(227, "PASV")
+	if err != nil {
+		return nil, err
+	}
+	match := pasvReply.FindStringSubmatch(message)
+	if match == nil {
+		return nil, fmt.Errorf("unexpected PASV reply %q", message)
+	}
+	high, _ := strconv.Atoi(match[5])
+	low, _ := strconv.Atoi(match[6])
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(high<<8|low)), timeout)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Client(conn, config), nil
+}
+
+func (t *ftpsTransport) exists(name string) (bool, error) {
+	conn, err := t.get()
+	if err != nil {
+		return false, err
+	}
+	code, _, err := conn.cmd(0, "SIZE %s", name)
+	t.release(conn, err)
+	if err != nil {
+		return false, err
+	}
+	switch code {
+	case 213:
+		return true, nil
+	case 550:
+		return false, nil
+	}
+	return false, fmt.Errorf("ftps SIZE %s: unexpected reply %d", name, code)
+}
+
+func (t *ftpsTransport) Remove(remotePath string) error {
+	conn, err := t.get()
+	if err != nil {
+		return err
+	}
+	code, _, err := conn.cmd(0, "DELE %s", remotePath)
+	t.release(conn, err)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 250, 550:
+		return nil
+	}
+	return fmt.Errorf("ftps DELE %s: unexpected reply %d", remotePath, code)
+}
+
+// write cannot refuse an existing file, FTP has no exclusive create. putAs checks the name before.
+func (t *ftpsTransport) write(name string, reader io.Reader, overwrite bool) error {
+	conn, err := t.get()
+	if err != nil {
+		return err
+	}
+	err = t.stor(conn, name, reader)
+	t.release(conn, err)
+	return err
+}
+
+func (t *ftpsTransport) stor(conn *ftpConn, name string, reader io.Reader) error {
+	err := t.mkdir(conn, path.Dir(name))
+	if err != nil {
+		return err
+	}
+	data, err := conn.data(t.tls, t.config.timeout())
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	_, _, err = conn.cmd(1, "STOR %s", name)
+	if err != nil {
+		return err
+	}
+	err = data.Handshake()
+	if err == nil {
+		_, err = io.Copy(data, reader)
+	}
+	// the end of the file for the server
+	closeErr := data.Close()
+	if err == nil {
+		err = closeErr
+	}
+	_, _, replyErr := conn.text.ReadResponse(2)
+	if err != nil {
+		return err
+	}
+	return replyErr
+}
+
+// mkdir creates the folders of folder from the top, the existing ones answer 550
+func (t *ftpsTransport) mkdir(conn *ftpConn, folder string) error {
+	current := "/"
+	if !strings.HasPrefix(folder, "/") {
+		current = ""
+	}
+	for _, part := range strings.Split(strings.Trim(folder, "/"), "/") {
+		if len(part) <= 0 || part == "." {
+			continue
+		}
+		current = path.Join(current, part)
+		t.mu.Lock()
+		known := t.folders[current]
+		t.mu.Unlock()
+		if known {
+			continue
+		}
+		code, message, err := conn.cmd(0, "MKD %s", current)
+		if err != nil {
+			return err
+		}
+		if code != 257 && code != 550 {
+			return &textproto.Error{Code: code, Msg: message}
+		}
+		t.mu.Lock()
+		t.folders[current] = true
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+// validate the settings, for Config.Validate
+func (c *FTPSConfig) problems() []string {
+	problems := make([]string, 0)
+	if _, _, err := net.SplitHostPort(c.Host); err != nil {
+		problems = append(problems, fmt.Sprintf("transport.ftps.host %q must be host:port", c.Host))
+	}
+	if len(strings.TrimSpace(c.User)) <= 0 {
+		problems = append(problems, "transport.ftps.user is required")
+	}
+	if c.Timeout < 0 {
+		problems = append(problems, fmt.Sprintf("transport.ftps.timeout must be >= 0, got %d", c.Timeout))
+	}
+	return problems
+}
@@ -0,0 +1,267 @@
+package lib
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// an FTP server storing in a temp folder, user tester/secret, which wants TLS on every connection
+type testFTPSServer struct {
+	Addr   string
+	Root   string
+	CAFile string
+	tls    *tls.Config
+	conns  int32
+}
+
+func (s *testFTPSServer) Connections() int {
+	return int(atomic.LoadInt32(&s.conns))
+}
+
+func newTestFTPSServer(t *testing.T, implicit bool) *testFTPSServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ftps test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testFTPSServer{
+		Root:   t.TempDir(),
+		CAFile: filepath.Join(t.TempDir(), "ca.pem"),
+		tls:    &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{certificate}, PrivateKey: key}}},
+	}
+	writeTestFile(t, server.CAFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	server.Addr = listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&server.conns, 1)
+			if implicit {
+				conn = tls.Server(conn, server.tls)
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *testFTPSServer) path(name string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(name))
+}
+
+func (s *testFTPSServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 ready")
+	var passive net.Listener
+	user, loggedIn := "", false
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command, arg, _ := strings.Cut(line, " ")
+		command = strings.ToUpper(command)
+		if _, secure := conn.(*tls.Conn); !secure && command != "AUTH" {
+			text.PrintfLine("530 TLS required")
+			continue
+		}
+		if !loggedIn && command != "AUTH" && command != "USER" && command != "PASS" {
+			text.PrintfLine("530 login first")
+			continue
+		}
+		switch command {
+		case "AUTH":
+			text.PrintfLine("234 go ahead")
+			secure := tls.Server(conn, s.tls)
+			if secure.Handshake() != nil {
+				return
+			}
+			conn = secure
+			text = textproto.NewConn(conn)
+		case "USER":
+			user = arg
+			text.PrintfLine("331 password please")
+		case "PASS":
+			loggedIn = user == "tester" && arg == "secret"
+			if loggedIn {
+				text.PrintfLine("230 logged in")
+			} else {
+				text.PrintfLine("530 login incorrect")
+			}
+		case "PBSZ", "PROT", "TYPE":
+			text.PrintfLine("200 ok")
+		case "PWD":
+			text.PrintfLine(`257 "/"`)
+		case "MKD":
+			if err := os.Mkdir(s.path(arg), os.ModePerm); err != nil {
+				text.PrintfLine("550 %s", err)
+			} else {
+				text.PrintfLine(`257 "%s" created`, arg)
+			}
+		case "SIZE":
+			if info, err := os.Stat(s.path(arg)); err != nil {
+				text.PrintfLine("550 no such file")
+			} else {
+				text.PrintfLine("213 %d", info.Size())
+			}
+		case "DELE":
+			if err := os.Remove(s.path(arg)); err != nil {
+				text.PrintfLine("550 %s", err)
+			} else {
+				text.PrintfLine("250 deleted")
+			}
+		case "PASV":
+			passive, err = net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				text.PrintfLine("425 %s", err)
+				continue
+			}
+			port := passive.Addr().(*net.TCPAddr).Port
+			// a wrong address, as behind NAT, the client uses the one of the control connection
+			text.PrintfLine("227 Entering Passive Mode (10,0,0,1,%d,%d)", port>>8, port&255)
+		case "STOR":
+			if passive == nil {
+				text.PrintfLine("425 use PASV first")
+				continue
+			}
+			text.PrintfLine("150 ok")
+			data, err := passive.Accept()
+			passive.Close()
+			passive = nil
+			if err != nil {
+				text.PrintfLine("425 %s", err)
+				continue
+			}
+			secure := tls.Server(data, s.tls)
+			file, err := os.Create(s.path(arg))
+			if err == nil {
+				_, err = io.Copy(file, secure)
+				file.Close()
+			}
+			secure.Close()
+			if err != nil {
+				text.PrintfLine("451 %s", err)
+			} else {
+				text.PrintfLine("226 transfer complete")
+			}
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 %s not implemented", command)
+		}
+	}
+}
+
+func Test_FTPSTransport(t *testing.T) {
+	server := newTestFTPSServer(t, false)
+	conf := &TransportConfig{Type: TransportFTPS, FTPS: FTPSConfig{Host: server.Addr, User: "tester", Password: "secret", CAFile: server.CAFile}}
+	if problems := conf.problems(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	transport := NewTransport(context.Background(), conf, nil)
+	if err := transport.Check(); err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+
+	for _, expected := range []string{"/upload/pro/2024/report.pdf.pgp", "/upload/pro/2024/report-1.pdf.pgp"} {
+		written, err := transport.PutAs("/upload/pro/2024/report.pdf.pgp", strings.NewReader("encrypted"), CollisionSuffix)
+		if err != nil || written != expected {
+			t.Errorf("expected %s, got %s %v", expected, written, err)
+		}
+		if data, err := ioutil.ReadFile(server.path(expected)); err != nil || string(data) != "encrypted" {
+			t.Errorf("unexpected file %s %q %v", expected, data, err)
+		}
+	}
+	if _, err := transport.PutAs("/upload/pro/2024/report.pdf.pgp", strings.NewReader("other"), CollisionFail); !errors.Is(err, ErrRemoteExists) {
+		t.Errorf("expected ErrRemoteExists, got %v", err)
+	}
+	if _, err := transport.PutAs("/upload/pro/2024/report.pdf.pgp", strings.NewReader(""), CollisionOverwrite); err != nil {
+		t.Error(err)
+	}
+	if data, err := ioutil.ReadFile(server.path("/upload/pro/2024/report.pdf.pgp")); err != nil || len(data) != 0 {
+		t.Errorf("expected the file to be overwritten, got %q %v", data, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := transport.Remove("/upload/pro/2024/report-1.pdf.pgp"); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(server.path("/upload/pro/2024/report-1.pdf.pgp")); !os.IsNotExist(err) {
+		t.Errorf("expected the file to be removed, got %v", err)
+	}
+	transport.Close()
+	if server.Connections() != 1 {
+		t.Errorf("expected the control connection to be reused, got %d connections", server.Connections())
+	}
+
+	implicit := newTestFTPSServer(t, true)
+	conf.FTPS.Host = implicit.Addr
+	conf.FTPS.CAFile = implicit.CAFile
+	conf.FTPS.Implicit = true
+	if _, err := NewTransport(context.Background(), conf, nil).PutAs("/report.pgp", strings.NewReader("encrypted"), CollisionOverwrite); err != nil {
+		t.Errorf("implicit TLS: %v", err)
+	}
+
+	for _, broken := range []struct {
+		change   func(*FTPSConfig)
+		expected string
+	}{
+		{func(c *FTPSConfig) { c.Password = "wrong" }, "530"},
+		{func(c *FTPSConfig) { c.CAFile = "" }, "certificate"},
+	} {
+		wrong := *conf
+		broken.change(&wrong.FTPS)
+		if err := NewTransport(context.Background(), &wrong, nil).Check(); err == nil || !strings.Contains(err.Error(), broken.expected) {
+			t.Errorf("expected %q, got %v", broken.expected, err)
+		}
+	}
+	if problems := (&FTPSConfig{Host: "ftp.example.com", Timeout: -1}).problems(); len(problems) != 3 {
+		t.Errorf("unexpected problems %v", problems)
+	}
+}
@@ -0,0 +1,344 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultS3Region  = "us-east-1"
+	DefaultS3Timeout = 300
+	// the most of a reader which cannot seek kept in memory to learn its size, S3 needs the Content-Length
+	maxS3BufferedSize = 64 << 20
+	// the payload hash of the PUTs, the body is streamed and not hashed first
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+type S3Config struct {
+	// https://s3.eu-central-1.amazonaws.com, or the url of an S3-compatible storage like http://minio:9000
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region"`
+	Bucket   string `json:"bucket"`
+	// requests go to endpoint/bucket/key instead of bucket.endpoint/key, most S3-compatible storages need it
+	PathStyle bool   `json:"path_style"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key" secret:"true"`
+	// file holding the secret key
+	SecretKeyFile string `json:"secret_key_file,omitempty"`
+	// temporary credentials
+	SessionToken string `json:"session_token,omitempty" secret:"true"`
+	// seconds per request including the upload of the file, default 300
+	Timeout int `json:"timeout,omitempty"`
+}
+
+func (c *S3Config) region() string {
+	if len(c.Region) > 0 {
+		return c.Region
+	}
+	return DefaultS3Region
+}
+
+func (c *S3Config) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Second
+	}
+	return DefaultS3Timeout * time.Second
+}
+
+func (c *S3Config) host() string {
+	return "s3://" + c.Bucket
+}
+
+// s3Transport puts each file as one object, the remote path without its leading / is the key
+type s3Transport struct {
+	config *S3Config
+	ctx    context.Context
+	client *http.Client
+	now    func() time.Time
+}
+
+func newS3Transport(ctx context.Context, conf *S3Config) *s3Transport {
+	return &s3Transport{
+		config: conf,
+		ctx:    ctx,
+		client: &http.Client{Timeout: conf.timeout()},
+		now:    time.Now,
+	}
+}
+
+func (t *s3Transport) Host() string {
+	return t.config.host()
+}
+
+func (t *s3Transport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
+
+func (t *s3Transport) PutAs(remotePath string, reader io.Reader, collision string) (string, error) {
+	return observePut(t.ctx, TransportS3, t.Host(), remotePath, func() (string, error) {
+		return putAs(t, remotePath, reader, collision)
+	})
+}
+
+// the bucket exists and the credentials are accepted
+func (t *s3Transport) Check() error {
+	resp, err := t.do(http.MethodHead, "", nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 HEAD bucket %s: %s", t.config.Bucket, resp.Status)
+	}
+	return nil
+}
+
+// objectURL of key, an empty key is the bucket
+func (t *s3Transport) objectURL(key string) (*url.URL, error) {
+	endpoint, err := url.Parse(t.config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	target := &url.URL{Scheme: endpoint.Scheme, Host: endpoint.Host, Path: "/" + key}
+	if t.config.PathStyle {
+		target.Path = "/" + t.config.Bucket + "/" + key
+	} else {
+		target.Host = t.config.Bucket + "." + endpoint.Host
+	}
+	target.RawPath = s3Escape(target.Path)
+	return target, nil
+}
+
+// do sends a request, body is streamed with its size and not signed
+func (t *s3Transport) do(method string, key string, body io.Reader, size int64, header map[string]string) (*http.Response, error) {
+	target, err := t.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	payload := payloadHash(nil)
+	if body != nil {
+		payload = unsignedPayload
+		if size <= 0 {
+			// sent as Content-Length: 0, an empty reader would be chunked
+			body = http.NoBody
+		}
+	}
+	request, err := http.NewRequestWithContext(t.ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil && size > 0 {
+		request.ContentLength = size
+	}
+	for key, value := range header {
+		request.Header.Set(key, value)
+	}
+	if len(t.config.SessionToken) > 0 {
+		request.Header.Set("X-Amz-Security-Token", t.config.SessionToken)
+	}
+	signS3(request, payload, t.config.AccessKey, t.config.SecretKey, t.config.region(), t.now())
+	return t.client.Do(request)
+}
+
+func (t *s3Transport) key(name string) string {
+	return strings.TrimPrefix(name, "/")
+}
+
+func (t *s3Transport) exists(name string) (bool, error) {
+	resp, err := t.do(http.MethodHead, t.key(name), nil, 0, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("s3 HEAD %s: %s", name, resp.Status)
+}
+
+// Remove deletes the object, S3 answers 204 for a missing key too
+func (t *s3Transport) Remove(remotePath string) error {
+	resp, err := t.do(http.MethodDelete, t.key(remotePath), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return fmt.Errorf("s3 DELETE %s: %s", remotePath, resp.Status)
+}
+
+// write streams the object in one PUT, so up to 5GB
+func (t *s3Transport) write(name string, reader io.Reader, overwrite bool) error {
+	body, size, err := sizedReader(reader)
+	if err != nil {
+		return err
+	}
+	header := map[string]string{"Content-Type": "application/pgp-encrypted"}
+	if !overwrite {
+		// refused with 412 when the key exists
+		header["If-None-Match"] = "*"
+	}
+	resp, err := t.do(http.MethodPut, t.key(name), body, size, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return fmt.Errorf("%w: %s", ErrRemoteExists, name)
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 PUT %s: %s %s", name, resp.Status, strings.TrimSpace(string(message)))
+}
+
+// sizedReader returns the bytes left in reader and their number. A reader which cannot seek,
+// e.g. a pipe, is read into memory up to maxS3BufferedSize.
+func sizedReader(reader io.Reader) (io.Reader, int64, error) {
+	if seeker, ok := reader.(io.Seeker); ok {
+		current, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, 0, err
+		}
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, 0, err
+		}
+		_, err = seeker.Seek(current, io.SeekStart)
+		return reader, end - current, err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(reader, maxS3BufferedSize+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(body) > maxS3BufferedSize {
+		return nil, 0, fmt.Errorf("s3: a file which cannot seek must be at most %d bytes", maxS3BufferedSize)
+	}
+	return bytes.NewReader(body), int64(len(body)), nil
+}
+
+// payloadHash is the hex SHA-256 of body, for the X-Amz-Content-Sha256 header
+func payloadHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// signS3 adds the AWS Signature Version 4 of request, signing the host and every header set.
+// payload is the hex SHA-256 of the body or UNSIGNED-PAYLOAD.
+func signS3(request *http.Request, payload string, accessKey string, secretKey string, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payload)
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := new(strings.Builder)
+	for _, name := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := request.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	canonicalQuery := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			canonicalQuery = append(canonicalQuery, strings.ReplaceAll(s3Escape(key)+"="+s3Escape(value), "/", "%2F"))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		s3Escape(request.URL.Path),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape encodes every byte but the unreserved characters and /
+func s3Escape(value string) string {
+	escaped := new(strings.Builder)
+	for _, b := range []byte(value) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || strings.IndexByte("-_.~/", b) >= 0 {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// validate the settings, for Config.Validate
+func (c *S3Config) problems() []string {
+	problems := make([]string, 0)
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || len(endpoint.Host) <= 0 {
+		problems = append(problems, fmt.Sprintf("transport.s3.endpoint %q must be an http(s) url", c.Endpoint))
+	}
+	for _, item := range []struct {
+		name  string
+		value string
+	}{
+		{"transport.s3.bucket", c.Bucket},
+		{"transport.s3.access_key", c.AccessKey},
+		{"transport.s3.secret_key", c.SecretKey},
+	} {
+		if len(strings.TrimSpace(item.value)) <= 0 {
+			problems = append(problems, fmt.Sprintf("%s is required", item.name))
+		}
+	}
+	if c.Timeout < 0 {
+		problems = append(problems, fmt.Sprintf("transport.s3.timeout must be >= 0, got %d", c.Timeout))
+	}
+	return problems
+}
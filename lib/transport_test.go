@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a remoteWriter whose names are created by someone else after the exists check
+type racingWriter struct {
+	taken   map[string]bool
+	raced   map[string]bool
+	written map[string]string
+}
+
+func (w *racingWriter) exists(name string) (bool, error) {
+	return w.taken[name], nil
+}
+
+func (w *racingWriter) write(name string, reader io.Reader, overwrite bool) error {
+	data, _ := ioutil.ReadAll(reader)
+	if !overwrite && w.raced[name] {
+		return ErrRemoteExists
+	}
+	w.written[name] = string(data)
+	return nil
+}
+
+func Test_PutAs(t *testing.T) {
+	writer := &racingWriter{
+		taken:   map[string]bool{"/a/report.pgp": true},
+		raced:   map[string]bool{"/a/report-1.pgp": true},
+		written: make(map[string]string),
+	}
+	written, err := putAs(writer, "/a/report.pgp", strings.NewReader("encrypted"), CollisionSuffix)
+	if err != nil || written != "/a/report-2.pgp" || writer.written[written] != "encrypted" {
+		t.Errorf("expected the data sent again to report-2.pgp, got %s %v %v", written, err, writer.written)
+	}
+	if _, err := putAs(writer, "/a/report-1.pgp", struct{ io.Reader }{strings.NewReader("encrypted")}, CollisionSuffix); !errors.Is(err, ErrRemoteExists) {
+		t.Errorf("a plain reader cannot be sent again, got %v", err)
+	}
+	if _, err := putAs(writer, "/a/report.pgp", strings.NewReader("encrypted"), CollisionFail); !errors.Is(err, ErrRemoteExists) {
+		t.Errorf("expected ErrRemoteExists, got %v", err)
+	}
+	if written, err := putAs(writer, "/a/report.pgp", strings.NewReader("new"), CollisionOverwrite); err != nil || writer.written[written] != "new" {
+		t.Errorf("expected report.pgp to be overwritten, got %v", err)
+	}
+}
+
+func Test_LocalTransport(t *testing.T) {
+	conf := getHealthTestConfig(t, newTestSFTPServer(t))
+	conf.SSH = SSHItem{}
+	conf.Transport = TransportConfig{Type: TransportLocal, Local: LocalConfig{Path: t.TempDir()}}
+	conf.Naming.Collision = CollisionSuffix
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	upload := func() (string, error) {
+		return Upload(context.Background(), conf, nil, nil, &UploadRequest{
+			Filename: "invoice.txt",
+			Reader:   strings.NewReader("plain text"),
+			Key:      getTestPGPKey(t),
+			Deploy:   "pro",
+		})
+	}
+	for _, expected := range []string{"invoice.txt.pgp", "invoice-1.txt.pgp"} {
+		remoteFile, err := upload()
+		if err != nil {
+			t.Log(err)
+			t.Fail()
+			return
+		}
+		if remoteFile != filepath.ToSlash(filepath.Join(conf.Deploy.Production, expected)) {
+			t.Errorf("expected %s, got %s", expected, remoteFile)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(conf.Transport.Local.Path, remoteFile))
+		if err != nil || !strings.Contains(string(data), "BEGIN PGP MESSAGE") {
+			t.Errorf("unexpected file %s %v", remoteFile, err)
+		}
+	}
+	parts, _ := filepath.Glob(filepath.Join(conf.Transport.Local.Path, conf.Deploy.Production, ".*.part"))
+	if len(parts) > 0 {
+		t.Errorf("unexpected partial files %v", parts)
+	}
+	transport := NewTransport(context.Background(), &conf.Transport, &conf.SSH)
+	if err := transport.Check(); err != nil || transport.Host() != conf.Transport.Local.Path {
+		t.Errorf("unexpected check %s %v", transport.Host(), err)
+	}
+
+	conf.Transport = TransportConfig{Type: "nfs"}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.Error(), "transport.type") || strings.Contains(err.Error(), "ssh.host") {
+		t.Errorf("unexpected validation %v", err)
+	}
+	conf.Transport = TransportConfig{}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.Error(), "ssh.host is required") {
+		t.Errorf("expected the sftp transport to need ssh.host, got %v", err)
+	}
+}
+
+func Test_TransportHost(t *testing.T) {
+	ssh := &SSHItem{Host: "sftp.example.com:22"}
+	for _, conf := range []TransportConfig{
+		{},
+		{Type: TransportLocal, Local: LocalConfig{Path: "/mnt/partner"}},
+		{Type: TransportFTPS, FTPS: FTPSConfig{Host: "ftp.example.com:21"}},
+		{Type: TransportS3, S3: S3Config{Bucket: "partner"}},
+		{Type: TransportWebDAV, WebDAV: WebDAVConfig{URL: "https://dav.example.com/files"}},
+	} {
+		transport := NewTransport(context.Background(), &conf, ssh)
+		if host := conf.Host(ssh); host != transport.Host() {
+			t.Errorf("%s: expected %s, got %s", conf.kind(), transport.Host(), host)
+		}
+		transport.Close()
+	}
+}
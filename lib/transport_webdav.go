@@ -0,0 +1,198 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultWebDAVTimeout = 300
+
+type WebDAVConfig struct {
+	// base url, the remote paths are under it, e.g. https://dav.example.com/remote.php/dav/files/pgp
+	URL      string `json:"url"`
+	User     string `json:"user"`
+	Password string `json:"password" secret:"true"`
+	// file holding the password
+	PasswordFile string `json:"password_file,omitempty"`
+	// seconds per request including the upload of the file, default 300
+	Timeout int `json:"timeout,omitempty"`
+}
+
+func (c *WebDAVConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Second
+	}
+	return DefaultWebDAVTimeout * time.Second
+}
+
+func (c *WebDAVConfig) host() string {
+	if base, err := url.Parse(c.URL); err == nil {
+		return base.Host
+	}
+	return c.URL
+}
+
+type webdavTransport struct {
+	config *WebDAVConfig
+	ctx    context.Context
+	client *http.Client
+	// the collections created or found, MKCOL is sent once
+	mu      sync.Mutex
+	folders map[string]bool
+}
+
+func newWebDAVTransport(ctx context.Context, conf *WebDAVConfig) *webdavTransport {
+	return &webdavTransport{
+		config:  conf,
+		ctx:     ctx,
+		client:  &http.Client{Timeout: conf.timeout()},
+		folders: make(map[string]bool),
+	}
+}
+
+func (t *webdavTransport) Host() string {
+	return t.config.host()
+}
+
+func (t *webdavTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
+
+func (t *webdavTransport) PutAs(remotePath string, reader io.Reader, collision string) (string, error) {
+	return observePut(t.ctx, TransportWebDAV, t.Host(), remotePath, func() (string, error) {
+		return putAs(t, remotePath, reader, collision)
+	})
+}
+
+// the base url is a collection the login can read
+func (t *webdavTransport) Check() error {
+	resp, err := t.do("PROPFIND", "/", nil, map[string]string{"Depth": "0"})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return fmt.Errorf("webdav PROPFIND %s: %s", t.config.URL, resp.Status)
+	}
+	return nil
+}
+
+func (t *webdavTransport) do(method string, name string, body io.Reader, header map[string]string) (*http.Response, error) {
+	base, err := url.Parse(t.config.URL)
+	if err != nil {
+		return nil, err
+	}
+	target := base.JoinPath(strings.Split(strings.Trim(name, "/"), "/")...)
+	if strings.HasSuffix(name, "/") {
+		target.Path += "/"
+	}
+	request, err := http.NewRequestWithContext(t.ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.config.User) > 0 {
+		request.SetBasicAuth(t.config.User, t.config.Password)
+	}
+	for key, value := range header {
+		request.Header.Set(key, value)
+	}
+	return t.client.Do(request)
+}
+
+func (t *webdavTransport) exists(name string) (bool, error) {
+	resp, err := t.do(http.MethodHead, name, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("webdav HEAD %s: %s", name, resp.Status)
+}
+
+func (t *webdavTransport) Remove(remotePath string) error {
+	resp, err := t.do(http.MethodDelete, remotePath, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return fmt.Errorf("webdav DELETE %s: %s", remotePath, resp.Status)
+}
+
+// mkcol creates the collections of folder from the top, the existing ones answer 405
+func (t *webdavTransport) mkcol(folder string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	current := "/"
+	for _, part := range strings.Split(strings.Trim(folder, "/"), "/") {
+		if len(part) <= 0 {
+			continue
+		}
+		current = path.Join(current, part) + "/"
+		if t.folders[current] {
+			continue
+		}
+		resp, err := t.do("MKCOL", current, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("webdav MKCOL %s: %s", current, resp.Status)
+		}
+		t.folders[current] = true
+	}
+	return nil
+}
+
+func (t *webdavTransport) write(name string, reader io.Reader, overwrite bool) error {
+	err := t.mkcol(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	header := map[string]string{"Content-Type": "application/pgp-encrypted"}
+	if !overwrite {
+		header["If-None-Match"] = "*"
+	}
+	resp, err := t.do(http.MethodPut, name, reader, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil
+	case http.StatusPreconditionFailed:
+		return fmt.Errorf("%w: %s", ErrRemoteExists, name)
+	}
+	return fmt.Errorf("webdav PUT %s: %s", name, resp.Status)
+}
+
+// validate the settings, for Config.Validate
+func (c *WebDAVConfig) problems() []string {
+	problems := make([]string, 0)
+	base, err := url.Parse(c.URL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || len(base.Host) <= 0 {
+		problems = append(problems, fmt.Sprintf("transport.webdav.url %q must be an http(s) url", c.URL))
+	}
+	if c.Timeout < 0 {
+		problems = append(problems, fmt.Sprintf("transport.webdav.timeout must be >= 0, got %d", c.Timeout))
+	}
+	return problems
+}
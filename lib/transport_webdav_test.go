@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+// a WebDAV server under /dav storing in a temp folder, with basic auth and If-None-Match
+func newTestWebDAVServer(t *testing.T) (*httptest.Server, string) {
+	root := t.TempDir()
+	handler := &webdav.Handler{Prefix: "/dav", FileSystem: webdav.Dir(root), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if user, password, ok := request.BasicAuth(); !ok || user != "tester" || password != "secret" {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if request.Method == http.MethodPut && request.Header.Get("If-None-Match") == "*" {
+			if _, err := os.Stat(filepath.Join(root, strings.TrimPrefix(request.URL.Path, "/dav"))); err == nil {
+				writer.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+		}
+		handler.ServeHTTP(writer, request)
+	}))
+	t.Cleanup(server.Close)
+	return server, root
+}
+
+func Test_WebDAVTransport(t *testing.T) {
+	server, root := newTestWebDAVServer(t)
+	conf := &TransportConfig{Type: TransportWebDAV, WebDAV: WebDAVConfig{URL: server.URL + "/dav", User: "tester", Password: "secret"}}
+	if problems := conf.problems(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	transport := NewTransport(context.Background(), conf, nil)
+	defer transport.Close()
+	if err := transport.Check(); err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+
+	for _, expected := range []string{"/upload/pro/2024/report 1.pdf.pgp", "/upload/pro/2024/report 1-1.pdf.pgp"} {
+		written, err := transport.PutAs("/upload/pro/2024/report 1.pdf.pgp", strings.NewReader("encrypted"), CollisionSuffix)
+		if err != nil || written != expected {
+			t.Errorf("expected %s, got %s %v", expected, written, err)
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(root, expected)); err != nil || string(data) != "encrypted" {
+			t.Errorf("unexpected file %s %q %v", expected, data, err)
+		}
+	}
+	if _, err := transport.PutAs("/upload/pro/2024/report 1.pdf.pgp", strings.NewReader("other"), CollisionFail); !errors.Is(err, ErrRemoteExists) {
+		t.Errorf("expected ErrRemoteExists, got %v", err)
+	}
+	// the server refuses the name taken since the check
+	if err := transport.(*webdavTransport).write("/upload/pro/2024/report 1.pdf.pgp", strings.NewReader("other"), false); !errors.Is(err, ErrRemoteExists) {
+		t.Errorf("expected ErrRemoteExists from the server, got %v", err)
+	}
+	if _, err := transport.PutAs("/upload/pro/2024/report 1.pdf.pgp", strings.NewReader("new"), CollisionOverwrite); err != nil {
+		t.Error(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := transport.Remove("/upload/pro/2024/report 1-1.pdf.pgp"); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "/upload/pro/2024/report 1-1.pdf.pgp")); !os.IsNotExist(err) {
+		t.Errorf("expected the file to be removed, got %v", err)
+	}
+
+	conf.WebDAV.Password = "wrong"
+	if err := NewTransport(context.Background(), conf, nil).Check(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected the login to fail, got %v", err)
+	}
+	if problems := (&WebDAVConfig{URL: "ftp://dav"}).problems(); len(problems) != 1 {
+		t.Errorf("unexpected problems %v", problems)
+	}
+}
@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// UploadRequest is one file encrypted and put on the sftp, by the /upload API and the upload command
+type UploadRequest struct {
+	// file name, the remote file is named after it
+	Filename string
+	Reader   io.Reader
+	// converted to pdf before the encryption
+	Image bool
+	// PGP public key
+	Key string
+	// dev, pro or test
+	Deploy string
+	// checksum of the source, for the audit log
+	Received   *FileResult
+	Caller     string
+	RemoteAddr string
+	// the X-Client-ID header, for the audit log
+	ClaimedClientID string
+}
+
+// IsImageFile tells by the extension whether filename is converted to pdf before the encryption
+func IsImageFile(filename string) bool {
+	ext := filepath.Ext(filename)
+	for _, condition := range []string{"png", "gif", "jpg", "bmp", "jpeg"} {
+		if strings.Contains(ext, condition) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// EncryptSource converts an image to pdf, then encrypts reader with helper.
+// Returns the file name of the plaintext, with .pdf added for images.
+func EncryptSource(ctx context.Context, conf *Config, scheduler *Scheduler, helper *PGPHelper, filename string, image bool, reader io.Reader) (_ *bytes.Buffer, _ string, err error) {
+	logger := Logger(ctx)
+	if image {
+		_, span := startSpan(ctx, "pdf.convert", attribute.String("file.name", filename))
+		reader, err = getPDFBytes(reader, conf.TempPath)
+		endSpan(span, err)
+		if err != nil {
+			logger.Error(err)
+			return nil, "", err
+		}
+		filename = filename + ".pdf"
+	}
+
+	var buffer *bytes.Buffer
+	encrypt := func() (err error) {
+		buffer, err = helper.WithContext(ctx).Encrypt(reader)
+		return
+	}
+	if scheduler != nil {
+		err = scheduler.Do(StageEncrypt, encrypt)
+	} else {
+		err = encrypt()
+	}
+	if err != nil {
+		logger.Error(err)
+		return nil, "", err
+	}
+	return buffer, filename, nil
+}
+
+// Upload encrypts the file of req and puts it into the deploy path on the sftp, recording it in audit.
+// Returns the remote path.
+func Upload(ctx context.Context, conf *Config, scheduler *Scheduler, audit *AuditLog, req *UploadRequest) (remoteFile string, err error) {
+	logger := Logger(ctx)
+	entry := &AuditEntry{
+		Started:         time.Now(),
+		Caller:          req.Caller,
+		RemoteAddr:      req.RemoteAddr,
+		ClaimedClientID: req.ClaimedClientID,
+		RequestID:       RequestIDFromContext(ctx),
+		Filename:        req.Filename,
+		Host:            conf.Transport.Host(&conf.SSH),
+	}
+	if req.Received != nil {
+		entry.PlaintextSHA256 = req.Received.SHA256
+	}
+	defer func() {
+		entry.Finished = time.Now()
+		entry.Outcome, entry.Error = auditOutcome(err)
+		// a delivery without its audit entry fails
+		recordErr := audit.Record(entry)
+		if recordErr != nil {
+			logger.Error(recordErr)
+			err = errors.Join(err, recordErr)
+		}
+	}()
+
+	logger.Info("filename:", req.Filename)
+	helper, err := NewPGPHelper(strings.NewReader(req.Key))
+	if err != nil {
+		logger.Error(err)
+		return "", err
+	}
+	entry.Recipients = helper.Fingerprints()
+	buffer, filename, err := EncryptSource(ctx, conf, scheduler, helper, req.Filename, req.Image, req.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	vars := &NameVars{
+		Name:   filename,
+		Env:    req.Deploy,
+		JobID:  JobIDFromContext(ctx),
+		Seq:    1,
+		Caller: req.Caller,
+		Time:   entry.Started,
+	}
+	if len(vars.JobID) <= 0 {
+		vars.JobID = RequestIDFromContext(ctx)
+	}
+	if req.Received != nil {
+		vars.SHA256 = req.Received.SHA256
+	}
+	remoteFile, err = conf.Naming.RemotePath(conf.GetDeployPath(req.Deploy), vars)
+	if err != nil {
+		logger.Error(err)
+		return "", err
+	}
+	entry.RemotePath = remoteFile
+	if ciphertext, err := ChecksumReader(remoteFile, bytes.NewReader(buffer.Bytes())); err == nil {
+		entry.CiphertextSHA256 = ciphertext.SHA256
+	}
+	transport := NewTransport(ctx, &conf.Transport, &conf.SSH)
+	defer transport.Close()
+	put := func() error {
+		// seekable, a retry continues the partial file
+		written, err := transport.PutAs(remoteFile, bytes.NewReader(buffer.Bytes()), conf.Naming.collision())
+		if err == nil {
+			remoteFile = written
+			entry.RemotePath = written
+		}
+		return err
+	}
+	if scheduler != nil {
+		err = scheduler.Do(StageUpload, put)
+	} else {
+		err = put()
+	}
+	if err != nil {
+		logger.Error(err)
+		return "", err
+	}
+	return remoteFile, nil
+}
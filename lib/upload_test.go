@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_UploadRequest(t *testing.T) {
+	server := newTestSFTPServer(t)
+	conf := getHealthTestConfig(t, server)
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	audit := NewAuditLog(auditPath)
+	if err := audit.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	remoteFile, err := Upload(context.Background(), conf, nil, audit, &UploadRequest{
+		Filename: "report.txt",
+		Reader:   strings.NewReader("plain text"),
+		Key:      getTestPGPKey(t),
+		Deploy:   "pro",
+		Caller:   "cli",
+	})
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	if remoteFile != filepath.Join(conf.Deploy.Production, "report.txt.pgp") {
+		t.Errorf("unexpected remote file %s", remoteFile)
+	}
+	data, err := os.ReadFile(remoteFile)
+	if err != nil || !strings.Contains(string(data), "BEGIN PGP MESSAGE") {
+		t.Errorf("remote file not encrypted: %v", err)
+	}
+	if count, _, err := VerifyAuditLog(auditPath); err != nil || count != 1 {
+		t.Errorf("expected one audit entry, got %d %v", count, err)
+	}
+
+	_, err = Upload(context.Background(), conf, nil, audit, &UploadRequest{
+		Filename: "report.txt",
+		Reader:   strings.NewReader("plain text"),
+		Key:      "not a key",
+		Deploy:   "pro",
+	})
+	if err == nil {
+		t.Errorf("expected an error for an invalid key")
+	}
+}
+
+func Test_RunJob(t *testing.T) {
+	files := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("plain text"))
+	}))
+	defer files.Close()
+	server := newTestSFTPServer(t)
+	conf := getHealthTestConfig(t, server)
+	conf.Download = DownloadConfig{AllowPrivate: true, Timeout: 5}
+
+	body := &MultipleBody{Files: []*ZurichFile{{Name: "a.txt", Url: files.URL + "/a.txt"}}, PGPKey: getTestPGPKey(t), ENV: "dev"}
+	if err := body.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	result := RunJob(context.Background(), conf, body, "cli", nil)
+	if !result.Status || len(result.Files) != 1 || len(result.ID) <= 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(conf.Deploy.Development, "a.txt.pgp")); err != nil {
+		t.Error(err)
+	}
+	if len(result.Files) == 1 && result.Files[0].Remote != filepath.Join(conf.Deploy.Development, "a.txt.pgp") {
+		t.Errorf("unexpected remote %s", result.Files[0].Remote)
+	}
+
+	if err := (&MultipleBody{PGPKey: "key", ENV: "dev"}).Validate(); err == nil {
+		t.Errorf("expected an error for an empty file list")
+	}
+}
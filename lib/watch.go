@@ -0,0 +1,343 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	DefaultWatchPollInterval = 2
+	DefaultWatchStableTime   = 5
+	watchDoneFolder          = "done"
+	watchFailedFolder        = "failed"
+	watchResultSuffix        = ".result.json"
+)
+
+type WatchConfig struct {
+	// local folders whose files are encrypted and uploaded
+	Folders []WatchFolder `json:"folders"`
+	// seconds between scans of the folders, default 2; fsnotify events scan at once
+	PollInterval int `json:"poll_interval"`
+	// seconds the size and modification time of a file must stay the same before it is picked up, default 5
+	StableTime int `json:"stable_time"`
+}
+
+type WatchFolder struct {
+	Path string `json:"path"`
+	// sftp remote save folder: dev, pro or test
+	Env string `json:"env"`
+	// PGP public key file
+	KeyFile string `json:"key_file"`
+}
+
+func (c *WatchConfig) pollInterval() time.Duration {
+	if c.PollInterval > 0 {
+		return time.Duration(c.PollInterval) * time.Second
+	}
+	return DefaultWatchPollInterval * time.Second
+}
+
+func (c *WatchConfig) stableTime() time.Duration {
+	if c.StableTime > 0 {
+		return time.Duration(c.StableTime) * time.Second
+	}
+	return DefaultWatchStableTime * time.Second
+}
+
+// WatchResult is written next to the file moved to done/ or failed/, as <name>.result.json
+type WatchResult struct {
+	ServiceResult
+	Folder   string    `json:"folder"`
+	Remote   string    `json:"remote,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// a file seen in a folder, picked up once it stops changing
+type watchCandidate struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// Watcher delivers the files dropped into the watch folders through the /upload pipeline,
+// then moves them to done/ or failed/ with a result file
+type Watcher struct {
+	conf       *Config
+	scheduler  *Scheduler
+	audit      *AuditLog
+	candidates map[string]*watchCandidate
+	mu         sync.Mutex
+	processing map[string]bool
+	wg         sync.WaitGroup
+	now        func() time.Time
+}
+
+func NewWatcher(conf *Config, scheduler *Scheduler, audit *AuditLog) *Watcher {
+	return &Watcher{
+		conf:       conf,
+		scheduler:  scheduler,
+		audit:      audit,
+		candidates: make(map[string]*watchCandidate),
+		processing: make(map[string]bool),
+		now:        time.Now,
+	}
+}
+
+// Run watches the folders until ctx is done, files being delivered then are finished by Wait
+func (w *Watcher) Run(ctx context.Context) error {
+	folders := w.conf.Watch.Folders
+	if len(folders) <= 0 {
+		return nil
+	}
+	for _, folder := range folders {
+		for _, sub := range []string{watchDoneFolder, watchFailedFolder} {
+			err := os.MkdirAll(filepath.Join(folder.Path, sub), os.ModePerm)
+			if err != nil {
+				log.Error(err)
+				return err
+			}
+		}
+	}
+
+	events := w.notify(ctx, folders)
+	ticker := time.NewTicker(w.conf.Watch.pollInterval())
+	defer ticker.Stop()
+	log.Infof("watching %d folders", len(folders))
+	for {
+		w.scan(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-events:
+		}
+	}
+}
+
+// notify signals changes in the folders, nil when fsnotify is not available and only the polling is left
+func (w *Watcher) notify(ctx context.Context, folders []WatchFolder) <-chan struct{} {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Warningf("fsnotify unavailable, polling the watch folders: %s", err)
+		return nil
+	}
+	for _, folder := range folders {
+		err = watcher.Add(folder.Path)
+		if err != nil {
+			// e.g. network shares
+			log.Warningf("fsnotify cannot watch %s, polling it: %s", folder.Path, err)
+		}
+	}
+
+	changed := make(chan struct{}, 1)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Warning(err)
+			}
+		}
+	}()
+	return changed
+}
+
+// scan picks up the files which did not change for watch.stable_time
+func (w *Watcher) scan(ctx context.Context) {
+	now := w.now()
+	seen := make(map[string]bool)
+	for _, folder := range w.conf.Watch.Folders {
+		entries, err := ioutil.ReadDir(folder.Path)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		for _, info := range entries {
+			// skip the sub folders, hidden and partial files
+			name := info.Name()
+			if !info.Mode().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".tmp") || strings.HasSuffix(name, ".part") {
+				continue
+			}
+			filePath := filepath.Join(folder.Path, name)
+			seen[filePath] = true
+			if w.stable(filePath, info, now) {
+				w.deliver(ctx, folder, filePath)
+			}
+		}
+	}
+	for filePath := range w.candidates {
+		if !seen[filePath] {
+			delete(w.candidates, filePath)
+		}
+	}
+}
+
+func (w *Watcher) stable(filePath string, info os.FileInfo, now time.Time) bool {
+	candidate, ok := w.candidates[filePath]
+	if !ok || candidate.size != info.Size() || !candidate.modTime.Equal(info.ModTime()) {
+		w.candidates[filePath] = &watchCandidate{size: info.Size(), modTime: info.ModTime(), since: now}
+		return false
+	}
+	return now.Sub(candidate.since) >= w.conf.Watch.stableTime()
+}
+
+func (w *Watcher) deliver(ctx context.Context, folder WatchFolder, filePath string) {
+	w.mu.Lock()
+	if w.processing[filePath] || ctx.Err() != nil {
+		w.mu.Unlock()
+		return
+	}
+	w.processing[filePath] = true
+	w.wg.Add(1)
+	w.mu.Unlock()
+
+	go func() {
+		defer func() {
+			w.mu.Lock()
+			delete(w.processing, filePath)
+			w.mu.Unlock()
+			w.wg.Done()
+		}()
+		w.process(folder, filePath)
+	}()
+}
+
+// Wait for the files being delivered, until ctx is done
+func (w *Watcher) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// process uploads one file and moves it with its result file, the file stays when it cannot be moved
+func (w *Watcher) process(folder WatchFolder, filePath string) {
+	name := filepath.Base(filePath)
+	ctx := WithJobID(context.Background(), "watch-"+name)
+	logger := Logger(ctx)
+	logger.Infof("watch folder %s: delivering %s", folder.Path, name)
+	result := &WatchResult{Folder: folder.Path, Started: w.now()}
+
+	var err error
+	result.Remote, result.Files, err = w.upload(ctx, folder, filePath)
+	result.Finished = w.now()
+	result.Status = err == nil
+	target := watchDoneFolder
+	if err != nil {
+		logger.Errorf("watch folder %s: %s failed: %s", folder.Path, name, err)
+		result.Error = err.Error()
+		target = watchFailedFolder
+	}
+
+	moved, err := moveAside(filePath, filepath.Join(folder.Path, target))
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	data, _ := json.MarshalIndent(result, "", "\t")
+	err = ioutil.WriteFile(moved+watchResultSuffix, data, 0644)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func (w *Watcher) upload(ctx context.Context, folder WatchFolder, filePath string) (string, []*FileResult, error) {
+	key, err := ioutil.ReadFile(folder.KeyFile)
+	if err != nil {
+		return "", nil, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+	received, err := ChecksumReader(filepath.Base(filePath), file)
+	if err != nil {
+		return "", nil, err
+	}
+	files := []*FileResult{received}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", files, err
+	}
+
+	remote, err := Upload(ctx, w.conf, w.scheduler, w.audit, &UploadRequest{
+		Filename: filepath.Base(filePath),
+		Reader:   file,
+		Image:    IsImageFile(filePath),
+		Key:      string(key),
+		Deploy:   folder.Env,
+		Received: received,
+		Caller:   "watch:" + folder.Path,
+	})
+	return remote, files, err
+}
+
+// moveAside moves filePath into dir, a file of the same name there is kept by adding a timestamp
+func moveAside(filePath string, dir string) (string, error) {
+	target := filepath.Join(dir, filepath.Base(filePath))
+	if _, err := os.Stat(target); err == nil {
+		ext := filepath.Ext(target)
+		target = fmt.Sprintf("%s-%s%s", strings.TrimSuffix(target, ext), time.Now().Format("20060102150405.000000000"), ext)
+	}
+	err := os.Rename(filePath, target)
+	if err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// validate the watch folders, for Config.Validate
+func (c *WatchConfig) problems() []string {
+	problems := make([]string, 0)
+	for i, folder := range c.Folders {
+		name := fmt.Sprintf("watch.folders[%d]", i)
+		if info, err := os.Stat(folder.Path); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("%s.path %q must be a folder", name, folder.Path))
+		}
+		switch folder.Env {
+		case "dev", "pro", "test":
+		default:
+			problems = append(problems, fmt.Sprintf("%s.env must be dev, pro or test, got %q", name, folder.Env))
+		}
+		if _, err := os.Stat(folder.KeyFile); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.key_file: %s", name, errors.Unwrap(err)))
+		}
+	}
+	if c.PollInterval < 0 || c.StableTime < 0 {
+		problems = append(problems, "watch.poll_interval and watch.stable_time must be >= 0")
+	}
+	return problems
+}
@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_WatchFolder(t *testing.T) {
+	server := newTestSFTPServer(t)
+	conf := getHealthTestConfig(t, server)
+	folder := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "public.asc")
+	writeTestFile(t, keyFile, getTestPGPKey(t))
+	badKeyFile := filepath.Join(t.TempDir(), "bad.asc")
+	writeTestFile(t, badKeyFile, "not a key")
+	failing := t.TempDir()
+	conf.Watch = WatchConfig{
+		Folders: []WatchFolder{
+			{Path: folder, Env: "pro", KeyFile: keyFile},
+			{Path: failing, Env: "dev", KeyFile: badKeyFile},
+		},
+		StableTime: 5,
+	}
+	if problems := conf.Watch.problems(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+
+	watcher := NewWatcher(conf, NewScheduler(&conf.Concurrency), nil)
+	now := time.Now()
+	watcher.now = func() time.Time {
+		return now
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// creates done/ and failed/, then stops at the cancelled ctx
+	if err := watcher.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, filepath.Join(folder, "report.txt"), "plain text")
+	writeTestFile(t, filepath.Join(folder, ".hidden"), "skipped")
+	writeTestFile(t, filepath.Join(failing, "report.txt"), "plain text")
+	watcher.scan(context.Background())
+	now = now.Add(2 * time.Second)
+	watcher.scan(context.Background())
+	watcher.Wait(context.Background())
+	if _, err := os.Stat(filepath.Join(folder, "report.txt")); err != nil {
+		t.Errorf("file picked up before it was stable: %v", err)
+	}
+
+	now = now.Add(5 * time.Second)
+	watcher.scan(context.Background())
+	watcher.Wait(context.Background())
+
+	if _, err := os.Stat(filepath.Join(conf.Deploy.Production, "report.txt.pgp")); err != nil {
+		t.Error(err)
+	}
+	result := &WatchResult{}
+	data, err := ioutil.ReadFile(filepath.Join(folder, watchDoneFolder, "report.txt"+watchResultSuffix))
+	if err == nil {
+		err = json.Unmarshal(data, result)
+	}
+	if err != nil || !result.Status || len(result.Files) != 1 || result.Remote != filepath.Join(conf.Deploy.Production, "report.txt.pgp") {
+		t.Errorf("unexpected result %+v %v", result, err)
+	}
+	if _, err := os.Stat(filepath.Join(folder, ".hidden")); err != nil {
+		t.Errorf("hidden file should stay: %v", err)
+	}
+
+	result = &WatchResult{}
+	data, err = ioutil.ReadFile(filepath.Join(failing, watchFailedFolder, "report.txt"+watchResultSuffix))
+	if err == nil {
+		err = json.Unmarshal(data, result)
+	}
+	if err != nil || result.Status || len(result.Error) <= 0 {
+		t.Errorf("unexpected failed result %+v %v", result, err)
+	}
+	if _, err := os.Stat(filepath.Join(failing, watchFailedFolder, "report.txt")); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_MoveAside(t *testing.T) {
+	dir := t.TempDir()
+	done := filepath.Join(dir, "done")
+	os.MkdirAll(done, os.ModePerm)
+	writeTestFile(t, filepath.Join(done, "a.pdf"), "first")
+	writeTestFile(t, filepath.Join(dir, "a.pdf"), "second")
+
+	moved, err := moveAside(filepath.Join(dir, "a.pdf"), done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == filepath.Join(done, "a.pdf") || filepath.Ext(moved) != ".pdf" {
+		t.Errorf("existing file would be replaced by %s", moved)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(done, "a.pdf")); string(data) != "first" {
+		t.Errorf("existing file was changed")
+	}
+}
@@ -1,15 +1,22 @@
 package lib
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // swagger:model
@@ -19,6 +26,15 @@ type ZurichFile struct {
 	Path string
 	// required: true
 	Url string `json:"url"`
+	// expected SHA-256 (hex) of the remote file
+	SHA256 string `json:"sha256,omitempty"`
+	// expected size in bytes of the remote file
+	Size       int64 `json:"size,omitempty"`
+	received   *FileResult
+	remotePath string
+	delivered  bool
+	// remotePath did not exist before the upload, a roll back may remove it
+	created bool
 }
 
 type Zurich struct {
@@ -30,112 +46,331 @@ type Zurich struct {
 	pgpKey      string
 	pgpFiles    []*ZurichFile
 	deployENV   string
+	downloader  *Downloader
+	scheduler   *Scheduler
+	result      ServiceResult
+	ctx         context.Context
+	audit       *AuditLog
+	caller      string
+	remoteAddr  string
+	requestID   string
+	// the X-Client-ID header, for the audit log
+	claimedClientID string
+	// remote paths of the uploaded manifests
+	manifests []string
+	// the manifests which replaced a file that existed before, kept by a roll back
+	replacedManifests map[string]bool
+	// zip or tar.gz to upload all files in one archive
+	packageFormat string
+	// MultipleBody.Destinations, empty for the default destination only
+	destinations []*DestinationRequest
+	// MultipleBody.Delivery, all or best_effort
+	delivery string
+	// a copy of the job for each of destinations, see forDestination
+	deliveries []*Zurich
+	// name of the destination of a copy
+	destination string
+	// error of the delivery to destination
+	err        error
+	rolledBack bool
 }
 
 func NewZurich(conf *Config, files []*ZurichFile, publicKey string, ENV string, notifyUrl string) *Zurich {
+	prefixPath := fmt.Sprintf("%d", rand.Int63())
 	return &Zurich{
 		conf:        conf,
 		Files:       files,
 		NotifyUrl:   notifyUrl,
-		prefixPath:  fmt.Sprintf("%d", rand.Int63()),
+		prefixPath:  prefixPath,
 		pgpKey:      publicKey,
 		notifyTries: 2,
 		pgpFiles:    make([]*ZurichFile, len(files)),
 		deployENV:   ENV,
+		downloader:  NewDownloader(&conf.Download),
+		scheduler:   NewScheduler(&conf.Concurrency),
+		ctx:         WithJobID(context.Background(), prefixPath),
 	}
 }
 
-//准备相关文件
-func (this *Zurich) prepareFile() (err error) {
-	log.Info("prepare Files")
-	queue := make(chan bool, 0)
-	counter := 0
-	defer close(queue)
-
-	for i, item := range this.Files {
-		counter++
-		
-		go func(i int, item *ZurichFile) {
-			defer func() {
-				queue <- true
-			}()
-			
-			this.Files[i], err = this.DownloadRemoteFile(item)
-		}(i, item)
-	}
-	
-	for <-queue {
-		counter--
-		log.Debug("total queue:", counter)
-		
-		if counter <= 0 {
-			break
-		}
+// 在当前goroutine中执行整个任务，不经过队列，用于 batch 命令
+func RunJob(ctx context.Context, conf *Config, body *MultipleBody, caller string, audit *AuditLog) *ServiceResult {
+	z := NewZurich(conf, body.Files, body.PGPKey, body.ENV, body.NotifyURL)
+	z.caller = caller
+	z.audit = audit
+	z.withOptions(body)
+	z.WithContext(ctx)
+	z.Process()
+	return z.Result()
+}
+
+// 从关机时保存的任务恢复，保留原来的任务ID
+func NewZurichFromPending(conf *Config, job *PendingJob) *Zurich {
+	z := NewZurich(conf, requestFiles(job.Files), job.PGPKey, job.ENV, job.NotifyURL)
+	z.prefixPath = job.ID
+	z.caller = job.Caller
+	z.remoteAddr = job.RemoteAddr
+	z.claimedClientID = job.ClaimedClientID
+	z.withOptions(&job.MultipleBody)
+	return z.WithContext(WithRequestID(context.Background(), job.RequestID))
+}
+
+// Pending 返回可以保存并在重启后恢复的任务
+func (this *Zurich) Pending() *PendingJob {
+	return &PendingJob{
+		MultipleBody: MultipleBody{
+			Files:        requestFiles(this.Files),
+			PGPKey:       this.pgpKey,
+			ENV:          this.deployENV,
+			NotifyURL:    this.NotifyUrl,
+			Package:      this.packageFormat,
+			Destinations: this.destinations,
+			Delivery:     this.delivery,
+		},
+		ID:              this.ID(),
+		Caller:          this.caller,
+		RemoteAddr:      this.remoteAddr,
+		ClaimedClientID: this.claimedClientID,
+		RequestID:       this.requestID,
 	}
-	
-	return nil
+}
+
+// withOptions takes the package and the destinations of body
+func (this *Zurich) withOptions(body *MultipleBody) *Zurich {
+	this.packageFormat = body.Package
+	this.destinations = body.Destinations
+	this.delivery = body.Delivery
+	return this
+}
+
+// 只保留请求中的字段，去掉下载后的本地信息
+func requestFiles(files []*ZurichFile) []*ZurichFile {
+	result := make([]*ZurichFile, 0, len(files))
+	for _, zFile := range files {
+		result = append(result, &ZurichFile{
+			Name:   zFile.Name,
+			Url:    zFile.Url,
+			SHA256: zFile.SHA256,
+			Size:   zFile.Size,
+		})
+	}
+	return result
+}
+
+// WithContext keeps the values of ctx (e.g. the request id) for logging, not its cancellation
+func (this *Zurich) WithContext(ctx context.Context) *Zurich {
+	this.ctx = WithJobID(context.WithoutCancel(ctx), this.ID())
+	this.requestID = RequestIDFromContext(ctx)
+	return this
+}
+
+func (this *Zurich) logger() *ContextLogger {
+	return Logger(this.ctx)
+}
+
+//准备相关文件
+func (this *Zurich) prepareFile() error {
+	this.logger().Info("prepare Files")
+
+	ctx, span := startSpan(this.ctx, "stage.download", attribute.Int("job.files", len(this.Files)))
+	err := this.scheduler.Run(StageDownload, len(this.Files), func(i int) error {
+		_, err := this.downloadFile(ctx, this.Files[i])
+		return err
+	})
+	endSpan(span, err)
+	return err
 }
 
 func (this *Zurich) Process() {
 	defer this.ClearAllFiles()
-	
-	err := this.prepareFile()
+
+	var span trace.Span
+	this.ctx, span = startSpan(this.ctx, "job",
+		attribute.String("job.id", this.ID()),
+		attribute.String("job.env", this.deployENV),
+		attribute.Int("job.files", len(this.Files)))
+	defer span.End()
+
+	started := time.Now()
+	err := this.run()
+	err = errors.Join(err, this.recordAudit(started, err))
 	if err != nil {
-		log.Error(err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		this.logger().Error(err)
+		this.result.Error = err.Error()
 		return
 	}
-	
-	err = this.EncryptFiles()
+	this.result.Status = true
+
+	if len(this.NotifyUrl) > 0 {
+		this.notifyRemote(this.NotifyUrl)
+	}
+}
+
+func (this *Zurich) run() error {
+	err := this.prepareFile()
 	if err != nil {
-		log.Error(err)
-		return
+		return err
 	}
 
-	this.UploadToSFTP()
+	if len(this.destinations) > 0 {
+		return this.fanOut()
+	}
+	return this.deliver()
+}
 
-	if len(this.NotifyUrl) > 0 {
-		this.notifyRemote(this.NotifyUrl)
+//加密并上传文件及索引文件
+func (this *Zurich) deliver() error {
+	err := this.uploadFiles()
+	if err != nil || len(this.packageFormat) > 0 {
+		return err
+	}
+	return this.UploadManifest()
+}
+
+func (this *Zurich) uploadFiles() error {
+	if len(this.packageFormat) > 0 {
+		return this.UploadPackage()
+	}
+
+	err := this.EncryptFiles()
+	if err != nil {
+		return err
+	}
+
+	return this.UploadToSFTP()
+}
+
+func (this *Zurich) ID() string {
+	return this.prefixPath
+}
+
+// Result of the last Process, with the checksums of all received files
+func (this *Zurich) Result() *ServiceResult {
+	result := this.result
+	result.ID = this.ID()
+	result.Manifests = this.manifests
+	for _, delivery := range this.deliveries {
+		result.Destinations = append(result.Destinations, delivery.destinationResult())
+	}
+	result.Files = make([]*FileResult, 0, len(this.Files))
+	for index, zFile := range this.Files {
+		if zFile.received != nil {
+			file := *zFile.received
+			if pgpFile := this.pgpFiles[index]; pgpFile != nil && pgpFile.delivered {
+				file.Remote = pgpFile.remotePath
+			}
+			result.Files = append(result.Files, &file)
+		}
+	}
+	return &result
+}
+
+//记录每个文件的审计日志，写不进审计日志的投递算作失败
+func (this *Zurich) recordAudit(started time.Time, jobErr error) error {
+	if this.audit == nil {
+		return nil
+	}
+	if len(this.deliveries) > 0 {
+		var errs []error
+		for _, delivery := range this.deliveries {
+			err := delivery.recordAudit(started, delivery.err)
+			if err != nil {
+				delivery.err = errors.Join(delivery.err, err)
+				errs = append(errs, fmt.Errorf("destination %s: %w", delivery.destination, err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+	var recipients []string
+	if helper, err := NewPGPHelper(strings.NewReader(this.pgpKey)); err == nil {
+		recipients = helper.Fingerprints()
+	}
+
+	finished := time.Now()
+	var errs []error
+	for index, zFile := range this.Files {
+		entry := &AuditEntry{
+			Started:         started,
+			Finished:        finished,
+			Caller:          this.caller,
+			RemoteAddr:      this.remoteAddr,
+			ClaimedClientID: this.claimedClientID,
+			RequestID:       RequestIDFromContext(this.ctx),
+			JobID:           this.ID(),
+			Filename:        zFile.Name,
+			Recipients:      recipients,
+			Host:            this.conf.Transport.Host(&this.conf.SSH),
+			Destination:     this.destination,
+			Outcome:         "failure",
+		}
+		if zFile.received != nil {
+			entry.PlaintextSHA256 = zFile.received.SHA256
+		}
+		if pgpFile := this.pgpFiles[index]; pgpFile != nil {
+			if pgpFile.received != nil {
+				entry.CiphertextSHA256 = pgpFile.received.SHA256
+			}
+			entry.RemotePath = pgpFile.remotePath
+			if pgpFile.delivered {
+				entry.Outcome = "success"
+			}
+		}
+		if entry.Outcome != "success" {
+			entry.Error = "not delivered"
+			if jobErr != nil {
+				entry.Error = jobErr.Error()
+			}
+		}
+		err := this.audit.Record(entry)
+		if err != nil {
+			this.logger().Error(err)
+			errs = append(errs, fmt.Errorf("%s: %w", zFile.Name, err))
+		}
 	}
+	return errors.Join(errs...)
 }
 
 //下载远程文件
 func (this *Zurich) DownloadRemoteFile(zFile *ZurichFile) (localFile *ZurichFile, err error) {
-	log.Info("begin download file, url:", zFile.Url)
+	return this.downloadFile(this.ctx, zFile)
+}
+
+func (this *Zurich) downloadFile(ctx context.Context, zFile *ZurichFile) (localFile *ZurichFile, err error) {
+	this.logger().Info("begin download file, url:", redactURL(zFile.Url))
 
 	basePath := filepath.Join(this.conf.TempPath, this.prefixPath)
 
 	if _, err := os.Stat(basePath); err != nil && os.IsNotExist(err) {
 		os.MkdirAll(basePath, os.ModePerm)
 	}
-	localPath := filepath.Join(basePath, zFile.Name)
+	localPath := filepath.Join(basePath, filepath.Base(zFile.Name))
 
-	file, err := os.Create(localPath)
+	err = this.downloader.Download(ctx, zFile.Url, localPath)
 	if err != nil {
-		log.Error(err)
-		return
+		this.logger().Error(err)
+		return nil, fmt.Errorf("download %s: %w", zFile.Name, err)
 	}
-	defer file.Close()
 
-	resp, err := http.Get(zFile.Url)
+	received, err := ChecksumFile(zFile.Name, localPath)
 	if err != nil {
-		log.Error(err)
-		return
+		this.logger().Error(err)
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	_, err = io.Copy(file, resp.Body)
+	err = received.Verify(zFile.SHA256, zFile.Size)
 	if err != nil {
-		log.Error(err)
-		return
+		this.logger().Error(err)
+		return nil, err
 	}
 
 	zFile.Path = localPath
+	zFile.received = received
 	return zFile, nil
 }
 
 //清理所有文件夹
 func (this *Zurich) ClearAllFiles() {
-	log.Info("begin clear all files")
+	this.logger().Info("begin clear all files")
 
 	os.RemoveAll(filepath.Join(this.conf.TempPath, this.prefixPath))
 }
@@ -146,134 +381,211 @@ func (this *Zurich) notifyRemote(remoteURL string) {
 		return
 	}
 	this.notifyTries--
-	log.Info("begin notify")
+	this.logger().Info("begin notify")
 
-	resp, err := http.Get(this.NotifyUrl)
+	ctx, span := startSpan(this.ctx, "notify", attribute.String("url.full", redactURL(remoteURL)))
+	var err error
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	notifyURL, err := this.notifyURL(remoteURL)
+	if err != nil {
+		this.logger().Error(err)
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, notifyURL, nil)
 	if err != nil {
-		log.Error(err)
+		this.logger().Error(err)
 		return
 	}
+	injectTrace(ctx, req.Header)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		notifyAttempts.WithLabelValues("error").Inc()
+		this.logger().Error(err)
+		return
+	}
+	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Error(err)
+		notifyAttempts.WithLabelValues("error").Inc()
+		this.logger().Error(err)
 		return
 	}
 	//	log.Info("notify response:", string(body))
 	//检查通知返回是否正确
 	if !strings.EqualFold(string(body), "success") {
+		notifyAttempts.WithLabelValues("rejected").Inc()
+		err = fmt.Errorf("notify rejected: %s", resp.Status)
 		//一分钟后重试通知
 		time.AfterFunc(time.Minute*1, func() {
-			log.Info("retry notify:", remoteURL)
+			this.logger().Info("retry notify:", remoteURL)
 			this.notifyRemote(remoteURL)
 		})
+		return
+	}
+	notifyAttempts.WithLabelValues("success").Inc()
+}
+
+// notifyURL adds the job id and, in the order of the request, the file, sha256 and size of each
+// received file to the query of remoteURL
+func (this *Zurich) notifyURL(remoteURL string) (string, error) {
+	target, err := url.Parse(remoteURL)
+	if err != nil {
+		return "", err
+	}
+	query := target.Query()
+	query.Set("id", this.ID())
+	for _, zFile := range this.Files {
+		if zFile.received == nil {
+			continue
+		}
+		query.Add("file", zFile.received.Name)
+		query.Add("sha256", zFile.received.SHA256)
+		query.Add("size", strconv.FormatInt(zFile.received.Size, 10))
 	}
+	target.RawQuery = query.Encode()
+	return target.String(), nil
 }
 
 //加密索引文件及打包文件
-func (this *Zurich) EncryptFiles() (err error) {
-	log.Info("begin encrypt files")
-	queue := make(chan bool, 0)
-	counter := 0
-	defer close(queue)
+func (this *Zurich) EncryptFiles() error {
+	this.logger().Info("begin encrypt files")
 
-	for index, zFile := range this.Files {
-		counter++
-		
-		go func(index int, zFile *ZurichFile) {
-			defer func() {
-				queue <- true
-			}()
-			
-			log.Debug("begin encrypt file:", zFile.Name)
-			
-			var src []byte
-			var err error
-			//检查是否图片
-			if this.isImage(zFile.Path) {
-				//将图片转换成PDF
-				pdfFileName := zFile.Path + ".pdf"
-				src, err = GetPDF(zFile.Path)
-				if err != nil {
-					log.Error(err)
-				}
-				zFile.Path = pdfFileName
-			} else {
-				src, err = ioutil.ReadFile(zFile.Path)
-				if err != nil {
-					log.Error(err)
-				}
-			}
-			keyReader := strings.NewReader(this.pgpKey)
-			
-			pgpFile := &ZurichFile{
-				Path: zFile.Path + ".pgp",
-			}
-			err = PGP_Encrypt_File(src, keyReader, pgpFile.Path)
-			if err != nil {
-				log.Error(err)
-			}
-			this.pgpFiles[index] = pgpFile
-			
-			
-		}(index, zFile)
-		
-	}
-	
-	for true {
-		<- queue
-		counter--
-		if counter <= 0 {
-			break
-		}
+	ctx, span := startSpan(this.ctx, "stage.encrypt", attribute.Int("job.files", len(this.Files)))
+	err := os.MkdirAll(this.encryptedPath(""), os.ModePerm)
+	if err != nil {
+		endSpan(span, err)
+		return err
+	}
+	err = this.scheduler.Run(StageEncrypt, len(this.Files), func(index int) error {
+		return this.encryptFile(ctx, index, this.Files[index])
+	})
+	endSpan(span, err)
+	return err
+}
+
+func (this *Zurich) encryptFile(ctx context.Context, index int, zFile *ZurichFile) error {
+	this.logger().Debug("begin encrypt file:", zFile.Name)
+
+	src, err := this.readFile(ctx, zFile)
+	if err != nil {
+		return err
+	}
+	helper, err := NewPGPHelper(strings.NewReader(this.pgpKey))
+	if err != nil {
+		return err
 	}
 
+	pgpFile := &ZurichFile{
+		Path: this.encryptedPath(filepath.Base(zFile.Path) + ".pgp"),
+	}
+	err = helper.WithContext(ctx).EncryptFile(src, pgpFile.Path)
+	if err != nil {
+		this.logger().Error(err)
+		return fmt.Errorf("encrypt %s: %w", zFile.Name, err)
+	}
+	pgpFile.received, err = ChecksumFile(filepath.Base(pgpFile.Path), pgpFile.Path)
+	if err != nil {
+		this.logger().Error(err)
+		return err
+	}
+	this.pgpFiles[index] = pgpFile
+
 	return nil
 }
 
-//检查是否图片文件
-func (this *Zurich) isImage(filePath string) bool {
-	ext := filepath.Ext(filePath)
-	for _, condition := range []string{"png", "gif", "jpg", "bmp", "jpeg"} {
-		if strings.Contains(ext, condition) {
-			return true
+//读取文件内容，图片转换成PDF
+func (this *Zurich) readFile(ctx context.Context, zFile *ZurichFile) (src []byte, err error) {
+	//检查是否图片
+	if this.isImage(zFile.Path) {
+		//将图片转换成PDF
+		pdfFileName := zFile.Path + ".pdf"
+		_, span := startSpan(ctx, "pdf.convert", attribute.String("file.name", zFile.Name))
+		src, err = GetPDF(zFile.Path)
+		endSpan(span, err)
+		if err != nil {
+			this.logger().Error(err)
+			return nil, fmt.Errorf("convert %s: %w", zFile.Name, err)
 		}
+		//保存PDF，其他目的地直接读取
+		err = ioutil.WriteFile(pdfFileName, src, 0600)
+		if err != nil {
+			this.logger().Error(err)
+			return nil, err
+		}
+		zFile.Path = pdfFileName
+	} else {
+		src, err = ioutil.ReadFile(zFile.Path)
+		if err != nil {
+			this.logger().Error(err)
+			return nil, err
+		}
+	}
+	return src, nil
+}
+
+//加密文件的本地路径，每个目的地使用单独的文件夹
+func (this *Zurich) encryptedPath(name string) string {
+	folder := filepath.Join(this.conf.TempPath, this.prefixPath)
+	if len(this.destination) > 0 {
+		folder = filepath.Join(folder, ".destinations", this.destination)
 	}
+	return filepath.Join(folder, name)
+}
 
-	return false
+//检查是否图片文件
+func (this *Zurich) isImage(filePath string) bool {
+	return IsImageFile(filePath)
 }
 
 //上传到SFTP
-func (this *Zurich) UploadToSFTP() {
-	log.Info("begin upload 2 sftp")
-	ssh := NewSSHClient(&this.conf.SSH)
-	queue := make(chan bool, 0)
-	counter := 0
+func (this *Zurich) UploadToSFTP() error {
+	this.logger().Info("begin upload 2 sftp")
+	ctx, span := startSpan(this.ctx, "stage.upload", attribute.Int("job.files", len(this.pgpFiles)))
+	transport := NewTransport(ctx, &this.conf.Transport, &this.conf.SSH)
+	defer transport.Close()
 
 	prefixFolder := this.conf.GetDeployPath(this.deployENV)
+	started := time.Now()
 
-	for _, pgpFile := range this.pgpFiles {
-		counter++
-		
-		go func(pgpFile *ZurichFile) {
-			defer func() {
-				queue <- true
-			}()
-			
-			log.Info("upload 2 sftp:", pgpFile.Path)
-			
-			err := ssh.UploadFile(pgpFile.Path, prefixFolder)
-			if err != nil {
-				log.Error(err)
-			}
-		}(pgpFile)
-		
-	}
-	
-	for true {
-		<- queue
-		counter--
-		if counter <= 0 {
-			break
+	err := this.scheduler.Run(StageUpload, len(this.pgpFiles), func(index int) error {
+		pgpFile := this.pgpFiles[index]
+		this.logger().Info("upload 2 sftp:", pgpFile.Path)
+
+		vars := &NameVars{
+			Name:   strings.TrimSuffix(filepath.Base(pgpFile.Path), ".pgp"),
+			Env:    this.deployENV,
+			JobID:  this.ID(),
+			Seq:    index + 1,
+			Caller: this.caller,
+			Time:   started,
 		}
-	}
+		if received := this.Files[index].received; received != nil {
+			vars.SHA256 = received.SHA256
+		}
+		remotePath, err := this.conf.Naming.RemotePath(prefixFolder, vars)
+		if err != nil {
+			this.logger().Error(err)
+			return err
+		}
+		pgpFile.remotePath = remotePath
+		existed, err := existedBefore(transport, remotePath, this.conf.Naming.collision())
+		if err != nil {
+			this.logger().Error(err)
+			return err
+		}
+		written, err := UploadFileAs(transport, pgpFile.Path, remotePath, this.conf.Naming.collision())
+		if err != nil {
+			this.logger().Error(err)
+			return err
+		}
+		pgpFile.remotePath = written
+		pgpFile.delivered = true
+		pgpFile.created = !existed
+		return nil
+	})
+	endSpan(span, err)
+	return err
 }
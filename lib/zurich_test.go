@@ -1,8 +1,13 @@
 package lib
 
 import (
+	"errors"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"testing"
 )
@@ -62,3 +67,86 @@ func Test_Process(t *testing.T) {
 
 	z.Process()
 }
+
+func Test_DownloadChecksum(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	conf := &Config{
+		TempPath: t.TempDir(),
+		Download: DownloadConfig{AllowPrivate: true},
+	}
+	files := []*ZurichFile{
+		&ZurichFile{
+			Url:    server.URL + "/hello.txt",
+			Name:   "hello.txt",
+			SHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+			Size:   5,
+		},
+		&ZurichFile{
+			Url:    server.URL + "/other.txt",
+			Name:   "other.txt",
+			SHA256: "deadbeef",
+		},
+	}
+	z := NewZurich(conf, files, "", "dev", "")
+
+	_, err := z.DownloadRemoteFile(files[0])
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	_, err = z.DownloadRemoteFile(files[1])
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+
+	result := z.Result()
+	if len(result.Files) != 1 || result.Files[0].SHA256 != files[0].SHA256 {
+		t.Errorf("unexpected result %s", ToJSON(result))
+	}
+}
+
+func Test_Notify(t *testing.T) {
+	files := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("hello"))
+	}))
+	defer files.Close()
+	var query url.Values
+	notify := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		query = request.URL.Query()
+		writer.Write([]byte("success"))
+	}))
+	defer notify.Close()
+
+	conf := &Config{
+		TempPath: t.TempDir(),
+		Download: DownloadConfig{AllowPrivate: true},
+	}
+	z := NewZurich(conf, []*ZurichFile{
+		&ZurichFile{Url: files.URL + "/hello.txt", Name: "hello.txt"},
+		&ZurichFile{Url: files.URL + "/world.txt", Name: "world.txt"},
+	}, "", "dev", notify.URL+"/done?token=abc")
+	for _, zFile := range z.Files {
+		_, err := z.DownloadRemoteFile(zFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	z.notifyRemote(z.NotifyUrl)
+	sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	expected := url.Values{
+		"token":  {"abc"},
+		"id":     {z.ID()},
+		"file":   {"hello.txt", "world.txt"},
+		"sha256": {sum, sum},
+		"size":   {"5", "5"},
+	}
+	if !reflect.DeepEqual(query, expected) {
+		t.Errorf("unexpected notification %v", query)
+	}
+}
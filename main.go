@@ -2,24 +2,196 @@
 package main
 
 import (
+	"context"
 	"pgp-sftp-proxy/lib"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
 )
 
+// -c may be given more than once, later files override earlier ones
+type configFiles []string
+
+func (c *configFiles) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *configFiles) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
 func main() {
-	conf_path := flag.String("c", "config.json", "config json file")
+	conf_paths := configFiles{}
+	flag.Var(&conf_paths, "c", "config file, json, yaml or toml; repeat to layer files, e.g. -c base.yaml -c pro.yaml (default config.json)")
 	flag.Parse()
+	if len(conf_paths) <= 0 {
+		conf_paths = append(conf_paths, "config.json")
+	}
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	err, conf := lib.NewConfig(*conf_path)
+	err, conf := lib.NewConfig(conf_paths...)
+	if flag.Arg(0) == "validate-config" {
+		os.Exit(validateConfig(conf, err))
+	}
+	if err != nil && flag.Arg(0) == "encrypt" {
+		// encrypt only needs the key and the file
+		fmt.Fprintln(os.Stderr, "encrypting without the config:", err)
+		err, conf = nil, &lib.Config{TempPath: os.TempDir()}
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	switch flag.Arg(0) {
+	case "verify-audit":
+		os.Exit(verifyAudit(conf, flag.Arg(1)))
+	case "encrypt-secret":
+		os.Exit(encryptSecret(conf, flag.Args()[1:]))
+	case "rotate-master-key":
+		os.Exit(rotateMasterKey(conf, flag.Arg(1)))
+	case "encrypt", "upload", "batch", "watch":
+		os.Exit(runCommand(conf, flag.Arg(0), flag.Args()[1:]))
+	case "", "serve":
+	default:
+		fmt.Println("unknown command:", flag.Arg(0))
+		os.Exit(2)
+	}
+
+	err = conf.Validate()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = lib.SetupLog(&conf.Log)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	shutdownTracing, err := lib.SetupTracing(&conf.Tracing)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer shutdownTracing(context.Background())
 
 	service := lib.NewHTTP(conf)
-	service.Start()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- service.Start()
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go service.WatchConfig(ctx)
+	go service.WatchFolders(ctx)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for ctx.Err() == nil {
+		select {
+		case err = <-serveErr:
+			stop()
+			if err != nil {
+				fmt.Println(err)
+			}
+			return
+		case <-hup:
+			service.Reload()
+		case <-ctx.Done():
+		}
+	}
+	// a second signal kills the process right away
+	stop()
+	signal.Stop(hup)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout())
+	defer cancel()
+	err = service.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// verify-audit [file], checks the hash chain of the audit log
+func verifyAudit(conf *lib.Config, path string) int {
+	if len(path) <= 0 {
+		path = conf.Audit.Path
+	}
+	if len(path) <= 0 {
+		fmt.Println("no audit log, set audit.path or pass the file")
+		return 2
+	}
+	count, head, err := lib.VerifyAuditLog(path)
+	if err != nil {
+		fmt.Printf("%s: %s (%d entries verified)\n", path, err, count)
+		return 1
+	}
+	fmt.Printf("%s: ok, %d entries, head %s\n", path, count, head)
+	return 0
+}
+
+// validate-config, loads the config with the environment overrides and reports every problem.
+// The warnings, e.g. unknown settings, are listed but pass.
+func validateConfig(conf *lib.Config, err error) int {
+	if err == nil {
+		for _, warning := range conf.Warnings() {
+			fmt.Println("warning:", warning)
+		}
+		err = conf.Validate()
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println("ok")
+	return 0
+}
+
+// encrypt-secret [value], prints the value (or stdin) encrypted to the master key, for the config file
+func encryptSecret(conf *lib.Config, args []string) int {
+	var value string
+	if len(args) > 0 {
+		value = strings.Join(args, " ")
+	} else {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		value = strings.TrimRight(string(data), "\r\n")
+	}
+	encrypted, err := lib.EncryptConfigSecret(conf, value)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println(encrypted)
+	return 0
+}
+
+// rotate-master-key <new key file>, re-encrypts the secrets of the config files to the new key
+func rotateMasterKey(conf *lib.Config, newKeyFile string) int {
+	if len(newKeyFile) <= 0 {
+		fmt.Println("usage: rotate-master-key <new key file>")
+		return 2
+	}
+	counts, err := lib.RotateMasterKey(conf, newKeyFile)
+	for _, path := range conf.Paths() {
+		if count, ok := counts[path]; ok {
+			fmt.Printf("%s: %d secrets re-encrypted\n", path, count)
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
 }